@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"doit/internal/services/worker"
+	"doit/pkg/utils"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	server := os.Getenv("DOIT_SERVER")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+	capacity := runtime.NumCPU()
+	if c, err := strconv.Atoi(os.Getenv("AGENT_CAPACITY")); err == nil {
+		capacity = c
+	}
+	memoryMB := 0
+	if m, err := strconv.Atoi(os.Getenv("AGENT_MEMORY_MB")); err == nil {
+		memoryMB = m
+	}
+
+	labels := os.Getenv("AGENT_LABELS")
+	grpcAddr := os.Getenv("DOIT_GRPC_SERVER")
+	// The key is only read from the environment, flags show up in process listings
+	apiKey := os.Getenv("DOIT_API_KEY")
+
+	flag.StringVar(&server, "server", server, "base URL of the doit server")
+	flag.StringVar(&grpcAddr, "grpc", grpcAddr, "address of the executor's gRPC worker service, used instead of -server when set")
+	flag.IntVar(&capacity, "capacity", capacity, "number of CPU slots offered to jobs")
+	flag.IntVar(&memoryMB, "memory", memoryMB, "memory in MB offered to jobs, 0 doesn't track memory")
+	flag.StringVar(&labels, "labels", labels, "comma separated key=value labels matched by job node selectors")
+	flag.Parse()
+
+	if capacity < 1 {
+		log.Fatalf("Capacity must be at least 1, got %d", capacity)
+	}
+	if memoryMB < 0 {
+		log.Fatalf("Memory cannot be negative, got %d", memoryMB)
+	}
+	agentLabels, err := utils.ParseLabels(labels)
+	if err != nil {
+		log.Fatalf("Invalid labels: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if apiKey == "" {
+		log.Println("DOIT_API_KEY is not set, the server only accepts the agent if authentication is disabled")
+	}
+
+	agent := worker.NewAgent(strings.TrimRight(server, "/"), apiKey, capacity, memoryMB, agentLabels)
+	if grpcAddr != "" {
+		if agent, err = worker.NewGRPCAgent(ctx, grpcAddr, apiKey, capacity, memoryMB, agentLabels); err != nil {
+			log.Fatalf("Failed to set up gRPC transport: %v", err)
+		}
+		server = grpcAddr
+	}
+	log.Printf("Agent pulling work from %s", server)
+	if err := agent.Run(ctx); err != nil && ctx.Err() == nil {
+		log.Fatalf("Agent stopped: %v", err)
+	}
+	log.Println("Agent shut down, running jobs have been reported.")
+}
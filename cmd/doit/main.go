@@ -3,17 +3,20 @@ package main
 import (
 	"doit/internal/animation"
 	"doit/internal/api"
+	"doit/internal/auth"
+	"doit/internal/cache"
 	"doit/internal/db"
 	"doit/internal/services/executor"
 	"doit/internal/services/scheduler"
 	"doit/internal/services/worker"
-	redishandler "doit/internal/cache/redishandler"
 	"github.com/joho/godotenv"
 	"log"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	// Embed the zone database so per-job time zones resolve on hosts without tzdata
+	_ "time/tzdata"
 )
 
 func main() {
@@ -24,21 +27,35 @@ func main() {
 
 	animation.StartBootAnimation()
 
-	if err := db.ConnectDatabase(); err != nil {
+	store, err := db.NewStore(os.Getenv("DB_DRIVER"))
+	if err != nil {
 		log.Fatalf("Failed to connect to the database: %v", err)
 	}
+	defer store.Close()
 
-	rc := redishandler.GetRedisClient()
+	// Jobs, executions and schedules are cached in front of the store when a cache is configured
+	c, err := cache.New(os.Getenv("CACHE_DRIVER"))
+	if err != nil {
+		log.Fatalf("Failed to connect to the cache: %v", err)
+	}
+	store = cache.WrapStore(store, c)
 
-	if err := rc.Rdb.Set(rc.Ctx, "job:"+"1212", "something", 0).Err(); err != nil {
-		log.Printf("failed to store Job in Redis: %v", err)
+	// Clients, agents and gRPC workers all authenticate against the same keys
+	var authn *auth.Authenticator
+	if os.Getenv("AUTH_DISABLED") == "true" {
+		log.Println("API authentication is disabled, anyone who can reach the API can use it")
 	} else {
-		log.Println("Successfully stored job in Redis")
+		authn, err = auth.LoadAuthenticator(store)
+		if err != nil {
+			log.Fatalf("Error loading API authentication: %v", err)
+		}
 	}
 
-	s := scheduler.NewScheduler()
-	e := executor.NewExecutor()
-	w := worker.NewWorkerPool()
+	s := scheduler.NewScheduler(store)
+	e := executor.NewExecutor(store)
+	e.SetAuthenticator(authn)
+	w := worker.NewWorkerPool(store)
+	w.AutoscaleOn(e.Queue())
 
 	var wg sync.WaitGroup
 	wg.Add(3)
@@ -60,7 +77,7 @@ func main() {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 
-	go api.StartServer()
+	go api.StartServer(store, w, e, authn)
 
 	// Wait for termination signal
 	<-shutdown
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"doit/internal/api/middlewares"
+	"doit/internal/auth"
+	"doit/internal/db"
+	"doit/internal/services/worker"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// registerAgentRoutes adds the endpoints remote workers (doit-agent) use to pull and report work. They
+// need an agent or admin key unless authn is nil, when authentication is disabled.
+func (s *Server) registerAgentRoutes(r *gin.Engine, authn *auth.Authenticator) {
+	agent := r.Group("/api/v1/agent")
+	if authn != nil {
+		agent.Use(middlewares.AgentAuthMiddleware(authn))
+	}
+	{
+		agent.POST("/register", s.registerAgent)
+		agent.POST("/:id/heartbeat", s.actsAsWorker, s.agentHeartbeat)
+		agent.POST("/:id/lease", s.actsAsWorker, s.leaseJob)
+		agent.POST("/:id/executions/:pid/logs", s.actsAsWorker, s.streamExecutionLogs)
+		agent.POST("/:id/executions/:pid/complete", s.actsAsWorker, s.completeExecution)
+	}
+}
+
+// mayActAs answers 403 itself unless the caller registered workerID, admins may act as any worker and
+// everyone may when authentication is disabled. An execution is only reported by the worker running it,
+// so owning the worker covers its executions.
+func (s *Server) mayActAs(c *gin.Context, workerID string) bool {
+	p, ok := middlewares.PrincipalOf(c)
+	if !ok || p.Admin {
+		return true
+	}
+	err := worker.CheckOwner(s.store, workerID, p.KeyID)
+	if errors.Is(err, worker.ErrWorkerOwned) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return false
+	}
+	if err != nil {
+		agentError(c, err)
+		return false
+	}
+	return true
+}
+
+// actsAsWorker only lets the agent that registered the worker of the path through
+func (s *Server) actsAsWorker(c *gin.Context) {
+	if !s.mayActAs(c, c.Param("id")) {
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// agentError maps errors of the agent endpoints to a status code. 410 tells the agent to register again.
+func agentError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, worker.ErrWorkerInactive):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	case errors.Is(err, worker.ErrStaleExecution):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, db.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	default:
+		log.Printf("Agent request failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (s *Server) registerAgent(c *gin.Context) {
+	var w db.Worker
+	if err := c.ShouldBindJSON(&w); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+	if w.IPAddress == "" {
+		w.IPAddress = c.ClientIP()
+	}
+	if !s.mayActAs(c, w.WorkerID) {
+		return
+	}
+	w.KeyID = ""
+	if p, ok := middlewares.PrincipalOf(c); ok {
+		w.KeyID = p.KeyID
+	}
+
+	registered, err := s.pool.Registry().RegisterRemote(w)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"worker":                     registered,
+		"heartbeat_interval_seconds": s.pool.Registry().Interval().Seconds(),
+	})
+}
+
+// agentHeartbeat keeps the agent alive and tells it whether it was paused or is draining, the load it
+// reports is ignored as the executor tracks what it reserved
+func (s *Server) agentHeartbeat(c *gin.Context) {
+	status, err := s.pool.Registry().RemoteHeartbeat(c.Param("id"))
+	if err != nil {
+		agentError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Heartbeat received", "status": status})
+}
+
+// leaseJob long-polls for a job, it answers 204 when nothing was dispatched within wait
+func (s *Server) leaseJob(c *gin.Context) {
+	wait, err := time.ParseDuration(c.DefaultQuery("wait", "30s"))
+	if err != nil || wait < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid wait duration"})
+		return
+	}
+
+	// The server only notices the agent hanging up once the body has been read
+	io.Copy(io.Discard, c.Request.Body)
+	assignment, err := s.pool.Lease(c.Request.Context(), c.Param("id"), wait)
+	if err != nil {
+		agentError(c, err)
+		return
+	}
+	if assignment == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, assignment)
+}
+
+func (s *Server) streamExecutionLogs(c *gin.Context) {
+	var chunk struct {
+		Stdout string `json:"stdout"`
+		Stderr string `json:"stderr"`
+	}
+	if err := c.ShouldBindJSON(&chunk); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	cancel, err := worker.AppendOutput(s.store, c.Param("id"), c.Param("pid"), chunk.Stdout, chunk.Stderr)
+	if err != nil {
+		agentError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Output received", "cancel": cancel})
+}
+
+func (s *Server) completeExecution(c *gin.Context) {
+	var report worker.ExecutionReport
+	if err := c.ShouldBindJSON(&report); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := worker.CompleteExecution(s.store, c.Param("id"), c.Param("pid"), report); err != nil {
+		agentError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Execution recorded"})
+}
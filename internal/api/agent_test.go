@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"doit/internal/auth"
+	"doit/internal/db"
+	"doit/internal/services/worker"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The script prints, waits past a log flush and prints again, so output streams before it completes
+const streamingScript = `import sys, time
+print("started")
+sys.stdout.flush()
+time.sleep(2.5)
+print("done")
+`
+
+// storeKey stores key and returns its secret
+func storeKey(t *testing.T, store db.Store, key db.APIKey) string {
+	t.Helper()
+	secret, err := auth.NewKey(&key)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	if err := store.CreateAPIKey(&key); err != nil {
+		t.Fatalf("storing key: %v", err)
+	}
+	return secret
+}
+
+// post sends body to url with key and returns the status code
+func post(t *testing.T, url string, key string, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("posting to %s: %v", url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// waitFor polls check until it holds or timeout passes
+func waitFor(t *testing.T, timeout time.Duration, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestAgentRunsLeasedJob(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := db.NewMemoryStore()
+	pool := worker.NewWorkerPool(store)
+	s := NewServer(store, pool, nil)
+	authn, err := auth.LoadAuthenticator(store)
+	if err != nil {
+		t.Fatalf("loading authenticator: %v", err)
+	}
+
+	r := gin.New()
+	s.registerAgentRoutes(r, authn)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	// Credentials
+	agentKey := storeKey(t, store, db.APIKey{Name: "agent", UserID: "ops", Agent: true})
+	userKey := storeKey(t, store, db.APIKey{Name: "client", UserID: "alice"})
+	otherKey := storeKey(t, store, db.APIKey{Name: "other agent", UserID: "ops", Agent: true})
+	for _, tt := range []struct {
+		key  string
+		want int
+	}{{"", http.StatusUnauthorized}, {userKey, http.StatusForbidden}} {
+		if got := post(t, server.URL+"/api/v1/agent/register", tt.key, `{"capacity":1}`); got != tt.want {
+			t.Fatalf("registering with key %q answered %d, want %d", tt.key, got, tt.want)
+		}
+	}
+
+	script := filepath.Join(t.TempDir(), "stream.py")
+	if err := os.WriteFile(script, []byte(streamingScript), 0o644); err != nil {
+		t.Fatalf("writing script: %v", err)
+	}
+	job := db.Job{JobID: "a9e1", Payload: script, Status: db.JobStatusPending}
+	if err := store.CreateJob(job); err != nil {
+		t.Fatalf("creating job: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	agent := worker.NewAgent(server.URL, agentKey, 1, 0, map[string]string{"zone": "test"})
+	go func() { stopped <- agent.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	// Register
+	var registered db.Worker
+	waitFor(t, 5*time.Second, "the agent to register", func() bool {
+		workers, err := store.GetAllWorkers()
+		if err != nil || len(workers) != 1 {
+			return false
+		}
+		registered = workers[0]
+		return true
+	})
+	if registered.Status != db.WorkerActive || registered.Capacity != 1 || registered.Labels["zone"] != "test" {
+		t.Fatalf("registered %+v, want an active worker with 1 slot and its labels", registered)
+	}
+
+	// Another agent key can't act as the worker
+	if got := post(t, server.URL+"/api/v1/agent/"+registered.WorkerID+"/heartbeat", otherKey, `{}`); got != http.StatusForbidden {
+		t.Fatalf("heartbeat with another agent's key answered %d, want 403", got)
+	}
+	if got := post(t, server.URL+"/api/v1/agent/register", otherKey, `{"worker_id":"`+registered.WorkerID+`","capacity":1}`); got != http.StatusForbidden {
+		t.Fatalf("registering over another agent's worker answered %d, want 403", got)
+	}
+
+	// Lease
+	waitFor(t, 5*time.Second, "the agent to hold a lease request open", func() bool {
+		return pool.Available()[registered.WorkerID]
+	})
+	if !pool.Offer(registered.WorkerID, worker.Placement{JobID: job.JobID, CPUSlots: 1}, 5*time.Second) {
+		t.Fatalf("the agent did not take the job")
+	}
+
+	// Output streaming
+	var execution db.JobExecution
+	waitFor(t, 5*time.Second, "output to stream while the job runs", func() bool {
+		executions, err := store.GetJobExecutionsByJob(job.JobID)
+		if err != nil || len(executions) != 1 {
+			return false
+		}
+		execution = executions[0]
+		return strings.Contains(execution.Stdout, "started")
+	})
+	if execution.Status != db.JobStatusRunning || execution.WorkerID != registered.WorkerID {
+		t.Fatalf("streamed execution is %s on %s, want running on %s", execution.Status, execution.WorkerID, registered.WorkerID)
+	}
+	if strings.Contains(execution.Stdout, "done") {
+		t.Fatalf("output %q streamed only once the script finished", execution.Stdout)
+	}
+
+	// Completion
+	waitFor(t, 10*time.Second, "the agent to report the execution", func() bool {
+		execution, _ = store.GetJobExecution(execution.ProcessID)
+		return execution.Status != db.JobStatusRunning
+	})
+	if execution.Status != db.JobStatusCompleted || execution.ExitCode != 0 {
+		t.Fatalf("execution finished as %s with exit code %d, error %q", execution.Status, execution.ExitCode, execution.Error)
+	}
+	if execution.Stdout != "started\ndone\n" {
+		t.Errorf("final output %q, want both lines", execution.Stdout)
+	}
+}
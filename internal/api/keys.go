@@ -0,0 +1,178 @@
+package api
+
+import (
+	"doit/internal/api/middlewares"
+	"doit/internal/auth"
+	"doit/internal/db"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// principal returns who the request was authenticated as, it answers 403 itself when authentication
+// is disabled since there is nobody to own the keys
+func principal(c *gin.Context) (auth.Principal, bool) {
+	p, ok := middlewares.PrincipalOf(c)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API keys need authentication to be enabled"})
+	}
+	return p, ok
+}
+
+// requireAdmin only lets admins through, with authentication disabled anyone may do anything
+func requireAdmin(c *gin.Context) {
+	if p, ok := middlewares.PrincipalOf(c); ok && !p.Admin {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Only admins can do this"})
+		return
+	}
+	c.Next()
+}
+
+// createAPIKey generates a key for the caller, admins may create keys for other users, admin keys and
+// agent keys. The key is only ever shown in this response.
+func (s *Server) createAPIKey(c *gin.Context) {
+	p, ok := principal(c)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name             string `json:"name"`
+		UserID           string `json:"user_id"`
+		Admin            bool   `json:"admin"`
+		Agent            bool   `json:"agent"`
+		ExpiresInSeconds int    `json:"expires_in_seconds"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Name == "" || body.ExpiresInSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload, a key needs a name"})
+		return
+	}
+	if body.UserID == "" {
+		body.UserID = p.UserID
+	}
+	if !p.Admin && (body.UserID != p.UserID || body.Admin || body.Agent) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can create keys for other users, admin keys or agent keys"})
+		return
+	}
+	if body.Admin && body.Agent {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A key is either an admin key or an agent key"})
+		return
+	}
+
+	key := db.APIKey{Name: body.Name, UserID: body.UserID, Admin: body.Admin, Agent: body.Agent}
+	secret, err := auth.NewKey(&key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if body.ExpiresInSeconds > 0 {
+		key.ExpiresAt = key.RcreTime.Add(time.Duration(body.ExpiresInSeconds) * time.Second)
+	}
+	if err := s.store.CreateAPIKey(&key); err != nil {
+		log.Printf("Error storing API key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store API key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "API key created, it is not shown again", "key": key, "secret": secret})
+}
+
+// listAPIKeys lists the caller's keys, admins see every user's or those of ?user_id=
+func (s *Server) listAPIKeys(c *gin.Context) {
+	p, ok := principal(c)
+	if !ok {
+		return
+	}
+
+	userID := p.UserID
+	if p.Admin {
+		userID = c.Query("user_id")
+	}
+	keys, err := s.store.GetAPIKeys(userID)
+	if err != nil {
+		log.Printf("Error loading API keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load API keys"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// revokeAPIKey stops a key from authenticating, the key is kept so its use stays on record
+func (s *Server) revokeAPIKey(c *gin.Context) {
+	p, ok := principal(c)
+	if !ok {
+		return
+	}
+
+	key, err := s.store.GetAPIKey(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !p.Admin && key.UserID != p.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key belongs to another user"})
+		return
+	}
+
+	if err := s.store.RevokeAPIKey(key.KeyID, time.Now()); err != nil {
+		log.Printf("Error revoking API key %s: %v", key.KeyID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+// ownsJob answers 404 or 403 itself unless the caller may see or change the job. Admins may see and
+// change every job, and everyone may when authentication is disabled.
+func (s *Server) ownsJob(c *gin.Context, jobID string) bool {
+	p, ok := middlewares.PrincipalOf(c)
+	if !ok || p.Admin {
+		return true
+	}
+
+	job, err := s.store.GetJob(jobID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if job.UserID != p.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Job belongs to another user"})
+		return false
+	}
+	return true
+}
+
+// listedUser is whose jobs and dead letters a list shows, all is set when that is every user's.
+// Callers see their own, admins every user's or those of ?user_id, as with the API keys. With
+// authentication disabled everything is listed.
+func listedUser(c *gin.Context) (userID string, all bool) {
+	p, ok := middlewares.PrincipalOf(c)
+	if !ok {
+		return "", true
+	}
+	if p.Admin {
+		userID = c.Query("user_id")
+		return userID, userID == ""
+	}
+	return p.UserID, false
+}
+
+// ownJob makes the caller the job's user, admins may name another user
+func ownJob(c *gin.Context, job *db.Job) {
+	p, ok := middlewares.PrincipalOf(c)
+	if !ok || (p.Admin && job.UserID != "") {
+		return
+	}
+	job.UserID = p.UserID
+}
@@ -0,0 +1,74 @@
+package middlewares
+
+import (
+	"doit/internal/auth"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContextPrincipal holds the auth.Principal of an authenticated request
+const ContextPrincipal = "principal"
+
+// AuthMiddleware rejects requests that don't authenticate and records who the others are, for the
+// handlers and the rate limit. Agent keys only work on the agent endpoints.
+func AuthMiddleware(a *auth.Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, err := a.Authenticate(c.Request)
+		if err != nil {
+			abortUnauthenticated(c, err)
+			return
+		}
+		if principal.Agent {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Agent keys can only be used by agents"})
+			return
+		}
+
+		c.Set(ContextPrincipal, principal)
+		c.Set(ContextUser, principal.UserID)
+		if principal.KeyID != "" {
+			c.Set(ContextAPIKey, principal.KeyID)
+		}
+		c.Next()
+	}
+}
+
+// AgentAuthMiddleware only lets agents and admins reach the agent endpoints
+func AgentAuthMiddleware(a *auth.Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, err := a.AuthenticateAgent(c.GetHeader("X-API-Key"), c.GetHeader("Authorization"))
+		if errors.Is(err, auth.ErrNotAgent) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			abortUnauthenticated(c, err)
+			return
+		}
+
+		c.Set(ContextPrincipal, principal)
+		c.Next()
+	}
+}
+
+func abortUnauthenticated(c *gin.Context, err error) {
+	if !errors.Is(err, auth.ErrUnauthenticated) {
+		log.Printf("Error authenticating request: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	c.Header("WWW-Authenticate", `Bearer realm="doit"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+}
+
+// PrincipalOf returns who the request was authenticated as, false when authentication is disabled
+func PrincipalOf(c *gin.Context) (auth.Principal, bool) {
+	value, ok := c.Get(ContextPrincipal)
+	if !ok {
+		return auth.Principal{}, false
+	}
+	principal, ok := value.(auth.Principal)
+	return principal, ok
+}
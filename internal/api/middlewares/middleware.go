@@ -1,29 +1,15 @@
 package middlewares
 
 import (
-	"doit/internal/cache/redishandler"
+	"doit/internal/db"
 	"fmt"
-	"github.com/gin-gonic/gin"
-	"golang.org/x/time/rate"
 	"log"
-	"net/http"
+	"math/rand"
 	"time"
 )
 
-var rateLimiter = rate.NewLimiter(rate.Every(time.Minute), 100) // 100 requests per minute
-
-func RateLimitMiddleware(c *gin.Context) {
-	if !rateLimiter.Allow() {
-		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
-		c.Abort()
-		return
-	}
-	c.Next()
-}
-
-func CheckJobIdempotency(jobId string) error {
-	rc := redishandler.GetRedisClient()
-	if exists, _ := rc.Rdb.Exists(rc.Ctx, "job:"+jobId).Result(); exists == 1 {
+func CheckJobIdempotency(store db.Store, jobId string) error {
+	if _, err := store.GetJob(jobId); err == nil {
 		return fmt.Errorf("job already exists")
 	}
 	return nil
@@ -38,10 +24,7 @@ func ExponentialBackoff(retryCount int, maxRetries int) error {
     }
 
     // Exponential backoff: 2^retryCount backoff
-    delay := time.Duration(int64(baseDelay) * int64(1<<retryCount))
-    if delay > maxDelay {
-        delay = maxDelay
-    }
+    delay := BackoffDelay(db.BackoffExponential, retryCount+1, baseDelay, maxDelay)
 
     log.Printf("Retrying in %v... (attempt %d/%d)", delay, retryCount+1, maxRetries)
     time.Sleep(delay)
@@ -49,3 +32,27 @@ func ExponentialBackoff(retryCount int, maxRetries int) error {
     return nil
 }
 
+// BackoffDelay returns how long to wait before the given attempt (starting at 1) under strategy:
+// fixed always waits baseDelay, exponential doubles it every attempt and exponential_jitter
+// picks a random delay between zero and the exponential one. The result never exceeds maxDelay.
+func BackoffDelay(strategy string, attempt int, baseDelay, maxDelay time.Duration) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	delay := baseDelay
+	if strategy != db.BackoffFixed {
+		// Stop doubling once the cap is reached so large attempts can't overflow
+		for i := 1; i < attempt && delay < maxDelay; i++ {
+			delay *= 2
+		}
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if strategy == db.BackoffExponentialJitter && delay > 0 {
+		delay = time.Duration(rand.Int63n(int64(delay) + 1))
+	}
+	return delay
+}
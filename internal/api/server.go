@@ -2,33 +2,95 @@ package api
 
 import (
 	"doit/internal/api/middlewares"
+	"doit/internal/auth"
 	"doit/internal/controller"
 	"doit/internal/db"
-	"doit/internal/cache/redishandler"
+	"doit/internal/services/executor"
+	"doit/internal/services/scheduler"
+	"doit/internal/services/worker"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
-var (
-	RedisClient = redishandler.GetRedisClient()
-)
+type Server struct {
+	store    db.Store
+	pool     *worker.WorkerPool
+	executor *executor.Executor
+}
+
+func NewServer(store db.Store, pool *worker.WorkerPool, e *executor.Executor) *Server {
+	return &Server{store: store, pool: pool, executor: e}
+}
 
-func StartServer() {
+// StartServer serves the API, authn checks clients and agents and is nil when authentication is disabled
+func StartServer(store db.Store, pool *worker.WorkerPool, e *executor.Executor, authn *auth.Authenticator) {
+	s := NewServer(store, pool, e)
 	r := gin.Default()
 
-	r.Use(middlewares.RateLimitMiddleware)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	rateLimit, err := middlewares.NewRateLimitMiddleware()
+	if err != nil {
+		log.Fatalf("Error loading API rate limits: %v", err)
+	}
+	ipRateLimit, err := middlewares.NewIPRateLimitMiddleware()
+	if err != nil {
+		log.Fatalf("Error loading API rate limits: %v", err)
+	}
+
+	// Agents poll and heartbeat continuously, they stay outside the client rate limit
+	s.registerAgentRoutes(r, authn)
 
 	v1 := r.Group("/api/v1")
+	// Requests are limited by IP before authentication, failed attempts count too
+	v1.Use(ipRateLimit)
+	if authn != nil {
+		v1.Use(middlewares.AuthMiddleware(authn))
+	}
+	// The rate limit runs after authentication so it can key on the API key or user
+	v1.Use(rateLimit)
 	{
-		v1.GET("/jobs", listJobs)
-		v1.POST("/job", createJob)
-		v1.POST("/job-script", uploadJob)
-		v1.GET("/job/:id", getJob)
-		v1.PUT("/job", updateJob)
-		v1.DELETE("/job/:id", deleteJob)
+		v1.GET("/jobs", s.listJobs)
+		v1.POST("/job", s.createJob)
+		v1.POST("/job-script", s.uploadJob)
+		v1.GET("/job/:id", s.getJob)
+		v1.GET("/job/:id/placement", s.explainPlacement)
+		v1.PUT("/job", s.updateJob)
+		v1.DELETE("/job/:id", s.deleteJob)
+
+		v1.POST("/execution/:id/cancel", s.cancelExecution)
+
+		v1.GET("/api-keys", s.listAPIKeys)
+		v1.POST("/api-key", s.createAPIKey)
+		v1.DELETE("/api-key/:id", s.revokeAPIKey)
+
+		// Workers, the queue and tenant shares show every user's work, only admins see them
+		v1.GET("/workers", requireAdmin, s.listWorkers)
+		v1.GET("/worker/:id", requireAdmin, s.getWorker)
+		v1.POST("/worker/:id/cordon", requireAdmin, s.changeWorker(s.pool.Registry().Cordon, "Worker cordoned"))
+		v1.POST("/worker/:id/uncordon", requireAdmin, s.changeWorker(s.pool.Registry().Uncordon, "Worker uncordoned"))
+		v1.POST("/worker/:id/drain", requireAdmin, s.changeWorker(s.pool.Registry().Drain, "Worker draining, it becomes inactive once its running jobs finish"))
+		v1.POST("/worker/:id/pause", requireAdmin, s.changeWorker(s.pool.Registry().Pause, "Worker paused"))
+		v1.POST("/worker/:id/resume", requireAdmin, s.changeWorker(s.pool.Registry().Resume, "Worker resumed"))
+
+		v1.GET("/queue", requireAdmin, s.inspectQueue)
+		v1.GET("/tenants", requireAdmin, s.listTenantShares)
+		v1.PUT("/tenant/:id/weight", requireAdmin, s.setTenantWeight)
+		v1.DELETE("/tenant/:id/weight", requireAdmin, s.resetTenantWeight)
+		v1.GET("/rate-limits", s.listRateLimits)
+		v1.PUT("/rate-limit/:queue", requireAdmin, s.setRateLimit)
+
+		v1.GET("/dead-letters", s.listDeadLetters)
+		v1.GET("/dead-letter/:id", s.getDeadLetter)
+		v1.POST("/dead-letter/:id/requeue", requireAdmin, s.requeueDeadLetter)
+		v1.DELETE("/dead-letter/:id", requireAdmin, s.deleteDeadLetter)
+		v1.DELETE("/dead-letters", requireAdmin, s.purgeDeadLetters)
 	}
 
 	if err := r.Run(":8080"); err != nil {
@@ -37,12 +99,18 @@ func StartServer() {
 }
 
 // listJobs retrieves jobs with pagination from the database.
-func listJobs(c *gin.Context) {
+func (s *Server) listJobs(c *gin.Context) {
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
 	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
 
 	var jobs []db.Job
-	if err := db.DB.Limit(limit).Offset(offset).Find(&jobs).Error; err != nil {
+	var err error
+	if userID, all := listedUser(c); all {
+		jobs, err = s.store.GetAllJobs(limit, offset)
+	} else {
+		jobs, err = s.store.GetJobsByUser(userID, limit, offset)
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch jobs"})
 		return
 	}
@@ -65,15 +133,16 @@ func listJobs(c *gin.Context) {
 	})
 }
 
-func createJob(c *gin.Context) {
+func (s *Server) createJob(c *gin.Context) {
 	var job db.Job
 
 	if err := c.ShouldBindJSON(&job); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
+	ownJob(c, &job)
 
-	jc, err := controller.NewJobController("JobOperationController")
+	jc, err := controller.NewJobController("JobOperationController", s.store)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
 		log.Fatal(err.Error())
@@ -88,7 +157,7 @@ func createJob(c *gin.Context) {
 	c.JSON(http.StatusCreated, gin.H{"message": "Job created successfully", "job": job})
 }
 
-func uploadJob(c *gin.Context) {
+func (s *Server) uploadJob(c *gin.Context) {
 	file, err := c.FormFile("script")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "File upload failed"})
@@ -99,7 +168,10 @@ func uploadJob(c *gin.Context) {
 		return
 	}
 	jobId := c.Request.Header.Get("job_id")
-	jc, err := controller.NewJobController("JobOperationController")
+	if !s.ownsJob(c, jobId) {
+		return
+	}
+	jc, err := controller.NewJobController("JobOperationController", s.store)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
 		log.Fatal(err.Error())
@@ -114,10 +186,13 @@ func uploadJob(c *gin.Context) {
 }
 
 
-func getJob(c *gin.Context) {
+func (s *Server) getJob(c *gin.Context) {
 	jobID := c.Param("id")
+	if !s.ownsJob(c, jobID) {
+		return
+	}
 
-	jc, err := controller.NewJobController("JobOperationController")
+	jc, err := controller.NewJobController("JobOperationController", s.store)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
 		log.Fatal(err.Error())
@@ -133,15 +208,60 @@ func getJob(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"job": job})
 }
 
-func updateJob(c *gin.Context) {
+// explainPlacement tells which workers could run the job, why the others can't, and why it is still
+// queued if it is
+func (s *Server) explainPlacement(c *gin.Context) {
+	jobID := c.Param("id")
+	if !s.ownsJob(c, jobID) {
+		return
+	}
+
+	job, err := s.store.GetJob(jobID)
+	if errors.Is(err, db.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading job %s: %v", jobID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load job"})
+		return
+	}
+
+	workers, err := s.executor.ExplainPlacement(s.pool, &job)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to explain placement: %s", err.Error())})
+		return
+	}
+
+	response := gin.H{
+		"job_id":        job.JobID,
+		"node_selector": job.NodeSelector,
+		"anti_affinity": job.AntiAffinity,
+		"request":       scheduler.RequestOf(&job),
+		"workers":       workers,
+	}
+	for _, queued := range s.executor.Queue().Inspect(time.Now()) {
+		if queued.JobID == job.JobID {
+			response["queued"] = true
+			response["reason"] = queued.Reason
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) updateJob(c *gin.Context) {
 	var job db.Job
 
 	if err := c.ShouldBindJSON(&job); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 		return
 	}
+	if !s.ownsJob(c, job.JobID) {
+		return
+	}
+	ownJob(c, &job)
 
-	jc, err := controller.NewJobController("JobOperationController")
+	jc, err := controller.NewJobController("JobOperationController", s.store)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
 		log.Fatal(err.Error())
@@ -156,10 +276,13 @@ func updateJob(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Job updated successfully", "job": job})
 }
 
-func deleteJob(c *gin.Context) {
+func (s *Server) deleteJob(c *gin.Context) {
 	jobID := c.Param("id")
+	if !s.ownsJob(c, jobID) {
+		return
+	}
 
-	jc, err := controller.NewJobController("JobOperationController")
+	jc, err := controller.NewJobController("JobOperationController", s.store)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
 		log.Fatal(err.Error())
@@ -173,3 +296,233 @@ func deleteJob(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Job deleted successfully"})
 }
+
+// cancelExecution stops a running execution, on whichever worker it runs. The execution is
+// recorded as cancelled once the worker has stopped the script.
+func (s *Server) cancelExecution(c *gin.Context) {
+	processID := c.Param("id")
+
+	if _, ok := middlewares.PrincipalOf(c); ok {
+		execution, err := s.store.GetJobExecution(processID)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Execution not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !s.ownsJob(c, execution.JobID) {
+			return
+		}
+	}
+
+	if err := worker.CancelExecution(s.store, processID); err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Execution not found"})
+		case errors.Is(err, worker.ErrStaleExecution):
+			c.JSON(http.StatusConflict, gin.H{"error": "Execution is not running"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to cancel execution: %s", err.Error())})
+		}
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Cancellation requested"})
+}
+
+// inspectQueue lists the due jobs waiting for a worker with their aged priority and how long they waited
+func (s *Server) inspectQueue(c *gin.Context) {
+	queue := s.executor.Queue()
+	aging := queue.Aging()
+	c.JSON(http.StatusOK, gin.H{
+		"jobs":                   queue.Inspect(time.Now()),
+		"aging_interval_seconds": aging.Interval.Seconds(),
+		"aging_cap":              aging.Cap,
+	})
+}
+
+// listTenantShares shows each tenant's weight next to the share of jobs it actually received
+func (s *Server) listTenantShares(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"tenants": s.executor.FairShare().Shares()})
+}
+
+func (s *Server) setTenantWeight(c *gin.Context) {
+	var body struct {
+		Weight int `json:"weight"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := s.executor.FairShare().SetWeight(c.Param("id"), body.Weight); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Tenant weight updated successfully", "tenant": c.Param("id"), "weight": body.Weight})
+}
+
+// resetTenantWeight puts the tenant back on the default weight
+func (s *Server) resetTenantWeight(c *gin.Context) {
+	s.executor.FairShare().ResetWeight(c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"message": "Tenant weight reset successfully"})
+}
+
+// listRateLimits shows each queue's token bucket with the tokens it has left
+func (s *Server) listRateLimits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"queues": s.executor.RateLimits().Buckets()})
+}
+
+// setRateLimit replaces the capacity and refill of a queue's token bucket, executors sharing the
+// buckets through Redis pick it up too
+func (s *Server) setRateLimit(c *gin.Context) {
+	queue, err := scheduler.ParseQueue(c.Param("queue"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	var limit scheduler.RateLimit
+	if err := c.ShouldBindJSON(&limit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	if err := s.executor.RateLimits().Set(queue, limit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Rate limit updated successfully", "queue": queue.String(), "rate_limit": limit})
+}
+
+// listDeadLetters retrieves dead-lettered jobs with pagination, newest first.
+func (s *Server) listDeadLetters(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	dc, err := controller.NewDeadLetterController("DeadLetterOperationController", s.store)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Fatal(err.Error())
+		return
+	}
+
+	var deadLetters []db.DeadLetter
+	if userID, all := listedUser(c); all {
+		deadLetters, err = dc.ListDeadLetters(limit, offset)
+	} else {
+		deadLetters, err = dc.ListDeadLettersByUser(userID, limit, offset)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch dead letters"})
+		return
+	}
+
+	response := make([]map[string]interface{}, len(deadLetters))
+	for i, deadLetter := range deadLetters {
+		response[i] = map[string]interface{}{
+			"dead_letter": deadLetter,
+			"_links": map[string]string{
+				"self":    fmt.Sprintf("/dead-letter/%s", deadLetter.DeadLetterID),
+				"requeue": fmt.Sprintf("/dead-letter/%s/requeue", deadLetter.DeadLetterID),
+				"job":     fmt.Sprintf("/job/%s", deadLetter.JobID),
+			},
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"dead_letters": response,
+		"limit":        limit,
+		"offset":       offset,
+	})
+}
+
+func (s *Server) getDeadLetter(c *gin.Context) {
+	deadLetterID := c.Param("id")
+
+	dc, err := controller.NewDeadLetterController("DeadLetterOperationController", s.store)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Fatal(err.Error())
+		return
+	}
+
+	deadLetter, err := dc.GetDeadLetter(deadLetterID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return
+	}
+	if p, ok := middlewares.PrincipalOf(c); ok && !p.Admin && deadLetter.UserID != p.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Dead letter belongs to another user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dead_letter": deadLetter})
+}
+
+func (s *Server) requeueDeadLetter(c *gin.Context) {
+	deadLetterID := c.Param("id")
+
+	dc, err := controller.NewDeadLetterController("DeadLetterOperationController", s.store)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Fatal(err.Error())
+		return
+	}
+
+	schedule, err := dc.RequeueDeadLetter(deadLetterID)
+	if errors.Is(err, db.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to requeue job: %s", err.Error())})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Job requeued successfully", "schedule": schedule})
+}
+
+func (s *Server) deleteDeadLetter(c *gin.Context) {
+	deadLetterID := c.Param("id")
+
+	dc, err := controller.NewDeadLetterController("DeadLetterOperationController", s.store)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Fatal(err.Error())
+		return
+	}
+
+	if err := dc.DeleteDeadLetter(deadLetterID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to delete dead letter: %s", err.Error())})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Dead letter deleted successfully"})
+}
+
+// purgeDeadLetters drops every dead letter without requeueing the jobs.
+func (s *Server) purgeDeadLetters(c *gin.Context) {
+	dc, err := controller.NewDeadLetterController("DeadLetterOperationController", s.store)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Fatal(err.Error())
+		return
+	}
+
+	purged, err := dc.PurgeDeadLetters()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge dead letters"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Dead letters purged successfully", "purged": purged})
+}
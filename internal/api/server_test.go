@@ -0,0 +1,68 @@
+package api
+
+import (
+	"doit/internal/db"
+	"doit/internal/services/executor"
+	"doit/internal/services/scheduler"
+	"doit/internal/services/worker"
+	"doit/pkg/utils"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestExplainPlacement(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := db.NewMemoryStore()
+	pool := worker.NewWorkerPool(store)
+	s := NewServer(store, pool, executor.NewExecutor(store))
+
+	r := gin.New()
+	r.GET("/job/:id/placement", s.explainPlacement)
+
+	for _, w := range []db.Worker{
+		{WorkerID: "gpu-1", Capacity: 4, Labels: map[string]string{"gpu": "true"}},
+		{WorkerID: "cpu-1", Capacity: 4, Labels: map[string]string{"gpu": "false"}},
+	} {
+		if _, err := pool.Registry().RegisterRemote(w); err != nil {
+			t.Fatalf("registering %s: %v", w.WorkerID, err)
+		}
+	}
+	// Job IDs are sha256 hex, 64 characters long
+	job := db.Job{JobID: utils.HashAndGenerateId("explain", "placement"), CPUSlots: 2, NodeSelector: []string{"gpu=true"}}
+	if err := store.CreateJob(job); err != nil {
+		t.Fatalf("creating job: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/job/"+job.JobID+"/placement", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("explaining placement answered %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var answer struct {
+		JobID   string                `json:"job_id"`
+		Workers []scheduler.WorkerFit `json:"workers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body.String(), err)
+	}
+	if answer.JobID != job.JobID || len(answer.Workers) != 2 {
+		t.Fatalf("explained %s with %d workers, want %s with 2", answer.JobID, len(answer.Workers), job.JobID)
+	}
+	for _, fit := range answer.Workers {
+		wantFits := fit.WorkerID == "gpu-1"
+		if fit.Fits != wantFits || (!fit.Fits && fit.Reason == "") {
+			t.Errorf("worker %s fits %v, reason %q, want fits %v and a reason when it doesn't", fit.WorkerID, fit.Fits, fit.Reason, wantFits)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/job/"+utils.HashAndGenerateId("missing")+"/placement", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("explaining a missing job answered %d, want 404", rec.Code)
+	}
+}
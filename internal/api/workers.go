@@ -0,0 +1,64 @@
+package api
+
+import (
+	"doit/internal/db"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+)
+
+func (s *Server) listWorkers(c *gin.Context) {
+	workers, err := s.store.GetAllWorkers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load workers"})
+		log.Printf("Error loading workers: %v", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"workers": workers})
+}
+
+// getWorker shows a worker with the executions still running on it, which a drain waits for
+func (s *Server) getWorker(c *gin.Context) {
+	w, err := s.store.GetWorker(c.Param("id"))
+	if err != nil {
+		workerError(c, err)
+		return
+	}
+	running, err := s.store.GetJobExecutionsByWorker(w.WorkerID, db.JobStatusRunning)
+	if err != nil {
+		workerError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"worker": w, "running": running})
+}
+
+// workerError maps errors of the worker admin endpoints to a status code, a change the worker's
+// status doesn't allow is a conflict
+func workerError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Worker not found"})
+	case errors.Is(err, db.ErrWorkerStatus):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Worker request failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// changeWorker returns a handler that applies change to the worker and answers with its new state
+func (s *Server) changeWorker(change func(workerID string) error, message string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := change(c.Param("id")); err != nil {
+			workerError(c, err)
+			return
+		}
+		w, err := s.store.GetWorker(c.Param("id"))
+		if err != nil {
+			workerError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": message, "worker": w})
+	}
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"doit/internal/db"
+	"doit/pkg/utils"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// KeyPrefix starts every API key, a bearer token starting with it is an API key and not a JWT
+const KeyPrefix = "doit_"
+
+// touchInterval limits how often a key's LastUsedAt is written, not every request needs a write
+const touchInterval = time.Minute
+
+// ErrUnauthenticated is returned when a request carries no credentials or ones that don't check out
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// ErrNotAgent is returned for credentials that authenticate but may not act as a worker
+var ErrNotAgent = errors.New("only agent and admin keys may act as workers")
+
+// Principal is who a request was authenticated as. KeyID is set for API keys, Method is "api_key" or "jwt".
+// Agent is set for the keys of doit-agents, which may only act as workers.
+type Principal struct {
+	UserID string `json:"user_id"`
+	KeyID  string `json:"key_id,omitempty"`
+	Admin  bool   `json:"admin"`
+	Agent  bool   `json:"agent,omitempty"`
+	Method string `json:"method"`
+}
+
+// Authenticator checks API keys against the store and bearer tokens against the configured JWT keys
+type Authenticator struct {
+	store db.Store
+	jwt   *JWTVerifier
+}
+
+// LoadAuthenticator reads the JWT settings from the environment and stores the AUTH_BOOTSTRAP_KEY,
+// an admin key for AUTH_BOOTSTRAP_USER (admin by default) to create the first real keys with
+func LoadAuthenticator(store db.Store) (*Authenticator, error) {
+	verifier, err := LoadJWTVerifier()
+	if err != nil {
+		return nil, err
+	}
+	a := &Authenticator{store: store, jwt: verifier}
+
+	if secret := os.Getenv("AUTH_BOOTSTRAP_KEY"); secret != "" {
+		user := os.Getenv("AUTH_BOOTSTRAP_USER")
+		if user == "" {
+			user = "admin"
+		}
+		if err := a.bootstrap(secret, user); err != nil {
+			return nil, err
+		}
+	}
+	if verifier == nil && os.Getenv("AUTH_BOOTSTRAP_KEY") == "" {
+		log.Println("No JWT keys are configured, only API keys stored in the database are accepted")
+	}
+	return a, nil
+}
+
+func (a *Authenticator) bootstrap(secret, user string) error {
+	if len(secret) < 32 {
+		return fmt.Errorf("AUTH_BOOTSTRAP_KEY must be at least 32 characters")
+	}
+	hash := HashKey(secret)
+	if _, err := a.store.GetAPIKeyByHash(hash); err == nil {
+		return nil
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("error looking up the bootstrap key: %v", err)
+	}
+	key := db.APIKey{
+		KeyID:    utils.GenerateAPIKeyId(),
+		Name:     "bootstrap",
+		UserID:   user,
+		Prefix:   keyPrefix(secret),
+		Hash:     hash,
+		Admin:    true,
+		RcreTime: time.Now(),
+	}
+	if err := a.store.CreateAPIKey(&key); err != nil {
+		return fmt.Errorf("error storing the bootstrap key: %v", err)
+	}
+	log.Printf("Stored the bootstrap API key %s for %s", key.KeyID, user)
+	return nil
+}
+
+// HashKey is what the store keeps of an API key
+func HashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func keyPrefix(secret string) string {
+	if len(secret) > len(KeyPrefix)+8 {
+		return secret[:len(KeyPrefix)+8]
+	}
+	return secret
+}
+
+// NewKey generates an API key for key, which gets its ID, prefix and hash. The secret is returned
+// once and never stored.
+func NewKey(key *db.APIKey) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating API key: %v", err)
+	}
+	secret := KeyPrefix + hex.EncodeToString(b)
+
+	key.KeyID = utils.GenerateAPIKeyId()
+	key.Prefix = keyPrefix(secret)
+	key.Hash = HashKey(secret)
+	key.RcreTime = time.Now()
+	return secret, nil
+}
+
+// Authenticate checks the X-API-Key header, or else an Authorization: Bearer header holding an API
+// key or a JWT
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	return a.AuthenticateHeaders(r.Header.Get("X-API-Key"), r.Header.Get("Authorization"))
+}
+
+// AuthenticateHeaders checks the values of the X-API-Key and Authorization headers, gRPC callers send
+// them as metadata of the same names
+func (a *Authenticator) AuthenticateHeaders(apiKey, authorization string) (Principal, error) {
+	if apiKey != "" {
+		return a.checkKey(apiKey)
+	}
+
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return Principal{}, ErrUnauthenticated
+	}
+	if strings.HasPrefix(token, KeyPrefix) {
+		return a.checkKey(token)
+	}
+	if a.jwt == nil {
+		return Principal{}, fmt.Errorf("%w: JWTs are not accepted", ErrUnauthenticated)
+	}
+	return a.jwt.Verify(token)
+}
+
+// AuthenticateAgent is AuthenticateHeaders for workers, only agent keys and admins may register and
+// take jobs
+func (a *Authenticator) AuthenticateAgent(apiKey, authorization string) (Principal, error) {
+	p, err := a.AuthenticateHeaders(apiKey, authorization)
+	if err != nil {
+		return p, err
+	}
+	if !p.Agent && !p.Admin {
+		return p, ErrNotAgent
+	}
+	return p, nil
+}
+
+func (a *Authenticator) checkKey(secret string) (Principal, error) {
+	key, err := a.store.GetAPIKeyByHash(HashKey(secret))
+	if errors.Is(err, db.ErrNotFound) {
+		return Principal{}, fmt.Errorf("%w: unknown API key", ErrUnauthenticated)
+	}
+	if err != nil {
+		return Principal{}, fmt.Errorf("error looking up API key: %v", err)
+	}
+
+	now := time.Now()
+	if !key.RevokedAt.IsZero() {
+		return Principal{}, fmt.Errorf("%w: API key revoked", ErrUnauthenticated)
+	}
+	if !key.ExpiresAt.IsZero() && now.After(key.ExpiresAt) {
+		return Principal{}, fmt.Errorf("%w: API key expired", ErrUnauthenticated)
+	}
+	if now.Sub(key.LastUsedAt) > touchInterval {
+		if err := a.store.TouchAPIKey(key.KeyID, now); err != nil {
+			log.Printf("Error recording use of API key %s: %v", key.KeyID, err)
+		}
+	}
+	return Principal{UserID: key.UserID, KeyID: key.KeyID, Admin: key.Admin, Agent: key.Agent, Method: "api_key"}, nil
+}
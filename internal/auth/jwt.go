@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AdminRole in a token's roles claim makes its subject an admin
+const AdminRole = "admin"
+
+// claims are the registered claims plus roles, the subject is the user
+type claims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles"`
+}
+
+// JWTVerifier accepts HS256 tokens signed with the shared secret and RS256 tokens signed by the
+// private half of the public key, whichever are configured. Tokens must expire.
+type JWTVerifier struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	parser    *jwt.Parser
+}
+
+// LoadJWTVerifier reads JWT_HS256_SECRET and JWT_RS256_PUBLIC_KEY (a PEM key or the path of one),
+// JWT_ISSUER and JWT_AUDIENCE are checked when set. It returns nil when no key is configured.
+func LoadJWTVerifier() (*JWTVerifier, error) {
+	v := &JWTVerifier{}
+	var methods []string
+
+	if secret := os.Getenv("JWT_HS256_SECRET"); secret != "" {
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("JWT_HS256_SECRET must be at least 32 characters")
+		}
+		v.secret = []byte(secret)
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+
+	if value := os.Getenv("JWT_RS256_PUBLIC_KEY"); value != "" {
+		pem := []byte(value)
+		if !strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+			var err error
+			if pem, err = os.ReadFile(value); err != nil {
+				return nil, fmt.Errorf("error reading JWT_RS256_PUBLIC_KEY: %v", err)
+			}
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT_RS256_PUBLIC_KEY: %v", err)
+		}
+		v.publicKey = key
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+
+	if len(methods) == 0 {
+		return nil, nil
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired()}
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		options = append(options, jwt.WithAudience(audience))
+	}
+	v.parser = jwt.NewParser(options...)
+	return v, nil
+}
+
+// key picks the verification key by the token's algorithm, WithValidMethods already ruled out the others
+func (v *JWTVerifier) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return v.secret, nil
+	case *jwt.SigningMethodRSA:
+		return v.publicKey, nil
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+}
+
+// Verify checks the token's signature and claims, its subject becomes the principal's user
+func (v *JWTVerifier) Verify(token string) (Principal, error) {
+	var c claims
+	if _, err := v.parser.ParseWithClaims(token, &c, v.key); err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	if c.Subject == "" {
+		return Principal{}, fmt.Errorf("%w: token has no subject", ErrUnauthenticated)
+	}
+	return Principal{UserID: c.Subject, Admin: slices.Contains(c.Roles, AdminRole), Method: "jwt"}, nil
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"doit/internal/cache/redishandler"
+	"doit/internal/db"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	DriverRedis = "redis"
+	DriverNone  = "none"
+)
+
+// ErrMiss is returned by Get when the key isn't cached
+var ErrMiss = errors.New("cache miss")
+
+// Cache keeps copies of what the Store holds, a nil Cache caches nothing
+type Cache interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	// Add sets key only if it isn't cached yet, it reports whether it did
+	Add(key string, value []byte, ttl time.Duration) (bool, error)
+	Del(key string) error
+}
+
+// Redis is a Cache on the shared Redis client
+type Redis struct {
+	rc *redishandler.RedisClient
+}
+
+func NewRedis(rc *redishandler.RedisClient) *Redis {
+	return &Redis{rc: rc}
+}
+
+func (r *Redis) Get(key string) ([]byte, error) {
+	value, err := r.rc.Rdb.Get(r.rc.Ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrMiss
+	}
+	return value, err
+}
+
+func (r *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	return r.rc.Rdb.Set(r.rc.Ctx, key, value, ttl).Err()
+}
+
+func (r *Redis) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	return r.rc.Rdb.SetNX(r.rc.Ctx, key, value, ttl).Result()
+}
+
+func (r *Redis) Del(key string) error {
+	return r.rc.Rdb.Del(r.rc.Ctx, key).Err()
+}
+
+// New opens the cache named by driver, falling back to CACHE_DRIVER. Without either, Postgres
+// installs cache in Redis and SQLite or memory ones, which have to run without Redis, cache nothing.
+// It returns nil for no cache.
+func New(driver string) (Cache, error) {
+	if driver == "" {
+		driver = os.Getenv("CACHE_DRIVER")
+	}
+	if driver == "" {
+		switch os.Getenv("DB_DRIVER") {
+		case db.DriverSQLite, db.DriverMemory:
+			driver = DriverNone
+		default:
+			driver = DriverRedis
+		}
+	}
+
+	switch driver {
+	case DriverRedis:
+		return NewRedis(redishandler.GetRedisClient()), nil
+	case DriverNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown cache driver: %v", driver)
+	}
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"doit/internal/db"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// JobTTL bounds how long a job stays cached, JobHoldOff how long after a write to it a job isn't
+// cached again. A GetJob that read the job before the write can't fill the cache in that window.
+const (
+	JobTTL     = 10 * time.Minute
+	JobHoldOff = 10 * time.Second
+)
+
+// Store reads jobs through a Cache and writes executions to it, everything else goes straight to
+// the wrapped Store
+type Store struct {
+	db.Store
+	cache Cache
+}
+
+// WrapStore puts cache in front of store, store is returned as it is when cache is nil
+func WrapStore(store db.Store, cache Cache) db.Store {
+	if cache == nil {
+		return store
+	}
+	return &Store{Store: store, cache: cache}
+}
+
+// Executions are keyed by process id, they must not overwrite the job:<id> entries
+func jobKey(jobID string) string           { return "job:" + jobID }
+func executionKey(processID string) string { return "JobExecution:" + processID }
+
+// holdOff is cached in place of a job that was just written
+var holdOff = []byte{}
+
+func (s *Store) set(key string, value interface{}, ttl time.Duration) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", key, err)
+	}
+	if err := s.cache.Set(key, b, ttl); err != nil {
+		return fmt.Errorf("failed to cache %s: %v", key, err)
+	}
+	return nil
+}
+
+// invalidateJob replaces the cached job with a hold-off marker once the store has been written
+func (s *Store) invalidateJob(jobID string) error {
+	if err := s.cache.Set(jobKey(jobID), holdOff, JobHoldOff); err != nil {
+		return fmt.Errorf("failed to invalidate cached job %s: %v", jobID, err)
+	}
+	return nil
+}
+
+func (s *Store) CreateJob(job db.Job) error {
+	if err := s.Store.CreateJob(job); err != nil {
+		return err
+	}
+	return s.invalidateJob(job.JobID)
+}
+
+// GetJob answers from the cache. A miss is loaded from the store and cached only if nothing was
+// cached meanwhile, a write since the load has left its hold-off marker and the load may be stale.
+func (s *Store) GetJob(jobID string) (db.Job, error) {
+	b, err := s.cache.Get(jobKey(jobID))
+	fill := errors.Is(err, ErrMiss)
+	if err == nil && len(b) > 0 {
+		var job db.Job
+		if err := json.Unmarshal(b, &job); err == nil {
+			return job, nil
+		}
+	} else if err != nil && !fill {
+		log.Printf("Error reading job %s from the cache: %v", jobID, err)
+	}
+
+	job, err := s.Store.GetJob(jobID)
+	if err != nil {
+		return db.Job{}, err
+	}
+	if fill {
+		b, err := json.Marshal(job)
+		if err == nil {
+			_, err = s.cache.Add(jobKey(jobID), b, JobTTL)
+		}
+		if err != nil {
+			log.Printf("Error caching job %s: %v", jobID, err)
+		}
+	}
+	return job, nil
+}
+
+func (s *Store) UpdateJob(job db.Job) error {
+	if err := s.Store.UpdateJob(job); err != nil {
+		return err
+	}
+	return s.invalidateJob(job.JobID)
+}
+
+func (s *Store) UpdateJobPayload(jobID string, newPayload string) error {
+	if err := s.Store.UpdateJobPayload(jobID, newPayload); err != nil {
+		return err
+	}
+	return s.invalidateJob(jobID)
+}
+
+func (s *Store) DeleteJob(jobID string) error {
+	if err := s.Store.DeleteJob(jobID); err != nil {
+		return err
+	}
+	return s.invalidateJob(jobID)
+}
+
+func (s *Store) CreateJobExecution(je *db.JobExecution) error {
+	if err := s.Store.CreateJobExecution(je); err != nil {
+		return err
+	}
+	return s.set(executionKey(je.ProcessID), je, 0)
+}
+
+func (s *Store) UpdateJobExecution(je db.JobExecution) error {
+	if err := s.Store.UpdateJobExecution(je); err != nil {
+		return err
+	}
+	return s.set(executionKey(je.ProcessID), je, 0)
+}
+
+// FinishRunningExecution and SetRunningExecutionOutput only write some columns, the cached execution is dropped
+func (s *Store) FinishRunningExecution(je db.JobExecution) (bool, error) {
+	finished, err := s.Store.FinishRunningExecution(je)
+	if err != nil {
+		return false, err
+	}
+	return finished, s.cache.Del(executionKey(je.ProcessID))
+}
+
+func (s *Store) SetRunningExecutionOutput(processID string, stdout string, stderr string) (bool, error) {
+	set, err := s.Store.SetRunningExecutionOutput(processID, stdout, stderr)
+	if err != nil {
+		return false, err
+	}
+	return set, s.cache.Del(executionKey(processID))
+}
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"context"
+	"doit/internal/cache/redishandler"
+	"doit/internal/db"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// racingStore runs write, once, between loading a job and handing it back, as a writer racing a
+// cache miss would
+type racingStore struct {
+	db.Store
+	write func()
+}
+
+func (s *racingStore) GetJob(jobID string) (db.Job, error) {
+	job, err := s.Store.GetJob(jobID)
+	if write := s.write; write != nil {
+		s.write = nil
+		write()
+	}
+	return job, err
+}
+
+func cachedStore(t *testing.T) (*miniredis.Miniredis, *racingStore, db.Store) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	backing := &racingStore{Store: db.NewMemoryStore()}
+	return mr, backing, WrapStore(backing, NewRedis(&redishandler.RedisClient{Rdb: client, Ctx: context.Background()}))
+}
+
+func getPayload(t *testing.T, store db.Store, jobID string) string {
+	t.Helper()
+	job, err := store.GetJob(jobID)
+	if err != nil {
+		t.Fatalf("loading job: %v", err)
+	}
+	return job.Payload
+}
+
+func TestCachedJobsExpireAndAreInvalidated(t *testing.T) {
+	mr, _, store := cachedStore(t)
+	job := db.Job{JobID: "c0ffee", Payload: "v1"}
+	if err := store.CreateJob(job); err != nil {
+		t.Fatalf("creating job: %v", err)
+	}
+
+	// Writes hold the job off the cache, reads in that window go to the store
+	if got := getPayload(t, store, job.JobID); got != "v1" {
+		t.Fatalf("read %q, want v1", got)
+	}
+	if ttl := mr.TTL(jobKey(job.JobID)); ttl != JobHoldOff {
+		t.Fatalf("cached job right after creating it with ttl %v, want the hold-off of %v", ttl, JobHoldOff)
+	}
+
+	mr.FastForward(JobHoldOff)
+	if got := getPayload(t, store, job.JobID); got != "v1" {
+		t.Fatalf("read %q, want v1", got)
+	}
+	if ttl := mr.TTL(jobKey(job.JobID)); ttl != JobTTL {
+		t.Fatalf("cached job with ttl %v, want %v", ttl, JobTTL)
+	}
+
+	job.Payload = "v2"
+	if err := store.UpdateJob(job); err != nil {
+		t.Fatalf("updating job: %v", err)
+	}
+	if got := getPayload(t, store, job.JobID); got != "v2" {
+		t.Fatalf("read %q after updating the job, want v2", got)
+	}
+
+	if err := store.DeleteJob(job.JobID); err != nil {
+		t.Fatalf("deleting job: %v", err)
+	}
+	if _, err := store.GetJob(job.JobID); err == nil {
+		t.Fatalf("a deleted job is still read from the cache")
+	}
+}
+
+func TestCacheMissRacingAWriteDoesNotCacheTheOldJob(t *testing.T) {
+	mr, backing, store := cachedStore(t)
+	job := db.Job{JobID: "c0ffee", Payload: "v1"}
+	if err := store.CreateJob(job); err != nil {
+		t.Fatalf("creating job: %v", err)
+	}
+	mr.FastForward(JobHoldOff)
+
+	// The reader loads v1, v2 is written before it fills the cache
+	backing.write = func() {
+		if err := store.UpdateJobPayload(job.JobID, "v2"); err != nil {
+			t.Fatalf("updating payload: %v", err)
+		}
+	}
+	if got := getPayload(t, store, job.JobID); got != "v1" {
+		t.Fatalf("racing read got %q, want the v1 it loaded", got)
+	}
+	if got := getPayload(t, store, job.JobID); got != "v2" {
+		t.Fatalf("read %q after the racing read, want v2", got)
+	}
+
+	mr.FastForward(JobHoldOff)
+	if got := getPayload(t, store, job.JobID); got != "v2" {
+		t.Fatalf("read %q once the hold-off passed, want v2", got)
+	}
+	if got := getPayload(t, store, job.JobID); got != "v2" {
+		t.Fatalf("read %q from the cache, want v2", got)
+	}
+}
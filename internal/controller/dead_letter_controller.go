@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"doit/internal/db"
+	"doit/pkg/utils"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type DeadLetterController interface {
+	DeadLetterJob(job *db.Job, last *db.JobExecution) (*db.DeadLetter, error)
+	GetDeadLetter(deadLetterID string) (*db.DeadLetter, error)
+	ListDeadLetters(limit, offset int) ([]db.DeadLetter, error)
+	ListDeadLettersByUser(userID string, limit, offset int) ([]db.DeadLetter, error)
+	RequeueDeadLetter(deadLetterID string) (*db.Schedule, error)
+	DeleteDeadLetter(deadLetterID string) error
+	PurgeDeadLetters() (int64, error)
+}
+
+type DeadLetterOperationController struct {
+	store db.Store
+}
+
+func NewDeadLetterOperationController(store db.Store) *DeadLetterOperationController {
+	return &DeadLetterOperationController{store: store}
+}
+
+// DeadLetterJob moves a job that used up its retries into the dead-letter table. The attempts are
+// the failed executions back to the last successful one, last is the execution that gave up.
+func (dc *DeadLetterOperationController) DeadLetterJob(job *db.Job, last *db.JobExecution) (*db.DeadLetter, error) {
+	executions, err := dc.store.GetJobExecutionsByJob(job.JobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load executions of job %s: %v", job.JobID, err)
+	}
+
+	var executionIDs []string
+	for i := len(executions) - 1; i >= 0 && len(executionIDs) <= job.MaxRetries; i-- {
+		if executions[i].Status == db.JobStatusCompleted {
+			break
+		}
+		executionIDs = append([]string{executions[i].ProcessID}, executionIDs...)
+	}
+
+	now := time.Now()
+	deadLetter := &db.DeadLetter{
+		DeadLetterID: utils.HashAndGenerateId(job.JobID, last.ProcessID, now),
+		JobID:        job.JobID,
+		UserID:       job.UserID,
+		LastError:    last.Error,
+		LastStatus:   last.Status,
+		Attempts:     len(executionIDs),
+		ExecutionIDs: executionIDs,
+		RcreTime:     now,
+	}
+	if err := dc.store.CreateDeadLetter(deadLetter); err != nil {
+		return nil, fmt.Errorf("failed to save dead letter: %v", err)
+	}
+
+	return deadLetter, nil
+}
+
+func (dc *DeadLetterOperationController) GetDeadLetter(deadLetterID string) (*db.DeadLetter, error) {
+	deadLetter, err := dc.store.GetDeadLetter(deadLetterID)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetter, nil
+}
+
+func (dc *DeadLetterOperationController) ListDeadLetters(limit, offset int) ([]db.DeadLetter, error) {
+	return dc.store.GetAllDeadLetters(limit, offset)
+}
+
+func (dc *DeadLetterOperationController) ListDeadLettersByUser(userID string, limit, offset int) ([]db.DeadLetter, error) {
+	return dc.store.GetDeadLettersByUser(userID, limit, offset)
+}
+
+// RequeueDeadLetter makes the job due right away with a fresh retry budget and drops the dead letter,
+// both in one transaction. Only the retry columns of an existing schedule are written, when an
+// executor holds its lease the run being dispatched is the requeued one.
+func (dc *DeadLetterOperationController) RequeueDeadLetter(deadLetterID string) (*db.Schedule, error) {
+	deadLetter, err := dc.store.GetDeadLetter(deadLetterID)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := dc.store.GetJob(deadLetter.JobID)
+	if err != nil {
+		return nil, fmt.Errorf("job %s of dead letter not found: %v", deadLetter.JobID, err)
+	}
+
+	// The requeued run replays the dead one, so like a retry it doesn't count against MaxRuns
+	requeued := db.Schedule{
+		JobID:         job.JobID,
+		Priority:      job.Priority,
+		Payload:       job.Payload,
+		MaxRetries:    job.MaxRetries,
+		MisfirePolicy: job.MisfirePolicy,
+		NextRunTime:   time.Now(),
+		Retrying:      true,
+	}
+	if err := dc.store.RequeueDeadLetter(deadLetterID, requeued); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to requeue job %s: %v", job.JobID, err)
+	}
+
+	schedule, err := dc.store.GetSchedule(job.JobID)
+	if err != nil {
+		return nil, fmt.Errorf("job %s requeued but its schedule could not be loaded: %v", job.JobID, err)
+	}
+	return &schedule, nil
+}
+
+func (dc *DeadLetterOperationController) DeleteDeadLetter(deadLetterID string) error {
+	if _, err := dc.store.GetDeadLetter(deadLetterID); err != nil {
+		return err
+	}
+	return dc.store.DeleteDeadLetter(deadLetterID)
+}
+
+func (dc *DeadLetterOperationController) PurgeDeadLetters() (int64, error) {
+	return dc.store.PurgeDeadLetters()
+}
+
+func NewDeadLetterController(controllerType string, store db.Store) (DeadLetterController, error) {
+	switch controllerType {
+	case "DeadLetterOperationController":
+		return NewDeadLetterOperationController(store), nil
+	default:
+		return nil, fmt.Errorf("unknown controller type: %v", controllerType)
+	}
+}
@@ -1,14 +1,12 @@
 package controller
 
 import (
-	redishandler "doit/internal/cache/redishandler"
 	"doit/internal/db"
 	"doit/pkg/utils"
-	"encoding/json"
 	"fmt"
 	"mime/multipart"
+	"path/filepath"
 	"time"
-	"github.com/go-redis/redis/v8"
 )
 
 type JobController interface {
@@ -19,10 +17,12 @@ type JobController interface {
 	UploadJob(*multipart.FileHeader, string) error
 }
 
-type JobOperationController struct{}
+type JobOperationController struct {
+	store db.Store
+}
 
-func NewJobOperationController() *JobOperationController {
-	return &JobOperationController{}
+func NewJobOperationController(store db.Store) *JobOperationController {
+	return &JobOperationController{store: store}
 }
 
 
@@ -30,43 +30,17 @@ func (jc *JobOperationController) CreateJob(job *db.Job) error {
 	job.RcreTime = time.Now()
 	job.JobID = utils.GenerateJobIDFromStruct(job)
 
-	if err := db.CreateJob(*job); err != nil {
+	if err := jc.store.CreateJob(*job); err != nil {
 		return fmt.Errorf("failed to save job to database: %v", err)
 	}
 
-	jobJSON, err := json.Marshal(job)
-	if err != nil {
-		return fmt.Errorf("failed to marshal Job: %v", err)
-	}
-
-	rc := redishandler.GetRedisClient()
-	if err := rc.Rdb.Set(rc.Ctx, "job:"+job.JobID, jobJSON, 0).Err(); err != nil {
-		return fmt.Errorf("failed to store Job in Redis: %v", err)
-	}
-
 	return nil
 }
 
 func (jc *JobOperationController) GetJob(jobID string) (*db.Job, error) {
-	rc := redishandler.GetRedisClient()
-	jobJSON, err := rc.Rdb.Get(rc.Ctx, "job:"+jobID).Result()
-	if err == redis.Nil {
-		job, err := db.GetJob(jobID)
-		if err != nil {
-			return nil, fmt.Errorf("job not found")
-		}
-		jobJSON, err := json.Marshal(job)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal job data")
-		}
-		rc.Rdb.Set(rc.Ctx, "job:"+job.JobID, string(jobJSON), 0)
-	} else if err != nil {
-		return nil, fmt.Errorf("failed to fetch job from Redis")
-	}
-
-	var job db.Job
-	if err := json.Unmarshal([]byte(jobJSON), &job); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal job data")
+	job, err := jc.store.GetJob(jobID)
+	if err != nil {
+		return nil, fmt.Errorf("job not found")
 	}
 
 	return &job, nil
@@ -76,8 +50,8 @@ func (jc *JobOperationController) UploadJob(file *multipart.FileHeader, jobId st
 	if err := db.SaveJobScript(file); err != nil {
 		return err
 	}
-	payload := "doit/scripts/" + file.Filename
-	if err := db.UpdateJobPayload(jobId, payload); err != nil {
+	payload := filepath.Join(db.ScriptPath, filepath.Base(file.Filename))
+	if err := jc.store.UpdateJobPayload(jobId, payload); err != nil {
 		return fmt.Errorf("UpdateJobPayload failed: %v", err)
 	}
 
@@ -85,40 +59,25 @@ func (jc *JobOperationController) UploadJob(file *multipart.FileHeader, jobId st
 }
 
 func (jc *JobOperationController) UpdateJob(job *db.Job) error {
-	if err := db.UpdateJob(*job); err != nil {
+	if err := jc.store.UpdateJob(*job); err != nil {
 		return err
 	}
 
-	jobJSON, err := json.Marshal(job)
-	if err != nil {
-		return fmt.Errorf("failed to marshal job data")
-	}
-
-	rc := redishandler.GetRedisClient()
-	if err := rc.Rdb.Set(rc.Ctx, "job:"+job.JobID, jobJSON, 0).Err(); err != nil {
-		return fmt.Errorf("failed to store updated job in Redis: %v", err)
-	}
-
 	return nil
 }
 
 func (jc *JobOperationController) DeleteJob(jobID string) error {
-	if err := db.DeleteJob(jobID); err != nil {
+	if err := jc.store.DeleteJob(jobID); err != nil {
 		return err
 	}
 
-	rc := redishandler.GetRedisClient()
-	if err := rc.Rdb.Del(rc.Ctx, "job:"+jobID).Err(); err != nil {
-		return fmt.Errorf("failed to delete job from Redis: %v", err)
-	}
-
 	return nil
 }
 
-func NewJobController(controllerType string) (JobController, error) {
+func NewJobController(controllerType string, store db.Store) (JobController, error) {
 	switch controllerType {
 	case "JobOperationController":
-		return NewJobValidationController(NewJobOperationController(), &DefaultJobValidator{}), nil
+		return NewJobValidationController(NewJobOperationController(store), &DefaultJobValidator{store: store}), nil
 	default:
 		return nil, fmt.Errorf("unknown controller type: %v", controllerType)
 	}
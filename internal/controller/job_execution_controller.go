@@ -1,10 +1,8 @@
 package controller
 
 import (
-	"encoding/json"
 	"fmt"
 	"doit/internal/db"
-	redishandler "doit/internal/cache/redishandler"
 	"doit/pkg/utils"
 )
 
@@ -15,37 +13,45 @@ type JobExecutionController interface {
 	DeleteJobExecution(jobId string) error
 }
 
-type JobExecutionOperationController struct{}
+type JobExecutionOperationController struct {
+	store db.Store
+}
 
-func NewJobExecutionOperationController() *JobExecutionOperationController {
-	return &JobExecutionOperationController{}
+func NewJobExecutionOperationController(store db.Store) *JobExecutionOperationController {
+	return &JobExecutionOperationController{store: store}
 }
 
 
 func (jc *JobExecutionOperationController) CreateJobExecution(jobExec *db.JobExecution) error {
 	jobExec.ProcessID = utils.GenerateProcessIDFromStruct(jobExec)
 
-	if err := db.CreateJobExecution(jobExec); err != nil {
+	if err := jc.store.CreateJobExecution(jobExec); err != nil {
 		return fmt.Errorf("failed to save job execution to database: %v", err)
 	}
 
-	jobExecJSON, err := json.Marshal(jobExec)
+	return nil
+}
+
+func (jc *JobExecutionOperationController) GetJobExecution(processID string) (*db.JobExecution, error) {
+	jobExec, err := jc.store.GetJobExecution(processID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal JobExecution: %v", err)
+		return nil, fmt.Errorf("job execution not found: %v", err)
 	}
+	return &jobExec, nil
+}
 
-	rc := redishandler.GetRedisClient()
-	if err := rc.Rdb.Set(rc.Ctx, "job:"+jobExec.JobID, jobExecJSON, 0).Err(); err != nil {
-		return fmt.Errorf("failed to store JobExecution in Redis: %v", err)
+func (jc *JobExecutionOperationController) UpdateJobExecution(jobExec *db.JobExecution) error {
+	if err := jc.store.UpdateJobExecution(*jobExec); err != nil {
+		return fmt.Errorf("failed to update job execution in database: %v", err)
 	}
 
 	return nil
 }
 
-func NewJobExecutionController(controllerType string) (*JobExecutionOperationController, error) {
+func NewJobExecutionController(controllerType string, store db.Store) (*JobExecutionOperationController, error) {
 	switch controllerType {
 	case "JobExecutionOperationController":
-		return NewJobExecutionOperationController(), nil
+		return NewJobExecutionOperationController(store), nil
 	default:
 		return nil, fmt.Errorf("unknown controller type: %v", controllerType)
 	}
@@ -15,12 +15,15 @@ import (
 type JobValidator interface {
 	ValidateJob(job *db.Job) error
 	ValidateJobId(jobId string) error
+	ValidateJobExists(jobId string) error
 }
 
-type DefaultJobValidator struct{}
+type DefaultJobValidator struct {
+	store db.Store
+}
 
 func (v *DefaultJobValidator) ValidateJob(job *db.Job) error {
-	if err := mw.CheckJobIdempotency(job.JobID); err != nil {
+	if err := mw.CheckJobIdempotency(v.store, job.JobID); err != nil {
 		return fmt.Errorf("idempotency check failed: %v", err)
 	}
 
@@ -28,12 +31,78 @@ func (v *DefaultJobValidator) ValidateJob(job *db.Job) error {
 		job.TriggerAt = time.Now()
 	}
 
-	if job.FinishAt.Before(time.Now()) {
-		return fmt.Errorf("finishAt time [%v] is not ahead of current time", job.FinishAt)
+	// FinishAt is optional, a zero value means the job never expires
+	if !job.FinishAt.IsZero() && job.FinishAt.Before(job.TriggerAt) {
+		return fmt.Errorf("finishAt time [%v] is not ahead of trigger time", job.FinishAt)
+	}
+
+	if job.Kind == "" {
+		job.Kind = db.JobKindCron
+		if job.CronExpr == "" {
+			job.Kind = db.JobKindOnce
+		}
+	}
+
+	switch job.Kind {
+	case db.JobKindOnce:
+		if job.CronExpr != "" {
+			return fmt.Errorf("one-shot jobs cannot have a cron expression")
+		}
+		if job.MaxRuns > 1 {
+			return fmt.Errorf("one-shot jobs run once, max_runs cannot be %d", job.MaxRuns)
+		}
+	case db.JobKindCron:
+		if _, err := utils.LoadCronLocation(job.CronExpr, job.TimeZone); err != nil {
+			return err
+		}
+
+		if _, err := utils.NextCronTimeIn(job.CronExpr, job.TimeZone, time.Now()); err != nil {
+			return fmt.Errorf("invalid cron expression: %v", err)
+		}
+	default:
+		return fmt.Errorf("invalid job kind: %s", job.Kind)
+	}
+
+	if job.MaxRuns < 0 {
+		return fmt.Errorf("max_runs cannot be negative")
+	}
+
+	if job.TimeoutSeconds < 0 {
+		return fmt.Errorf("timeout_seconds cannot be negative")
+	}
+
+	if job.CPUSlots < 0 || job.MemoryMB < 0 {
+		return fmt.Errorf("cpu_slots and memory_mb cannot be negative")
+	}
+
+	if job.DeadlineSeconds < 0 {
+		return fmt.Errorf("deadline_seconds cannot be negative")
 	}
 
-	if _, err := utils.EvalCronExpr(job.CronExpr); err != nil {
-		return fmt.Errorf("invalid cron expression: %v", err)
+	for _, expr := range append(append([]string{}, job.NodeSelector...), job.AntiAffinity...) {
+		if _, err := utils.ParseRequirement(expr); err != nil {
+			return err
+		}
+	}
+
+	switch job.BackoffStrategy {
+	case "", db.BackoffFixed, db.BackoffExponential, db.BackoffExponentialJitter:
+	default:
+		return fmt.Errorf("invalid backoff strategy: %s", job.BackoffStrategy)
+	}
+
+	if job.MaxRetries < 0 || job.BackoffBaseSeconds < 0 || job.BackoffMaxSeconds < 0 {
+		return fmt.Errorf("max_retries and backoff durations cannot be negative")
+	}
+
+	switch job.MisfirePolicy {
+	case "", db.MisfireSkip, db.MisfireRunOnce, db.MisfireCatchUp:
+	default:
+		return fmt.Errorf("invalid misfire policy: %s", job.MisfirePolicy)
+	}
+
+	if job.CatchUpLimit < 0 {
+		return fmt.Errorf("catch_up_limit cannot be negative")
 	}
 
 	return nil
@@ -46,6 +115,16 @@ func (v *DefaultJobValidator) ValidateJobId(jobId string) error {
 	return nil
 }
 
+func (v *DefaultJobValidator) ValidateJobExists(jobId string) error {
+	if _, err := v.store.GetJob(jobId); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("jobId does not exist")
+		}
+		return err
+	}
+	return nil
+}
+
 type JobValidationController struct {
 	joc       JobController
 	validator JobValidator
@@ -92,7 +171,7 @@ func (jv *JobValidationController) DeleteJob(jobId string) error {
 
 // UploadJob validates the uploaded file (Python script) and checks its size and type
 func (jv *JobValidationController) UploadJob(file *multipart.FileHeader, jobId string) error {
-	if err := db.ValidateJobID(jobId); err != nil {
+	if err := jv.validator.ValidateJobExists(jobId); err != nil {
 		return err
 	}
 	ext := strings.ToLower(filepath.Ext(file.Filename))
@@ -1,116 +1,94 @@
 package controller
 
 import (
-	"encoding/json"
 	"fmt"
 	"time"
 	"doit/internal/db"
-	redishandler "doit/internal/cache/redishandler"
-	"github.com/go-redis/redis/v8"
 )
 
 type ScheduleController interface {
 	CreateSchedule(schedule *db.Schedule) error
 	GetSchedule(scheduleID string) (*db.Schedule, error)
 	UpdateSchedule(schedule *db.Schedule) error
+	AdvanceSchedule(schedule *db.Schedule, owner string) error
+	RetrySchedule(jobID string, retryCount int, retryAt time.Time) (bool, error)
+	MisfireSchedule(schedule *db.Schedule, missed time.Time) (bool, error)
 	DeleteSchedule(jobID string) error
 }
 
 type ScheduleOperationController struct {
-	redisClient *redis.Client
+	store db.Store
 }
 
-func NewScheduleOperationController(redisClient *redis.Client) *ScheduleOperationController {
-	return &ScheduleOperationController{redisClient: redisClient}
+func NewScheduleOperationController(store db.Store) *ScheduleOperationController {
+	return &ScheduleOperationController{store: store}
 }
 
-func (sc *ScheduleOperationController) cacheScheduleInRedis(schedule *db.Schedule) error {
-	scheduleJSON, err := json.Marshal(schedule)
-	if err != nil {
-		return fmt.Errorf("failed to marshal schedule: %v", err)
+func (sc *ScheduleOperationController) CreateSchedule(schedule *db.Schedule) error {
+	schedule.RcreTime = time.Now()
+	if err := sc.store.CreateSchedule(schedule); err != nil {
+		return fmt.Errorf("failed to save schedule to database: %v", err)
 	}
 
-	// Set to Redis with a TTL (optional, e.g., 1 hour)
-	ttl := 1 * time.Hour
-	if err := sc.redisClient.Set(sc.redisClient.Context(), "JobSchedule:"+schedule.JobID, scheduleJSON, ttl).Err(); err != nil {
-		return fmt.Errorf("failed to store schedule in Redis: %v", err)
-	}
 	return nil
 }
 
-func (sc *ScheduleOperationController) getScheduleFromCacheOrDB(scheduleID string) (*db.Schedule, error) {
-	scheduleJSON, err := sc.redisClient.Get(sc.redisClient.Context(), "Schedule:"+scheduleID).Result()
-	if err == redis.Nil {
-		schedule, err := db.GetSchedule(scheduleID)
-		if err != nil {
-			return nil, fmt.Errorf("schedule not found in database: %v", err)
-		}
-		if err := sc.cacheScheduleInRedis(&schedule); err != nil {
-			return nil, fmt.Errorf("failed to cache schedule in Redis: %v", err)
-		}
-		return &schedule, nil
-	} else if err != nil {
-		return nil, fmt.Errorf("failed to fetch schedule from Redis: %v", err)
-	}
-
-	var schedule db.Schedule
-	if err := json.Unmarshal([]byte(scheduleJSON), &schedule); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal schedule data: %v", err)
+func (sc *ScheduleOperationController) GetSchedule(scheduleID string) (*db.Schedule, error) {
+	schedule, err := sc.store.GetSchedule(scheduleID)
+	if err != nil {
+		return nil, fmt.Errorf("schedule not found in database: %v", err)
 	}
 
 	return &schedule, nil
 }
 
-func (sc *ScheduleOperationController) CreateSchedule(schedule *db.Schedule) error {
-	schedule.RcreTime = time.Now()
-	if err := db.CreateSchedule(schedule); err != nil {
-		return fmt.Errorf("failed to save schedule to database: %v", err)
+func (sc *ScheduleOperationController) UpdateSchedule(schedule *db.Schedule) error {
+	if err := sc.store.UpdateSchedule(*schedule); err != nil {
+		return fmt.Errorf("failed to update schedule in database: %v", err)
 	}
 
-	if err := sc.cacheScheduleInRedis(schedule); err != nil {
-		return err
+	return nil
+}
+
+// AdvanceSchedule returns db.ErrLeaseLost wrapped when another executor took the schedule over
+func (sc *ScheduleOperationController) AdvanceSchedule(schedule *db.Schedule, owner string) error {
+	if err := sc.store.AdvanceSchedule(*schedule, owner); err != nil {
+		return fmt.Errorf("failed to advance schedule in database: %w", err)
 	}
 
 	return nil
 }
 
-func (sc *ScheduleOperationController) GetSchedule(scheduleID string) (*db.Schedule, error) {
-	schedule, err := sc.getScheduleFromCacheOrDB(scheduleID)
+func (sc *ScheduleOperationController) RetrySchedule(jobID string, retryCount int, retryAt time.Time) (bool, error) {
+	scheduled, err := sc.store.RetrySchedule(jobID, retryCount, retryAt)
 	if err != nil {
-		return nil, err
+		return false, fmt.Errorf("failed to schedule retry in database: %v", err)
 	}
 
-	return schedule, nil
+	return scheduled, nil
 }
 
-func (sc *ScheduleOperationController) UpdateSchedule(schedule *db.Schedule) error {
-	if err := db.UpdateSchedule(*schedule); err != nil {
-		return fmt.Errorf("failed to update schedule in database: %v", err)
-	}
-
-	if err := sc.cacheScheduleInRedis(schedule); err != nil {
-		return err
+func (sc *ScheduleOperationController) MisfireSchedule(schedule *db.Schedule, missed time.Time) (bool, error) {
+	moved, err := sc.store.MisfireSchedule(*schedule, missed)
+	if err != nil {
+		return false, fmt.Errorf("failed to apply misfire policy in database: %v", err)
 	}
 
-	return nil
+	return moved, nil
 }
 
 func (sc *ScheduleOperationController) DeleteSchedule(jobID string) error {
-	if err := db.DeleteSchedule(jobID); err != nil {
+	if err := sc.store.DeleteSchedule(jobID); err != nil {
 		return fmt.Errorf("failed to delete schedule from database: %v", err)
 	}
 
-	if err := sc.redisClient.Del(sc.redisClient.Context(), "JobSchedule:"+jobID).Err(); err != nil {
-		return fmt.Errorf("failed to delete schedule from Redis: %v", err)
-	}
-
 	return nil
 }
 
-func CreateScheduleController(controllerType string) (ScheduleController, error) {
+func CreateScheduleController(controllerType string, store db.Store) (ScheduleController, error) {
 	switch controllerType {
 	case "ScheduleOperationController":
-		return NewScheduleOperationController(redishandler.GetRedisClient().Rdb), nil
+		return NewScheduleOperationController(store), nil
 	default:
 		return nil, fmt.Errorf("unknown controller type: %v", controllerType)
 	}
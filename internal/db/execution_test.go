@@ -0,0 +1,68 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFinishRunningExecutionHasOneWinner(t *testing.T) {
+	const reapers = 8
+
+	for name, store := range leaseStores(t) {
+		t.Run(name, func(t *testing.T) {
+			je := JobExecution{ProcessID: "orphan", JobID: "job", WorkerID: "dead", Status: JobStatusRunning, Stdout: "partial"}
+			if err := store.CreateJobExecution(&je); err != nil {
+				t.Fatalf("creating execution: %v", err)
+			}
+
+			var won atomic.Int32
+			var wg sync.WaitGroup
+			for r := 0; r < reapers; r++ {
+				failed := je
+				failed.Status = JobStatusFailed
+				failed.EndTime = time.Now()
+				failed.ExitCode = -1
+				failed.Error = fmt.Sprintf("reaped by %d", r)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ok, err := store.FinishRunningExecution(failed)
+					if err != nil {
+						t.Errorf("failing execution: %v", err)
+					}
+					if ok {
+						won.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if won.Load() != 1 {
+				t.Fatalf("%d reapers failed the execution, want 1", won.Load())
+			}
+			stored, err := store.GetJobExecution(je.ProcessID)
+			if err != nil {
+				t.Fatalf("loading execution: %v", err)
+			}
+			if stored.Status != JobStatusFailed || stored.ExitCode != -1 || stored.Stdout != "partial" {
+				t.Fatalf("stored %+v, want failed with exit code -1 and its output kept", stored)
+			}
+
+			// A finished execution stays finished, late output doesn't revive it either
+			completed := je
+			completed.Status = JobStatusCompleted
+			if ok, err := store.FinishRunningExecution(completed); err != nil || ok {
+				t.Fatalf("finishing a failed execution again = %v, %v, want false", ok, err)
+			}
+			if ok, err := store.SetRunningExecutionOutput(je.ProcessID, "partial, late", ""); err != nil || ok {
+				t.Fatalf("setting output of a failed execution = %v, %v, want false", ok, err)
+			}
+			if stored, _ := store.GetJobExecution(je.ProcessID); stored.Status != JobStatusFailed || stored.Stdout != "partial" {
+				t.Fatalf("late output left %s with %q, want failed with %q", stored.Status, stored.Stdout, "partial")
+			}
+		})
+	}
+}
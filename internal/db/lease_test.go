@@ -0,0 +1,223 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// leaseStores are the backends that have to hold up against concurrent executors
+func leaseStores(t *testing.T) map[string]Store {
+	sqlite, err := NewSQLiteStore(t.TempDir() + "/doit.db")
+	if err != nil {
+		t.Fatalf("opening sqlite store: %v", err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+	return map[string]Store{DriverMemory: NewMemoryStore(), DriverSQLite: sqlite}
+}
+
+func createDueSchedules(t *testing.T, store Store, n int) {
+	for i := 0; i < n; i++ {
+		schedule := &Schedule{JobID: fmt.Sprintf("job%03d", i), NextRunTime: time.Now().Add(-time.Minute)}
+		if err := store.CreateSchedule(schedule); err != nil {
+			t.Fatalf("creating schedule: %v", err)
+		}
+	}
+}
+
+func TestClaimDueSchedulesConcurrentExecutors(t *testing.T) {
+	const schedules, executors, batch = 60, 8, 5
+
+	for name, store := range leaseStores(t) {
+		t.Run(name, func(t *testing.T) {
+			createDueSchedules(t, store, schedules)
+			if err := store.CreateSchedule(&Schedule{JobID: "later", NextRunTime: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatalf("creating schedule: %v", err)
+			}
+
+			var mu sync.Mutex
+			claims := make(map[string][]string)
+			var wg sync.WaitGroup
+			for e := 0; e < executors; e++ {
+				owner := fmt.Sprintf("executor-%d", e)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						claimed, err := store.ClaimDueSchedules(owner, time.Minute, batch)
+						if err != nil {
+							t.Errorf("%s claiming: %v", owner, err)
+							return
+						}
+						if len(claimed) == 0 {
+							return
+						}
+						mu.Lock()
+						for _, schedule := range claimed {
+							if schedule.LeaseOwner != owner {
+								t.Errorf("%s got %s leased to %q", owner, schedule.JobID, schedule.LeaseOwner)
+							}
+							claims[schedule.JobID] = append(claims[schedule.JobID], owner)
+						}
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			if len(claims) != schedules {
+				t.Errorf("claimed %d schedules, want %d", len(claims), schedules)
+			}
+			for jobID, owners := range claims {
+				if len(owners) != 1 {
+					t.Errorf("%s was claimed %d times, by %v", jobID, len(owners), owners)
+				}
+			}
+			if _, ok := claims["later"]; ok {
+				t.Errorf("a schedule that isn't due was claimed")
+			}
+		})
+	}
+}
+
+func TestClaimDueSchedulesReclaimsExpiredLeases(t *testing.T) {
+	const lease = 200 * time.Millisecond
+
+	for name, store := range leaseStores(t) {
+		t.Run(name, func(t *testing.T) {
+			createDueSchedules(t, store, 3)
+
+			first, err := store.ClaimDueSchedules("crashed", lease, 0)
+			if err != nil || len(first) != 3 {
+				t.Fatalf("first claim got %d schedules, err %v", len(first), err)
+			}
+
+			held, err := store.ClaimDueSchedules("other", lease, 0)
+			if err != nil || len(held) != 0 {
+				t.Fatalf("claimed %d schedules under a live lease, err %v", len(held), err)
+			}
+
+			time.Sleep(lease + 50*time.Millisecond)
+			reclaimed, err := store.ClaimDueSchedules("other", lease, 0)
+			if err != nil || len(reclaimed) != 3 {
+				t.Fatalf("reclaimed %d expired schedules, want 3, err %v", len(reclaimed), err)
+			}
+			for _, schedule := range reclaimed {
+				stored, err := store.GetSchedule(schedule.JobID)
+				if err != nil || stored.LeaseOwner != "other" {
+					t.Errorf("%s is leased to %q after the reclaim, err %v", schedule.JobID, stored.LeaseOwner, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMisfireScheduleLeavesLeasedAndMovedSchedules(t *testing.T) {
+	for name, store := range leaseStores(t) {
+		t.Run(name, func(t *testing.T) {
+			createDueSchedules(t, store, 2)
+			behind, err := store.GetSchedule("job000")
+			if err != nil {
+				t.Fatalf("loading schedule: %v", err)
+			}
+			skipped := behind
+			skipped.NextRunTime = time.Now().Add(time.Hour)
+
+			// A retry brought the schedule to another run meanwhile
+			if _, err := store.RetrySchedule(behind.JobID, 1, behind.NextRunTime.Add(-time.Second)); err != nil {
+				t.Fatalf("recording retry: %v", err)
+			}
+			if moved, err := store.MisfireSchedule(skipped, behind.NextRunTime); err != nil || moved {
+				t.Fatalf("misfire over a retry = %v, %v, want false", moved, err)
+			}
+
+			// An executor leased the schedule meanwhile
+			leased, err := store.GetSchedule("job001")
+			if err != nil {
+				t.Fatalf("loading schedule: %v", err)
+			}
+			if _, err := store.ClaimDueSchedules("executor", time.Minute, 0); err != nil {
+				t.Fatalf("claiming: %v", err)
+			}
+			skipped = leased
+			skipped.NextRunTime = time.Now().Add(time.Hour)
+			if moved, err := store.MisfireSchedule(skipped, leased.NextRunTime); err != nil || moved {
+				t.Fatalf("misfire over a lease = %v, %v, want false", moved, err)
+			}
+			if stored, _ := store.GetSchedule(leased.JobID); stored.LeaseOwner != "executor" || !stored.NextRunTime.Equal(leased.NextRunTime) {
+				t.Fatalf("misfire changed a leased schedule to %+v", stored)
+			}
+
+			// Left alone, the policy applies
+			if err := store.CreateSchedule(&Schedule{JobID: "late", NextRunTime: time.Now().Add(-time.Hour)}); err != nil {
+				t.Fatalf("creating schedule: %v", err)
+			}
+			late, err := store.GetSchedule("late")
+			if err != nil {
+				t.Fatalf("loading schedule: %v", err)
+			}
+			caughtUp := late
+			caughtUp.NextRunTime = late.NextRunTime.Add(30 * time.Minute)
+			caughtUp.MissedRuns = 2
+			if moved, err := store.MisfireSchedule(caughtUp, late.NextRunTime); err != nil || !moved {
+				t.Fatalf("misfire of an unleased schedule = %v, %v, want true", moved, err)
+			}
+			if stored, _ := store.GetSchedule("late"); !stored.NextRunTime.Equal(caughtUp.NextRunTime) || stored.MissedRuns != 2 {
+				t.Fatalf("misfire stored %v with %d missed runs, want %v with 2", stored.NextRunTime, stored.MissedRuns, caughtUp.NextRunTime)
+			}
+		})
+	}
+}
+
+func TestRequeueDeadLetterKeepsLeaseAndIsAtomic(t *testing.T) {
+	for name, store := range leaseStores(t) {
+		t.Run(name, func(t *testing.T) {
+			createDueSchedules(t, store, 1)
+			if _, err := store.RetrySchedule("job000", 3, time.Time{}); err != nil {
+				t.Fatalf("recording retries: %v", err)
+			}
+			if _, err := store.ClaimDueSchedules("executor", time.Minute, 0); err != nil {
+				t.Fatalf("claiming: %v", err)
+			}
+			for _, id := range []string{"dead-leased", "dead-new"} {
+				if err := store.CreateDeadLetter(&DeadLetter{DeadLetterID: id, JobID: "job000", RcreTime: time.Now()}); err != nil {
+					t.Fatalf("creating dead letter: %v", err)
+				}
+			}
+			requeued := Schedule{JobID: "job000", NextRunTime: time.Now(), Retrying: true}
+
+			// The leased run is the requeued one, the lease stays and the budget is fresh
+			if err := store.RequeueDeadLetter("dead-leased", requeued); err != nil {
+				t.Fatalf("requeueing: %v", err)
+			}
+			stored, err := store.GetSchedule("job000")
+			if err != nil || stored.LeaseOwner != "executor" || stored.RetryCount != 0 {
+				t.Fatalf("requeue left %+v, err %v, want the lease kept and no retries", stored, err)
+			}
+			if _, err := store.GetDeadLetter("dead-leased"); err == nil {
+				t.Fatalf("the requeued dead letter is still there")
+			}
+
+			// Nothing is written when the dead letter is already gone
+			if err := store.RequeueDeadLetter("dead-leased", Schedule{JobID: "other", NextRunTime: time.Now()}); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("requeueing a removed dead letter = %v, want ErrNotFound", err)
+			}
+			if _, err := store.GetSchedule("other"); err == nil {
+				t.Fatalf("requeueing a removed dead letter created a schedule")
+			}
+
+			// A job without a schedule gets one
+			if err := store.DeleteSchedule("job000"); err != nil {
+				t.Fatalf("deleting schedule: %v", err)
+			}
+			if err := store.RequeueDeadLetter("dead-new", requeued); err != nil {
+				t.Fatalf("requeueing: %v", err)
+			}
+			if stored, err := store.GetSchedule("job000"); err != nil || !stored.Retrying {
+				t.Fatalf("requeue created %+v, err %v, want a retrying schedule", stored, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,681 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in process memory, it is meant for tests and local runs
+type MemoryStore struct {
+	mu         sync.RWMutex
+	jobs       map[string]Job
+	schedules  map[string]Schedule
+	executions map[string]JobExecution
+	workers    map[string]Worker
+	dead       map[string]DeadLetter
+	apiKeys    map[string]APIKey
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		jobs:       make(map[string]Job),
+		schedules:  make(map[string]Schedule),
+		executions: make(map[string]JobExecution),
+		workers:    make(map[string]Worker),
+		dead:       make(map[string]DeadLetter),
+		apiKeys:    make(map[string]APIKey),
+	}
+}
+
+// page applies limit/offset the same way the SQL backends do, a negative limit means no limit
+func page(n, limit, offset int) (int, int) {
+	if offset > n {
+		offset = n
+	}
+	end := n
+	if limit >= 0 && offset+limit < n {
+		end = offset + limit
+	}
+	return offset, end
+}
+
+func (m *MemoryStore) CreateJob(job Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.jobs[job.JobID]; ok {
+		return fmt.Errorf("job %s already exists", job.JobID)
+	}
+	m.jobs[job.JobID] = job
+	return nil
+}
+
+func (m *MemoryStore) GetJob(jobID string) (Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	job, ok := m.jobs[jobID]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return job, nil
+}
+
+func (m *MemoryStore) GetAllJobs(limit, offset int) ([]Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].JobID < jobs[j].JobID })
+
+	start, end := page(len(jobs), limit, offset)
+	return jobs[start:end], nil
+}
+
+func (m *MemoryStore) GetJobsByUser(userID string, limit, offset int) ([]Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	jobs := []Job{}
+	for _, job := range m.jobs {
+		if job.UserID == userID {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].JobID < jobs[j].JobID })
+
+	start, end := page(len(jobs), limit, offset)
+	return jobs[start:end], nil
+}
+
+func (m *MemoryStore) UpdateJob(job Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.jobs[job.JobID] = job
+	return nil
+}
+
+func (m *MemoryStore) UpdateJobPayload(jobID string, newPayload string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[jobID]
+	if !ok {
+		return fmt.Errorf("job not found: %v", ErrNotFound)
+	}
+	job.Payload = newPayload
+	m.jobs[jobID] = job
+	return nil
+}
+
+func (m *MemoryStore) DeleteJob(jobID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.jobs, jobID)
+	return nil
+}
+
+func (m *MemoryStore) CreateSchedule(schedule *Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.schedules[schedule.JobID]; ok {
+		return fmt.Errorf("schedule for job %s already exists", schedule.JobID)
+	}
+	m.schedules[schedule.JobID] = *schedule
+	return nil
+}
+
+func (m *MemoryStore) GetSchedule(jobID string) (Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	schedule, ok := m.schedules[jobID]
+	if !ok {
+		return Schedule{}, ErrNotFound
+	}
+	return schedule, nil
+}
+
+func (m *MemoryStore) GetAllSchedules(limit, offset int) ([]Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	schedules := make([]Schedule, 0, len(m.schedules))
+	for _, schedule := range m.schedules {
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].JobID < schedules[j].JobID })
+
+	start, end := page(len(schedules), limit, offset)
+	return schedules[start:end], nil
+}
+
+func (m *MemoryStore) GetSchedulesDueBefore(before time.Time) ([]Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var schedules []Schedule
+	for _, schedule := range m.schedules {
+		if !schedule.NextRunTime.After(before) {
+			schedules = append(schedules, schedule)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].NextRunTime.Before(schedules[j].NextRunTime) })
+	return schedules, nil
+}
+
+func (m *MemoryStore) ClaimDueSchedules(owner string, lease time.Duration, limit int) ([]Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var due []Schedule
+	for _, schedule := range m.schedules {
+		if schedule.NextRunTime.After(now) {
+			continue
+		}
+		if schedule.LeaseOwner != "" && !schedule.LeaseExpiresAt.Before(now) {
+			continue
+		}
+		due = append(due, schedule)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextRunTime.Before(due[j].NextRunTime) })
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+
+	expiresAt := now.Add(lease)
+	for i := range due {
+		due[i].LeaseOwner = owner
+		due[i].LeaseExpiresAt = expiresAt
+		m.schedules[due[i].JobID] = due[i]
+	}
+	return due, nil
+}
+
+func (m *MemoryStore) RenewScheduleLeases(owner string, jobIDs []string, lease time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expiresAt := time.Now().Add(lease)
+	for _, jobID := range jobIDs {
+		if schedule, ok := m.schedules[jobID]; ok && schedule.LeaseOwner == owner {
+			schedule.LeaseExpiresAt = expiresAt
+			m.schedules[jobID] = schedule
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateSchedule(schedule Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.schedules[schedule.JobID] = schedule
+	return nil
+}
+
+func (m *MemoryStore) AdvanceSchedule(schedule Schedule, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.schedules[schedule.JobID]
+	if !ok || stored.LeaseOwner != owner {
+		return ErrLeaseLost
+	}
+	stored.NextRunTime = schedule.NextRunTime
+	stored.LastRunTime = schedule.LastRunTime
+	stored.RunCount = schedule.RunCount
+	stored.MissedRuns = schedule.MissedRuns
+	stored.Retrying = schedule.Retrying
+	stored.LeaseOwner = ""
+	stored.LeaseExpiresAt = time.Time{}
+	m.schedules[schedule.JobID] = stored
+	return nil
+}
+
+func (m *MemoryStore) MisfireSchedule(schedule Schedule, missed time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.schedules[schedule.JobID]
+	if !ok || !stored.NextRunTime.Equal(missed) || (stored.LeaseOwner != "" && !stored.LeaseExpiresAt.Before(time.Now())) {
+		return false, nil
+	}
+	stored.NextRunTime = schedule.NextRunTime
+	stored.MissedRuns = schedule.MissedRuns
+	m.schedules[schedule.JobID] = stored
+	return true, nil
+}
+
+func (m *MemoryStore) RetrySchedule(jobID string, retryCount int, retryAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.retrySchedule(jobID, retryCount, retryAt)
+}
+
+// retrySchedule is RetrySchedule with m.mu held
+func (m *MemoryStore) retrySchedule(jobID string, retryCount int, retryAt time.Time) (bool, error) {
+	stored, ok := m.schedules[jobID]
+	if !ok {
+		return false, ErrNotFound
+	}
+	stored.RetryCount = retryCount
+	scheduled := false
+	if !retryAt.IsZero() && (stored.LeaseOwner == "" || stored.LeaseExpiresAt.Before(time.Now())) {
+		stored.Retrying = true
+		if retryAt.Before(stored.NextRunTime) {
+			stored.NextRunTime = retryAt
+		}
+		scheduled = true
+	}
+	m.schedules[jobID] = stored
+	return scheduled, nil
+}
+
+func (m *MemoryStore) DeleteSchedule(jobID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.schedules, jobID)
+	return nil
+}
+
+func (m *MemoryStore) CreateJobExecution(je *JobExecution) error {
+	if err := je.BeforeSave(nil); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.executions[je.ProcessID]; ok {
+		return fmt.Errorf("job execution %s already exists", je.ProcessID)
+	}
+	m.executions[je.ProcessID] = *je
+	return nil
+}
+
+func (m *MemoryStore) GetJobExecution(processID string) (JobExecution, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	je, ok := m.executions[processID]
+	if !ok {
+		return JobExecution{}, ErrNotFound
+	}
+	return je, nil
+}
+
+func (m *MemoryStore) GetJobExecutionsByJob(jobID string) ([]JobExecution, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var executions []JobExecution
+	for _, je := range m.executions {
+		if je.JobID == jobID {
+			executions = append(executions, je)
+		}
+	}
+	sort.Slice(executions, func(i, j int) bool { return executions[i].StartTime.Before(executions[j].StartTime) })
+	return executions, nil
+}
+
+func (m *MemoryStore) GetJobExecutionsByWorker(workerID string, status string) ([]JobExecution, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var executions []JobExecution
+	for _, je := range m.executions {
+		if je.WorkerID == workerID && je.Status == status {
+			executions = append(executions, je)
+		}
+	}
+	sort.Slice(executions, func(i, j int) bool { return executions[i].StartTime.Before(executions[j].StartTime) })
+	return executions, nil
+}
+
+func (m *MemoryStore) UpdateJobExecution(je JobExecution) error {
+	if err := je.BeforeSave(nil); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.executions[je.ProcessID] = je
+	return nil
+}
+
+func (m *MemoryStore) FinishRunningExecution(je JobExecution) (bool, error) {
+	if err := je.BeforeSave(nil); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.executions[je.ProcessID]
+	if !ok || stored.Status != JobStatusRunning {
+		return false, nil
+	}
+	stored.Status = je.Status
+	stored.EndTime = je.EndTime
+	stored.ExitCode = je.ExitCode
+	stored.Error = je.Error
+	m.executions[je.ProcessID] = stored
+	return true, nil
+}
+
+func (m *MemoryStore) SetRunningExecutionOutput(processID string, stdout string, stderr string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.executions[processID]
+	if !ok || stored.Status != JobStatusRunning {
+		return false, nil
+	}
+	stored.Stdout = stdout
+	stored.Stderr = stderr
+	m.executions[processID] = stored
+	return true, nil
+}
+
+func (m *MemoryStore) CreateDeadLetter(deadLetter *DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dead[deadLetter.DeadLetterID]; ok {
+		return fmt.Errorf("dead letter %s already exists", deadLetter.DeadLetterID)
+	}
+	m.dead[deadLetter.DeadLetterID] = *deadLetter
+	return nil
+}
+
+func (m *MemoryStore) GetDeadLetter(deadLetterID string) (DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	deadLetter, ok := m.dead[deadLetterID]
+	if !ok {
+		return DeadLetter{}, ErrNotFound
+	}
+	return deadLetter, nil
+}
+
+func (m *MemoryStore) GetAllDeadLetters(limit, offset int) ([]DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	deadLetters := make([]DeadLetter, 0, len(m.dead))
+	for _, deadLetter := range m.dead {
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	sort.Slice(deadLetters, func(i, j int) bool { return deadLetters[i].RcreTime.After(deadLetters[j].RcreTime) })
+
+	start, end := page(len(deadLetters), limit, offset)
+	return deadLetters[start:end], nil
+}
+
+func (m *MemoryStore) GetDeadLettersByUser(userID string, limit, offset int) ([]DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	deadLetters := []DeadLetter{}
+	for _, deadLetter := range m.dead {
+		if deadLetter.UserID == userID {
+			deadLetters = append(deadLetters, deadLetter)
+		}
+	}
+	sort.Slice(deadLetters, func(i, j int) bool { return deadLetters[i].RcreTime.After(deadLetters[j].RcreTime) })
+
+	start, end := page(len(deadLetters), limit, offset)
+	return deadLetters[start:end], nil
+}
+
+func (m *MemoryStore) DeleteDeadLetter(deadLetterID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.dead, deadLetterID)
+	return nil
+}
+
+func (m *MemoryStore) RequeueDeadLetter(deadLetterID string, schedule Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dead[deadLetterID]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := m.schedules[schedule.JobID]; ok {
+		m.retrySchedule(schedule.JobID, schedule.RetryCount, schedule.NextRunTime)
+	} else {
+		m.schedules[schedule.JobID] = schedule
+	}
+	delete(m.dead, deadLetterID)
+	return nil
+}
+
+func (m *MemoryStore) PurgeDeadLetters() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := int64(len(m.dead))
+	m.dead = make(map[string]DeadLetter)
+	return n, nil
+}
+
+func (m *MemoryStore) CreateWorker(worker *Worker) error {
+	if err := worker.BeforeSave(nil); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.workers[worker.WorkerID]; ok {
+		return fmt.Errorf("worker %s already exists", worker.WorkerID)
+	}
+	m.workers[worker.WorkerID] = *worker
+	return nil
+}
+
+func (m *MemoryStore) GetWorker(workerID string) (Worker, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	worker, ok := m.workers[workerID]
+	if !ok {
+		return Worker{}, ErrNotFound
+	}
+	return worker, nil
+}
+
+func (m *MemoryStore) GetAllWorkers() ([]Worker, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	workers := make([]Worker, 0, len(m.workers))
+	for _, worker := range m.workers {
+		workers = append(workers, worker)
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].WorkerID < workers[j].WorkerID })
+	return workers, nil
+}
+
+func (m *MemoryStore) UpdateWorker(worker Worker) error {
+	if err := worker.BeforeSave(nil); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.workers[worker.WorkerID] = worker
+	return nil
+}
+
+func (m *MemoryStore) DeleteWorker(workerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.workers, workerID)
+	return nil
+}
+
+func (m *MemoryStore) HeartbeatWorker(workerID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	worker, ok := m.workers[workerID]
+	if !ok {
+		return ErrNotFound
+	}
+	worker.LastHeartbeat = at
+	m.workers[workerID] = worker
+	return nil
+}
+
+func (m *MemoryStore) ReserveWorker(workerID string, cpuSlots int, memoryMB int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	worker, ok := m.workers[workerID]
+	if !ok || worker.Status != WorkerActive || worker.CurrentLoad+cpuSlots > worker.Capacity {
+		return ErrInsufficientCapacity
+	}
+	if worker.MemoryMB > 0 && worker.MemoryUsedMB+memoryMB > worker.MemoryMB {
+		return ErrInsufficientCapacity
+	}
+	worker.CurrentLoad += cpuSlots
+	worker.MemoryUsedMB += memoryMB
+	m.workers[workerID] = worker
+	return nil
+}
+
+func (m *MemoryStore) ReleaseWorker(workerID string, cpuSlots int, memoryMB int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	worker, ok := m.workers[workerID]
+	if !ok {
+		return nil
+	}
+	worker.CurrentLoad = max(worker.CurrentLoad-cpuSlots, 0)
+	worker.MemoryUsedMB = max(worker.MemoryUsedMB-memoryMB, 0)
+	m.workers[workerID] = worker
+	return nil
+}
+
+func (m *MemoryStore) SetWorkerStatus(workerID string, from []string, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	worker, ok := m.workers[workerID]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, s := range from {
+		if worker.Status == s {
+			worker.Status = status
+			m.workers[workerID] = worker
+			return nil
+		}
+	}
+	return ErrWorkerStatus
+}
+
+func (m *MemoryStore) CreateAPIKey(key *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.apiKeys[key.KeyID]; ok {
+		return fmt.Errorf("API key %s already exists", key.KeyID)
+	}
+	for _, existing := range m.apiKeys {
+		if existing.Hash == key.Hash {
+			return fmt.Errorf("API key %s has the same hash", existing.KeyID)
+		}
+	}
+	m.apiKeys[key.KeyID] = *key
+	return nil
+}
+
+func (m *MemoryStore) GetAPIKey(keyID string) (APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, ok := m.apiKeys[keyID]
+	if !ok {
+		return APIKey{}, ErrNotFound
+	}
+	return key, nil
+}
+
+func (m *MemoryStore) GetAPIKeyByHash(hash string) (APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, key := range m.apiKeys {
+		if key.Hash == hash {
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (m *MemoryStore) GetAPIKeys(userID string) ([]APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]APIKey, 0)
+	for _, key := range m.apiKeys {
+		if userID == "" || key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].RcreTime.After(keys[j].RcreTime) })
+	return keys, nil
+}
+
+func (m *MemoryStore) RevokeAPIKey(keyID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.apiKeys[keyID]
+	if !ok {
+		return ErrNotFound
+	}
+	if key.RevokedAt.IsZero() {
+		key.RevokedAt = at
+		m.apiKeys[keyID] = key
+	}
+	return nil
+}
+
+func (m *MemoryStore) TouchAPIKey(keyID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.apiKeys[keyID]
+	if !ok {
+		return ErrNotFound
+	}
+	key.LastUsedAt = at
+	m.apiKeys[keyID] = key
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
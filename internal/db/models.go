@@ -17,12 +17,38 @@ const (
 	JobStatusFailed    = "failed"
 	JobStatusPending   = "pending"
 	JobStatusCancelled = "cancelled"
+	JobStatusTimedOut  = "timed_out"
 )
 
+// A cron job recurs on CronExpr, a one-shot job fires exactly once at TriggerAt
+const (
+	JobKindCron = "cron"
+	JobKindOnce = "once"
+)
+
+// Misfire policies decide what happens to cron ticks missed while the service was down
+const (
+	MisfireSkip    = "skip"
+	MisfireRunOnce = "run_once"
+	MisfireCatchUp = "catch_up"
+)
+
+// Backoff strategies space out the retries of a failed execution
+const (
+	BackoffFixed             = "fixed"
+	BackoffExponential       = "exponential"
+	BackoffExponentialJitter = "exponential_jitter"
+)
+
+// A cordoned worker gets no new jobs, a paused one also stops asking for them until it is resumed. A
+// draining worker gets no new jobs and becomes inactive once the ones it runs have finished. All three
+// see their running executions through.
 const (
 	WorkerActive   = "active"
 	WorkerInactive = "inactive"
 	WorkerPaused   = "paused"
+	WorkerCordoned = "cordoned"
+	WorkerDraining = "draining"
 )
 
 type Job struct {
@@ -36,16 +62,72 @@ type Job struct {
 	RcreTime   time.Time `json:"rcre_time"`
 	TriggerAt  time.Time `json:"trigger_at"`
 	FinishAt   time.Time `json:"finish_at"`
+
+	// MisfirePolicy is one of the Misfire* constants (empty means run_once),
+	// CatchUpLimit caps how many missed ticks a catch_up job replays
+	MisfirePolicy string `json:"misfire_policy"`
+	CatchUpLimit  int    `json:"catch_up_limit"`
+
+	// TimeZone is the IANA zone CronExpr is evaluated in, a CRON_TZ= prefix on CronExpr takes precedence
+	TimeZone string `json:"time_zone"`
+
+	// Kind is one of the JobKind* constants, MaxRuns stops a cron job after that many runs (0 means no limit).
+	// Status becomes completed once the job has no runs left.
+	Kind    string `json:"kind"`
+	MaxRuns int    `json:"max_runs"`
+	Status  string `json:"status"`
+
+	// TimeoutSeconds bounds a single execution, 0 falls back to the worker default
+	TimeoutSeconds int `json:"timeout_seconds"`
+
+	// CPUSlots and MemoryMB are what a run needs on its worker, CPUSlots 0 means 1 and MemoryMB 0
+	// means the run asks for no memory
+	CPUSlots int `json:"cpu_slots"`
+	MemoryMB int `json:"memory_mb"`
+
+	// NodeSelector expressions must all match a worker's labels for the job to run there, a worker
+	// matching any AntiAffinity expression is ruled out. Expressions look like key=value, key!=value,
+	// key in (a,b), key notin (a,b), key or !key.
+	NodeSelector []string `gorm:"serializer:json" json:"node_selector"`
+	AntiAffinity []string `gorm:"serializer:json" json:"anti_affinity"`
+
+	// DeadlineSeconds is how long after its due time a run should have started, the edf policy
+	// dispatches the earliest deadline first. 0 means the job has no deadline.
+	DeadlineSeconds int `json:"deadline_seconds"`
+
+	// BackoffStrategy is one of the Backoff* constants (empty means exponential), the delay starts
+	// at BackoffBaseSeconds and never exceeds BackoffMaxSeconds
+	BackoffStrategy    string `json:"backoff_strategy"`
+	BackoffBaseSeconds int    `json:"backoff_base_seconds"`
+	BackoffMaxSeconds  int    `json:"backoff_max_seconds"`
+}
+
+// IsOneShot reports whether the job fires once at TriggerAt, jobs stored before kinds existed are cron jobs
+func (j *Job) IsOneShot() bool {
+	return j.Kind == JobKindOnce
 }
 
 type JobExecution struct {
 	ProcessID string    `gorm:"primaryKey" json:"process_id"`
 	JobID     string    `json:"job_id"`
-	WorkerID  string    `json:"worker_id"`
+	WorkerID  string    `gorm:"index" json:"worker_id"`
 	StartTime time.Time `json:"start_time"`
 	EndTime   time.Time `json:"end_time"`
 	Status    string    `json:"status"`
 	Error     string    `json:"error"`
+
+	// ExitCode is -1 when the process could not be started or was killed by a signal
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+
+	// CPUSlots and MemoryMB are reserved on the worker for the run and released when it ends
+	CPUSlots int `json:"cpu_slots"`
+	MemoryMB int `json:"memory_mb"`
+
+	// Attempt is the schedule's RetryCount when the run was dispatched, 0 for a first try. It outlives
+	// the schedules of one-shots and last runs, which are removed on dispatch.
+	Attempt int `json:"attempt"`
 }
 
 type Schedule struct {
@@ -59,8 +141,23 @@ type Schedule struct {
 	RcreTime    time.Time `json:"rcre_time"`
 	NextRunTime time.Time `json:"next_run_time"`
 	LastRunTime time.Time `json:"last_run_time"`
+
+	// MisfirePolicy is copied from the job, MissedRuns counts catch-up runs still owed after NextRunTime
+	MisfirePolicy string `json:"misfire_policy"`
+	MissedRuns    int    `json:"missed_runs"`
+
+	// RunCount is how many times the schedule has been dispatched, checked against Job.MaxRuns.
+	// Retrying marks the pending run as a retry, which doesn't count as a new run.
+	RunCount int  `json:"run_count"`
+	Retrying bool `json:"retrying"`
+
+	// LeaseOwner is the executor currently holding the schedule, the lease is void after LeaseExpiresAt
+	LeaseOwner     string    `gorm:"index" json:"lease_owner"`
+	LeaseExpiresAt time.Time `json:"lease_expires_at"`
 }
 
+// Worker advertises Capacity CPU slots and MemoryMB of memory, CurrentLoad and MemoryUsedMB are what
+// running executions have reserved. A MemoryMB of 0 means the worker doesn't track memory.
 type Worker struct {
 	WorkerID      string    `gorm:"primaryKey" json:"worker_id"`
 	IPAddress     string    `json:"ip_address"`
@@ -68,4 +165,44 @@ type Worker struct {
 	LastHeartbeat time.Time `json:"last_heartbeat"`
 	Capacity      int       `json:"capacity"`
 	CurrentLoad   int       `json:"current_load"`
+	MemoryMB      int       `json:"memory_mb"`
+	MemoryUsedMB  int       `json:"memory_used_mb"`
+
+	// Labels describe the worker to job node selectors, like role=api or gpu=false
+	Labels map[string]string `gorm:"serializer:json" json:"labels"`
+
+	// KeyID is the API key a remote worker registered with, only that key or an admin may act as the
+	// worker. Local workers and those registered with authentication disabled have none.
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// DeadLetter records a job that used up its retries, ExecutionIDs are the ProcessIDs of the failed attempts.
+// UserID is the job's, dead letters from before it was recorded have none and only admins see them.
+type DeadLetter struct {
+	DeadLetterID string    `gorm:"primaryKey" json:"dead_letter_id"`
+	JobID        string    `gorm:"index" json:"job_id"`
+	UserID       string    `gorm:"index" json:"user_id"`
+	LastError    string    `json:"last_error"`
+	LastStatus   string    `json:"last_status"`
+	Attempts     int       `json:"attempts"`
+	ExecutionIDs []string  `gorm:"serializer:json" json:"execution_ids"`
+	RcreTime     time.Time `json:"rcre_time"`
+}
+
+// APIKey authenticates a client as UserID, only the SHA-256 Hash of the key is stored and Prefix is
+// the start of it, enough to tell keys apart. An admin key may manage every user's jobs and keys, an
+// agent key authenticates a doit-agent as a worker and can't use the rest of the API.
+// A zero ExpiresAt never expires, a key stops working once RevokedAt is set.
+type APIKey struct {
+	KeyID      string    `gorm:"primaryKey" json:"key_id"`
+	Name       string    `json:"name"`
+	UserID     string    `gorm:"index" json:"user_id"`
+	Prefix     string    `json:"prefix"`
+	Hash       string    `gorm:"uniqueIndex" json:"-"`
+	Admin      bool      `json:"admin"`
+	Agent      bool      `json:"agent"`
+	RcreTime   time.Time `json:"rcre_time"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	RevokedAt  time.Time `json:"revoked_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
 }
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// postgresStores opens n stores, each with a connection pool of its own like separate executor
+// processes, on a schema of their own in the database at TEST_POSTGRES_DSN. The DSN is in the
+// key=value form NewPostgresStore builds. Without it the test is skipped.
+func postgresStores(t *testing.T, n int) []*GormStore {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connecting to postgres: %v", err)
+	}
+	schema := fmt.Sprintf("doit_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+		admin.Close()
+	})
+
+	stores := make([]*GormStore, n)
+	for i := range stores {
+		db, err := gorm.Open(postgres.Open(dsn+" search_path="+schema), &gorm.Config{})
+		if err != nil {
+			t.Fatalf("connecting to postgres: %v", err)
+		}
+		if stores[i], err = newGormStore(db); err != nil {
+			t.Fatalf("opening postgres store: %v", err)
+		}
+		store := stores[i]
+		t.Cleanup(func() { store.Close() })
+	}
+	return stores
+}
+
+func TestPostgresClaimSkipsLockedSchedules(t *testing.T) {
+	store := postgresStores(t, 1)[0]
+	createDueSchedules(t, store, 10)
+
+	// Another claimer's transaction holds four of the due schedules
+	tx := store.db.Begin()
+	defer tx.Rollback()
+	var locked []string
+	if err := tx.Raw("SELECT job_id FROM schedules ORDER BY job_id LIMIT 4 FOR UPDATE").Scan(&locked).Error; err != nil {
+		t.Fatalf("locking schedules: %v", err)
+	}
+
+	done := make(chan []Schedule, 1)
+	go func() {
+		claimed, err := store.ClaimDueSchedules("executor-b", time.Minute, 10)
+		if err != nil {
+			t.Errorf("claiming: %v", err)
+		}
+		done <- claimed
+	}()
+	var claimed []Schedule
+	select {
+	case claimed = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("claiming waited on the locked schedules instead of skipping them")
+	}
+
+	if len(claimed) != 6 {
+		t.Errorf("claimed %d schedules next to 4 locked ones, want 6", len(claimed))
+	}
+	for _, schedule := range claimed {
+		for _, jobID := range locked {
+			if schedule.JobID == jobID {
+				t.Errorf("claimed %s while another transaction held it", jobID)
+			}
+		}
+	}
+
+	// Once the other claimer lets go without leasing them, the locked schedules are free
+	if err := tx.Rollback().Error; err != nil {
+		t.Fatalf("rolling back: %v", err)
+	}
+	claimed, err := store.ClaimDueSchedules("executor-c", time.Minute, 10)
+	if err != nil {
+		t.Fatalf("claiming: %v", err)
+	}
+	if len(claimed) != len(locked) {
+		t.Errorf("claimed %d schedules after the lock was released, want %d", len(claimed), len(locked))
+	}
+}
+
+func TestPostgresClaimersCompete(t *testing.T) {
+	const schedules, batch = 200, 3
+
+	stores := postgresStores(t, 2)
+	createDueSchedules(t, stores[0], schedules)
+
+	var mu sync.Mutex
+	claims := make(map[string][]string)
+	var wg sync.WaitGroup
+	for i, store := range stores {
+		owner := fmt.Sprintf("executor-%d", i)
+		wg.Add(1)
+		go func(store *GormStore) {
+			defer wg.Done()
+			for {
+				claimed, err := store.ClaimDueSchedules(owner, time.Minute, batch)
+				if err != nil {
+					t.Errorf("%s claiming: %v", owner, err)
+					return
+				}
+				if len(claimed) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, schedule := range claimed {
+					claims[schedule.JobID] = append(claims[schedule.JobID], owner)
+				}
+				mu.Unlock()
+			}
+		}(store)
+	}
+	wg.Wait()
+
+	if len(claims) != schedules {
+		t.Errorf("claimed %d schedules, want %d", len(claims), schedules)
+	}
+	for jobID, owners := range claims {
+		if len(owners) != 1 {
+			t.Errorf("%s was claimed %d times, by %v", jobID, len(owners), owners)
+		}
+	}
+
+	// What was claimed is leased to whoever claimed it
+	for jobID, owners := range claims {
+		schedule, err := stores[1].GetSchedule(jobID)
+		if err != nil {
+			t.Fatalf("loading %s: %v", jobID, err)
+		}
+		if schedule.LeaseOwner != owners[0] {
+			t.Errorf("%s is leased to %q, want %q", jobID, schedule.LeaseOwner, owners[0])
+		}
+	}
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"mime/multipart"
@@ -10,11 +11,16 @@ import (
 	"time"
 	"path/filepath"
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	_ "github.com/lib/pq"
 )
 
-var DB *gorm.DB
+// GormStore implements Store on top of any gorm dialect
+type GormStore struct {
+	db *gorm.DB
+}
 
 // ensureDatabaseExists checks if the database exists, and creates it if not
 func ensureDatabaseExists() error {
@@ -56,13 +62,12 @@ func ensureDatabaseExists() error {
 	return nil
 }
 
-// ConnectDatabase initializes the database connection
-func ConnectDatabase() error {
+// NewPostgresStore initializes the Postgres connection described by the DB_* env vars
+func NewPostgresStore() (*GormStore, error) {
 	// Ensure the database exists before connecting
 	err := ensureDatabaseExists()
 	if err != nil {
-		log.Fatalf("Database check failed: %v", err)
-		return err
+		return nil, fmt.Errorf("database check failed: %v", err)
 	}
 
 	// Connect to the specified database
@@ -77,86 +82,143 @@ func ConnectDatabase() error {
 
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
-		return err
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+
+	return newGormStore(db)
+}
+
+// NewSQLiteStore opens (or creates) a single-file database for single-node installs
+func NewSQLiteStore(path string) (*GormStore, error) {
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %v", err)
+	}
+
+	// SQLite allows a single writer, serialize access through one connection
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
 	}
+	sqlDB.SetMaxOpenConns(1)
 
+	return newGormStore(db)
+}
+
+func newGormStore(db *gorm.DB) (*GormStore, error) {
 	// Migrate the schemas
-	err = db.AutoMigrate(&Job{}, &JobExecution{}, &Schedule{}, &Worker{})
+	if err := db.AutoMigrate(&Job{}, &JobExecution{}, &Schedule{}, &Worker{}, &DeadLetter{}, &APIKey{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate database schemas: %v", err)
+	}
+
+	log.Println("Database connected and schemas migrated!")
+	return &GormStore{db: db}, nil
+}
+
+func (s *GormStore) Close() error {
+	sqlDB, err := s.db.DB()
 	if err != nil {
-		log.Fatalf("Failed to migrate database schemas: %v", err)
 		return err
 	}
+	return sqlDB.Close()
+}
 
-	DB = db
-	fmt.Println("Database connected and schemas migrated!")
-	return nil
+// notFound maps gorm's sentinel onto the Store-wide ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
 }
 
-func CreateJob(job Job) error {
-	if err := DB.Create(&job).Error; err != nil {
+func (s *GormStore) CreateJob(job Job) error {
+	if err := s.db.Create(&job).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func GetJob(jobID string) (Job, error) {
+func (s *GormStore) GetJob(jobID string) (Job, error) {
 	var job Job
-	if err := DB.First(&job, "job_id = ?", jobID).Error; err != nil {
-		return Job{}, err
+	if err := s.db.First(&job, "job_id = ?", jobID).Error; err != nil {
+		return Job{}, notFound(err)
 	}
 	return job, nil
 }
 
-func GetAllJobs(limit, offset int) ([]Job, error) {
+func (s *GormStore) GetAllJobs(limit, offset int) ([]Job, error) {
 	var jobs []Job
-	if err := DB.Limit(limit).Offset(offset).Find(&jobs).Error; err != nil {
+	if err := s.db.Limit(limit).Offset(offset).Find(&jobs).Error; err != nil {
 		return nil, err
 	}
 	return jobs, nil
 }
 
-func UpdateJob(job Job) error {
-	if err := DB.Save(&job).Error; err != nil {
+func (s *GormStore) GetJobsByUser(userID string, limit, offset int) ([]Job, error) {
+	var jobs []Job
+	if err := s.db.Where("user_id = ?", userID).Limit(limit).Offset(offset).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *GormStore) UpdateJob(job Job) error {
+	if err := s.db.Save(&job).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func DeleteJob(jobID string) error {
-	if err := DB.Delete(&Job{}, "job_id = ?", jobID).Error; err != nil {
+func (s *GormStore) DeleteJob(jobID string) error {
+	if err := s.db.Delete(&Job{}, "job_id = ?", jobID).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func CreateSchedule(Schedule *Schedule) error {
-	if err := DB.Create(&Schedule).Error; err != nil {
+func (s *GormStore) UpdateJobPayload(jobID string, newPayload string) error {
+	var job Job
+
+	if err := s.db.First(&job, "job_id = ?", jobID).Error; err != nil {
+		return fmt.Errorf("job not found: %v", notFound(err))
+	}
+
+	job.Payload = newPayload
+	if err := s.db.Save(&job).Error; err != nil {
+		return fmt.Errorf("failed to update job payload: %v", err)
+	}
+
+	return nil
+}
+
+func (s *GormStore) CreateSchedule(schedule *Schedule) error {
+	if err := s.db.Create(schedule).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func GetSchedule(jobId string) (Schedule, error) {
+func (s *GormStore) GetSchedule(jobId string) (Schedule, error) {
 	var schedule Schedule
-	if err := DB.First(&schedule, "job_id = ?", jobId).Error; err != nil {
-		return Schedule{}, err
+	if err := s.db.First(&schedule, "job_id = ?", jobId).Error; err != nil {
+		return Schedule{}, notFound(err)
 	}
 	return schedule, nil
 }
 
-func GetAllSchedules(limit, offset int) ([]Schedule, error) {
-	var Schedules []Schedule
-	if err := DB.Limit(limit).Offset(offset).Find(&Schedules).Error; err != nil {
+func (s *GormStore) GetAllSchedules(limit, offset int) ([]Schedule, error) {
+	var schedules []Schedule
+	if err := s.db.Limit(limit).Offset(offset).Find(&schedules).Error; err != nil {
 		return nil, err
 	}
-	return Schedules, nil
+	return schedules, nil
 }
 
-func GetAllDueSchedules() ([]Schedule, error) {
+func (s *GormStore) GetSchedulesDueBefore(before time.Time) ([]Schedule, error) {
 	var schedules []Schedule
-	if err := DB.
-		Where("next_run_time <= ?", time.Now()).
+	if err := s.db.
+		Where("next_run_time <= ?", before).
+		Order("next_run_time").
 		Find(&schedules).Error; err != nil {
 		return nil, err
 	}
@@ -164,54 +226,423 @@ func GetAllDueSchedules() ([]Schedule, error) {
 	return schedules, nil
 }
 
-func UpdateSchedule(Schedule Schedule) error {
-	if err := DB.Save(&Schedule).Error; err != nil {
+func (s *GormStore) ClaimDueSchedules(owner string, lease time.Duration, limit int) ([]Schedule, error) {
+	var claimed []Schedule
+	now := time.Now()
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		query := tx.
+			Where("next_run_time <= ?", now).
+			Where("(lease_owner = ? OR lease_owner IS NULL OR lease_expires_at < ?)", "", now).
+			Order("next_run_time")
+		if limit > 0 {
+			query = query.Limit(limit)
+		}
+		// Postgres lets concurrent claimers skip each other's rows, SQLite serializes the transaction instead
+		if s.db.Dialector.Name() == DriverPostgres {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+		if err := query.Find(&claimed).Error; err != nil {
+			return err
+		}
+		if len(claimed) == 0 {
+			return nil
+		}
+
+		jobIDs := make([]string, len(claimed))
+		for i, schedule := range claimed {
+			jobIDs[i] = schedule.JobID
+		}
+
+		expiresAt := now.Add(lease)
+		if err := tx.Model(&Schedule{}).
+			Where("job_id IN ?", jobIDs).
+			Updates(map[string]interface{}{"lease_owner": owner, "lease_expires_at": expiresAt}).Error; err != nil {
+			return err
+		}
+		for i := range claimed {
+			claimed[i].LeaseOwner = owner
+			claimed[i].LeaseExpiresAt = expiresAt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return claimed, nil
+}
+
+func (s *GormStore) RenewScheduleLeases(owner string, jobIDs []string, lease time.Duration) error {
+	if len(jobIDs) == 0 {
+		return nil
+	}
+	return s.db.Model(&Schedule{}).
+		Where("job_id IN ? AND lease_owner = ?", jobIDs, owner).
+		Update("lease_expires_at", time.Now().Add(lease)).Error
+}
+
+func (s *GormStore) UpdateSchedule(schedule Schedule) error {
+	if err := s.db.Save(&schedule).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func DeleteSchedule(JobID string) error {
-	if err := DB.Delete(&Schedule{}, "job_id = ?", JobID).Error; err != nil {
+func (s *GormStore) AdvanceSchedule(schedule Schedule, owner string) error {
+	result := s.db.Model(&Schedule{}).
+		Where("job_id = ? AND lease_owner = ?", schedule.JobID, owner).
+		Updates(map[string]interface{}{
+			"next_run_time":    schedule.NextRunTime,
+			"last_run_time":    schedule.LastRunTime,
+			"run_count":        schedule.RunCount,
+			"missed_runs":      schedule.MissedRuns,
+			"retrying":         schedule.Retrying,
+			"lease_owner":      "",
+			"lease_expires_at": time.Time{},
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (s *GormStore) MisfireSchedule(schedule Schedule, missed time.Time) (bool, error) {
+	result := s.db.Model(&Schedule{}).
+		Where("job_id = ? AND next_run_time = ?", schedule.JobID, missed).
+		Where("(lease_owner = ? OR lease_owner IS NULL OR lease_expires_at < ?)", "", time.Now()).
+		Updates(map[string]interface{}{
+			"next_run_time": schedule.NextRunTime,
+			"missed_runs":   schedule.MissedRuns,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (s *GormStore) RetrySchedule(jobID string, retryCount int, retryAt time.Time) (bool, error) {
+	scheduled := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		scheduled, err = retrySchedule(tx, jobID, retryCount, retryAt)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return scheduled, nil
+}
+
+func retrySchedule(tx *gorm.DB, jobID string, retryCount int, retryAt time.Time) (bool, error) {
+	result := tx.Model(&Schedule{}).Where("job_id = ?", jobID).Update("retry_count", retryCount)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, ErrNotFound
+	}
+	if retryAt.IsZero() {
+		return false, nil
+	}
+
+	// A leased schedule is being dispatched, that run doubles as the retry
+	result = tx.Model(&Schedule{}).
+		Where("job_id = ?", jobID).
+		Where("(lease_owner = ? OR lease_owner IS NULL OR lease_expires_at < ?)", "", time.Now()).
+		Updates(map[string]interface{}{
+			"retrying":      true,
+			"next_run_time": gorm.Expr("CASE WHEN next_run_time > ? THEN ? ELSE next_run_time END", retryAt, retryAt),
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (s *GormStore) DeleteSchedule(jobID string) error {
+	if err := s.db.Delete(&Schedule{}, "job_id = ?", jobID).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func CreateJobExecution(je *JobExecution) error {
-	if err := DB.Create(&je).Error; err != nil {
+func (s *GormStore) CreateJobExecution(je *JobExecution) error {
+	if err := s.db.Create(je).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
-func ValidateJobID(jobId string) error {
-	var job Job
-	if err := DB.First(&job, "job_id = ?", jobId).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return fmt.Errorf("jobId does not exist")
+func (s *GormStore) GetJobExecution(processID string) (JobExecution, error) {
+	var je JobExecution
+	if err := s.db.First(&je, "process_id = ?", processID).Error; err != nil {
+		return JobExecution{}, notFound(err)
+	}
+	return je, nil
+}
+
+func (s *GormStore) GetJobExecutionsByJob(jobID string) ([]JobExecution, error) {
+	var executions []JobExecution
+	if err := s.db.Where("job_id = ?", jobID).Order("start_time").Find(&executions).Error; err != nil {
+		return nil, err
+	}
+	return executions, nil
+}
+
+func (s *GormStore) GetJobExecutionsByWorker(workerID string, status string) ([]JobExecution, error) {
+	var executions []JobExecution
+	if err := s.db.Where("worker_id = ? AND status = ?", workerID, status).Order("start_time").Find(&executions).Error; err != nil {
+		return nil, err
+	}
+	return executions, nil
+}
+
+func (s *GormStore) UpdateJobExecution(je JobExecution) error {
+	if err := s.db.Save(&je).Error; err != nil {
+		return err
+	}
+	return nil
+}
+
+// FinishRunningExecution is a single conditional UPDATE, of two callers finishing an execution only one wins
+func (s *GormStore) FinishRunningExecution(je JobExecution) (bool, error) {
+	if err := je.BeforeSave(nil); err != nil {
+		return false, err
+	}
+	result := s.db.Model(&JobExecution{}).
+		Where("process_id = ? AND status = ?", je.ProcessID, JobStatusRunning).
+		UpdateColumns(map[string]interface{}{
+			"status":    je.Status,
+			"end_time":  je.EndTime,
+			"exit_code": je.ExitCode,
+			"error":     je.Error,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (s *GormStore) SetRunningExecutionOutput(processID string, stdout string, stderr string) (bool, error) {
+	result := s.db.Model(&JobExecution{}).
+		Where("process_id = ? AND status = ?", processID, JobStatusRunning).
+		UpdateColumns(map[string]interface{}{"stdout": stdout, "stderr": stderr})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (s *GormStore) CreateDeadLetter(deadLetter *DeadLetter) error {
+	if err := s.db.Create(deadLetter).Error; err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *GormStore) GetDeadLetter(deadLetterID string) (DeadLetter, error) {
+	var deadLetter DeadLetter
+	if err := s.db.First(&deadLetter, "dead_letter_id = ?", deadLetterID).Error; err != nil {
+		return DeadLetter{}, notFound(err)
+	}
+	return deadLetter, nil
+}
+
+func (s *GormStore) GetAllDeadLetters(limit, offset int) ([]DeadLetter, error) {
+	var deadLetters []DeadLetter
+	if err := s.db.Order("rcre_time DESC").Limit(limit).Offset(offset).Find(&deadLetters).Error; err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+func (s *GormStore) GetDeadLettersByUser(userID string, limit, offset int) ([]DeadLetter, error) {
+	var deadLetters []DeadLetter
+	if err := s.db.Where("user_id = ?", userID).Order("rcre_time DESC").Limit(limit).Offset(offset).Find(&deadLetters).Error; err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+func (s *GormStore) DeleteDeadLetter(deadLetterID string) error {
+	if err := s.db.Delete(&DeadLetter{}, "dead_letter_id = ?", deadLetterID).Error; err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *GormStore) RequeueDeadLetter(deadLetterID string, schedule Schedule) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&DeadLetter{}, "dead_letter_id = ?", deadLetterID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		_, err := retrySchedule(tx, schedule.JobID, schedule.RetryCount, schedule.NextRunTime)
+		if errors.Is(err, ErrNotFound) {
+			return tx.Create(&schedule).Error
 		}
 		return err
+	})
+}
+
+func (s *GormStore) PurgeDeadLetters() (int64, error) {
+	result := s.db.Where("1 = 1").Delete(&DeadLetter{})
+	if result.Error != nil {
+		return 0, result.Error
 	}
+	return result.RowsAffected, nil
+}
 
+func (s *GormStore) CreateWorker(worker *Worker) error {
+	if err := s.db.Create(worker).Error; err != nil {
+		return err
+	}
 	return nil
 }
 
-func UpdateJobPayload(jobID string, newPayload string) error {
-	var job Job
+func (s *GormStore) GetWorker(workerID string) (Worker, error) {
+	var worker Worker
+	if err := s.db.First(&worker, "worker_id = ?", workerID).Error; err != nil {
+		return Worker{}, notFound(err)
+	}
+	return worker, nil
+}
 
-	if err := DB.First(&job, "job_id = ?", jobID).Error; err != nil {
-		return fmt.Errorf("job not found: %v", err)
+func (s *GormStore) GetAllWorkers() ([]Worker, error) {
+	var workers []Worker
+	if err := s.db.Find(&workers).Error; err != nil {
+		return nil, err
 	}
+	return workers, nil
+}
 
-	job.Payload = newPayload
-	if err := DB.Save(&job).Error; err != nil {
-		return fmt.Errorf("failed to update job payload: %v", err)
+func (s *GormStore) UpdateWorker(worker Worker) error {
+	if err := s.db.Save(&worker).Error; err != nil {
+		return err
 	}
+	return nil
+}
 
+func (s *GormStore) DeleteWorker(workerID string) error {
+	if err := s.db.Delete(&Worker{}, "worker_id = ?", workerID).Error; err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *GormStore) HeartbeatWorker(workerID string, at time.Time) error {
+	result := s.db.Model(&Worker{}).Where("worker_id = ?", workerID).UpdateColumn("last_heartbeat", at)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReserveWorker is a single conditional UPDATE, concurrent reservations can't overcommit the worker
+func (s *GormStore) ReserveWorker(workerID string, cpuSlots int, memoryMB int) error {
+	result := s.db.Model(&Worker{}).
+		Where("worker_id = ? AND status = ?", workerID, WorkerActive).
+		Where("current_load + ? <= capacity", cpuSlots).
+		Where("(memory_mb = 0 OR memory_used_mb + ? <= memory_mb)", memoryMB).
+		UpdateColumns(map[string]interface{}{
+			"current_load":   gorm.Expr("current_load + ?", cpuSlots),
+			"memory_used_mb": gorm.Expr("memory_used_mb + ?", memoryMB),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInsufficientCapacity
+	}
+	return nil
+}
+
+func (s *GormStore) ReleaseWorker(workerID string, cpuSlots int, memoryMB int) error {
+	return s.db.Model(&Worker{}).
+		Where("worker_id = ?", workerID).
+		UpdateColumns(map[string]interface{}{
+			"current_load":   gorm.Expr("CASE WHEN current_load > ? THEN current_load - ? ELSE 0 END", cpuSlots, cpuSlots),
+			"memory_used_mb": gorm.Expr("CASE WHEN memory_used_mb > ? THEN memory_used_mb - ? ELSE 0 END", memoryMB, memoryMB),
+		}).Error
+}
+
+func (s *GormStore) SetWorkerStatus(workerID string, from []string, status string) error {
+	result := s.db.Model(&Worker{}).
+		Where("worker_id = ? AND status IN ?", workerID, from).
+		UpdateColumn("status", status)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := s.GetWorker(workerID); err != nil {
+			return err
+		}
+		return ErrWorkerStatus
+	}
+	return nil
+}
+
+func (s *GormStore) CreateAPIKey(key *APIKey) error {
+	if err := s.db.Create(key).Error; err != nil {
+		return err
+	}
 	return nil
 }
 
+func (s *GormStore) GetAPIKey(keyID string) (APIKey, error) {
+	var key APIKey
+	if err := s.db.First(&key, "key_id = ?", keyID).Error; err != nil {
+		return APIKey{}, notFound(err)
+	}
+	return key, nil
+}
+
+func (s *GormStore) GetAPIKeyByHash(hash string) (APIKey, error) {
+	var key APIKey
+	if err := s.db.First(&key, "hash = ?", hash).Error; err != nil {
+		return APIKey{}, notFound(err)
+	}
+	return key, nil
+}
+
+func (s *GormStore) GetAPIKeys(userID string) ([]APIKey, error) {
+	query := s.db.Order("rcre_time DESC")
+	if userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	var keys []APIKey
+	if err := query.Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *GormStore) RevokeAPIKey(keyID string, at time.Time) error {
+	key, err := s.GetAPIKey(keyID)
+	if err != nil {
+		return err
+	}
+	if !key.RevokedAt.IsZero() {
+		return nil
+	}
+	return s.db.Model(&APIKey{}).Where("key_id = ?", keyID).UpdateColumn("revoked_at", at).Error
+}
+
+func (s *GormStore) TouchAPIKey(keyID string, at time.Time) error {
+	return s.db.Model(&APIKey{}).Where("key_id = ?", keyID).UpdateColumn("last_used_at", at).Error
+}
+
 func SaveJobScript(file *multipart.FileHeader) error {
 	uploadDir := ScriptPath
 	err := os.MkdirAll(uploadDir, os.ModePerm)
@@ -219,7 +650,7 @@ func SaveJobScript(file *multipart.FileHeader) error {
 		return fmt.Errorf("failed to create upload directory: %v", err)
 	}
 
-	filePath := filepath.Join(uploadDir, file.Filename)  
+	filePath := filepath.Join(uploadDir, filepath.Base(file.Filename))
 
 	srcFile, err := file.Open()
 	if err != nil {
@@ -242,7 +673,7 @@ func SaveJobScript(file *multipart.FileHeader) error {
 }
 
 func (j *JobExecution) BeforeSave(tx *gorm.DB) (err error) {
-	if j.Status != JobStatusPending && j.Status != JobStatusRunning && j.Status != JobStatusCompleted && j.Status != JobStatusFailed && j.Status != JobStatusCancelled {
+	if j.Status != JobStatusPending && j.Status != JobStatusRunning && j.Status != JobStatusCompleted && j.Status != JobStatusFailed && j.Status != JobStatusCancelled && j.Status != JobStatusTimedOut {
 		return fmt.Errorf("invalid job status: %s", j.Status)
 	}
 
@@ -250,7 +681,9 @@ func (j *JobExecution) BeforeSave(tx *gorm.DB) (err error) {
 }
 
 func (w *Worker) BeforeSave(tx *gorm.DB) (err error) {
-	if w.Status != WorkerActive && w.Status != WorkerInactive && w.Status != WorkerPaused {
+	switch w.Status {
+	case WorkerActive, WorkerInactive, WorkerPaused, WorkerCordoned, WorkerDraining:
+	default:
 		return fmt.Errorf("invalid worker status: %s", w.Status)
 	}
 	if w.CurrentLoad < 0 {
@@ -259,5 +692,11 @@ func (w *Worker) BeforeSave(tx *gorm.DB) (err error) {
 	if w.CurrentLoad > w.Capacity {
 		return fmt.Errorf("current load cannot exceed capacity")
 	}
+	if w.MemoryMB < 0 || w.MemoryUsedMB < 0 {
+		return fmt.Errorf("memory cannot be negative")
+	}
+	if w.MemoryMB > 0 && w.MemoryUsedMB > w.MemoryMB {
+		return fmt.Errorf("used memory cannot exceed the worker's memory")
+	}
 	return nil
 }
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+	DriverMemory   = "memory"
+)
+
+// ErrNotFound is returned by every Store implementation when a lookup misses
+var ErrNotFound = errors.New("record not found")
+
+// ErrInsufficientCapacity is returned by ReserveWorker when the worker is not active or the request doesn't fit
+var ErrInsufficientCapacity = errors.New("worker has insufficient capacity")
+
+// ErrLeaseLost is returned by AdvanceSchedule when the schedule is no longer leased to the caller
+var ErrLeaseLost = errors.New("schedule is not leased to this owner")
+
+// ErrWorkerStatus is returned by SetWorkerStatus when the worker isn't in one of the statuses it may change from
+var ErrWorkerStatus = errors.New("worker status does not allow this change")
+
+// Store is the persistence layer shared by the scheduler, executor, workers and controllers
+type Store interface {
+	CreateJob(job Job) error
+	GetJob(jobID string) (Job, error)
+	GetAllJobs(limit, offset int) ([]Job, error)
+	GetJobsByUser(userID string, limit, offset int) ([]Job, error)
+	UpdateJob(job Job) error
+	UpdateJobPayload(jobID string, newPayload string) error
+	DeleteJob(jobID string) error
+
+	CreateSchedule(schedule *Schedule) error
+	GetSchedule(jobID string) (Schedule, error)
+	GetAllSchedules(limit, offset int) ([]Schedule, error)
+	GetSchedulesDueBefore(before time.Time) ([]Schedule, error)
+	// ClaimDueSchedules leases up to limit due schedules to owner, skipping rows leased by someone else
+	ClaimDueSchedules(owner string, lease time.Duration, limit int) ([]Schedule, error)
+	// RenewScheduleLeases extends the leases owner holds on the schedules of jobIDs, leases it lost are left alone
+	RenewScheduleLeases(owner string, jobIDs []string, lease time.Duration) error
+	UpdateSchedule(schedule Schedule) error
+	// AdvanceSchedule writes the run bookkeeping of a dispatched schedule and releases its lease, it fails
+	// with ErrLeaseLost unless owner still holds the lease. RetryCount is left to RetrySchedule.
+	AdvanceSchedule(schedule Schedule, owner string) error
+	// RetrySchedule sets RetryCount and, when retryAt isn't zero and no executor holds the lease, marks
+	// the schedule retrying and brings NextRunTime forward to retryAt. It reports whether it did the latter.
+	RetrySchedule(jobID string, retryCount int, retryAt time.Time) (bool, error)
+	// MisfireSchedule writes the NextRunTime and MissedRuns a misfire policy chose, only while no
+	// executor holds the lease and NextRunTime is still the missed run at missed. It reports whether it did.
+	MisfireSchedule(schedule Schedule, missed time.Time) (bool, error)
+	DeleteSchedule(jobID string) error
+
+	CreateJobExecution(je *JobExecution) error
+	GetJobExecution(processID string) (JobExecution, error)
+	GetJobExecutionsByJob(jobID string) ([]JobExecution, error)
+	GetJobExecutionsByWorker(workerID string, status string) ([]JobExecution, error)
+	UpdateJobExecution(je JobExecution) error
+	// FinishRunningExecution writes the Status, EndTime, ExitCode and Error of je only while the
+	// execution is still running, it reports whether it did
+	FinishRunningExecution(je JobExecution) (bool, error)
+	// SetRunningExecutionOutput replaces the Stdout and Stderr of an execution only while it is still
+	// running, it reports whether it did
+	SetRunningExecutionOutput(processID string, stdout string, stderr string) (bool, error)
+
+	CreateDeadLetter(deadLetter *DeadLetter) error
+	GetDeadLetter(deadLetterID string) (DeadLetter, error)
+	GetAllDeadLetters(limit, offset int) ([]DeadLetter, error)
+	GetDeadLettersByUser(userID string, limit, offset int) ([]DeadLetter, error)
+	DeleteDeadLetter(deadLetterID string) error
+	// RequeueDeadLetter deletes the dead letter and, in the same transaction, retries the job's
+	// schedule at schedule's RetryCount and NextRunTime as RetrySchedule does, or creates schedule
+	// when the job has none. It fails with ErrNotFound when the dead letter is gone.
+	RequeueDeadLetter(deadLetterID string, schedule Schedule) error
+	PurgeDeadLetters() (int64, error)
+
+	CreateWorker(worker *Worker) error
+	GetWorker(workerID string) (Worker, error)
+	GetAllWorkers() ([]Worker, error)
+	UpdateWorker(worker Worker) error
+	DeleteWorker(workerID string) error
+	// HeartbeatWorker only moves LastHeartbeat, it leaves the load alone
+	HeartbeatWorker(workerID string, at time.Time) error
+	// ReserveWorker adds cpuSlots and memoryMB to an active worker's load in one atomic step, it fails
+	// with ErrInsufficientCapacity instead of going over the worker's capacity
+	ReserveWorker(workerID string, cpuSlots int, memoryMB int) error
+	// ReleaseWorker takes a reservation back off the worker's load, the load never drops below zero
+	ReleaseWorker(workerID string, cpuSlots int, memoryMB int) error
+	// SetWorkerStatus moves a worker whose status is one of from to status, it leaves the load alone and
+	// fails with ErrWorkerStatus when the worker is in another status
+	SetWorkerStatus(workerID string, from []string, status string) error
+
+	CreateAPIKey(key *APIKey) error
+	GetAPIKey(keyID string) (APIKey, error)
+	GetAPIKeyByHash(hash string) (APIKey, error)
+	// GetAPIKeys lists the keys of userID, every user's keys when userID is empty
+	GetAPIKeys(userID string) ([]APIKey, error)
+	// RevokeAPIKey sets RevokedAt unless the key is already revoked, TouchAPIKey only moves LastUsedAt
+	RevokeAPIKey(keyID string, at time.Time) error
+	TouchAPIKey(keyID string, at time.Time) error
+
+	Close() error
+}
+
+// NewStore opens the backend named by driver, falling back to DB_DRIVER and then Postgres
+func NewStore(driver string) (Store, error) {
+	if driver == "" {
+		driver = os.Getenv("DB_DRIVER")
+	}
+
+	switch driver {
+	case "", DriverPostgres:
+		return NewPostgresStore()
+	case DriverSQLite:
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "doit.db"
+		}
+		return NewSQLiteStore(path)
+	case DriverMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown database driver: %v", driver)
+	}
+}
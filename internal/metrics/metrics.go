@@ -0,0 +1,74 @@
+// Package metrics holds the Prometheus collectors doit exports on /metrics
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	TenantDispatched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "doit_tenant_dispatched_jobs_total",
+		Help: "Jobs handed to a worker, by tenant. Tenants without a configured weight are counted as other.",
+	}, []string{"tenant"})
+
+	TenantQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "doit_tenant_queued_jobs",
+		Help: "Due jobs waiting for a worker, by tenant. Tenants without a configured weight are counted as other.",
+	}, []string{"tenant"})
+
+	TenantWeight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "doit_tenant_weight",
+		Help: "Fair share weight of the tenant, for tenants with a configured weight.",
+	}, []string{"tenant"})
+
+	TenantShare = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "doit_tenant_share_ratio",
+		Help: "Fraction of all dispatched jobs that went to the tenant, tenants without a configured weight are counted as other.",
+	}, []string{"tenant"})
+
+	QueueBucketTokens = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "doit_queue_bucket_tokens",
+		Help: "Tokens left in the queue's rate limit bucket.",
+	}, []string{"queue"})
+
+	QueueBucketCapacity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "doit_queue_bucket_capacity",
+		Help: "Size of the queue's rate limit bucket.",
+	}, []string{"queue"})
+
+	QueueBucketRefill = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "doit_queue_bucket_refill_per_second",
+		Help: "Tokens the queue's rate limit bucket gains per second.",
+	}, []string{"queue"})
+
+	QueueThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "doit_queue_throttled_total",
+		Help: "Times a job was held back because its queue was over its rate.",
+	}, []string{"queue"})
+
+	APIThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "doit_api_throttled_total",
+		Help: "API requests refused because the client was over its rate, by read or write route or the per-IP limit.",
+	}, []string{"class"})
+
+	PoolSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "doit_worker_pool_size",
+		Help: "Local workers the pool runs.",
+	})
+
+	PoolScaleEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "doit_worker_pool_scale_events_total",
+		Help: "Times the worker pool was scaled, by direction.",
+	}, []string{"direction"})
+
+	PoolWaitingJobs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "doit_worker_pool_waiting_jobs",
+		Help: "Queued jobs a local worker could run.",
+	})
+
+	PoolOldestWait = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "doit_worker_pool_oldest_wait_seconds",
+		Help: "How long the oldest queued job a local worker could run has waited.",
+	})
+)
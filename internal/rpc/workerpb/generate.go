@@ -0,0 +1,4 @@
+// Package workerpb holds the gRPC protocol between the executor and its workers, generated from worker.proto
+package workerpb
+
+//go:generate protoc --proto_path=../../.. --go_out=../../.. --go_opt=paths=source_relative --go-grpc_out=../../.. --go-grpc_opt=paths=source_relative internal/rpc/workerpb/worker.proto
@@ -1,11 +1,16 @@
 package executor
 
 import (
-	"container/heap"
 	"doit/internal/api/middlewares"
+	"doit/internal/auth"
+	"doit/internal/cache/redishandler"
+	"doit/internal/controller"
 	"doit/internal/db"
+	"doit/internal/services/scheduler"
 	"doit/internal/services/worker"
 	"doit/pkg/utils"
+	"errors"
+	"fmt"
 	"github.com/joho/godotenv"
 	"log"
 	"os"
@@ -13,29 +18,76 @@ import (
 	"time"
 )
 
-const ScheduleQueryFreq = 1 * time.Minute
+// ScheduleQueryFreq is how often upcoming schedules are loaded from the store into the timing wheel,
+// ScheduleLookAhead is how far ahead each load reaches
+const ScheduleQueryFreq = 10 * time.Second
+const ScheduleLookAhead = 1 * time.Minute
 
-type Executor struct{}
+// The timing wheel resolves due times to WheelTick, which keeps seconds-level cron and @every accurate
+const WheelTick = 100 * time.Millisecond
+const WheelSize = 64
 
-func NewExecutor() *Executor {
-	return &Executor{}
+// DefaultLeaseDuration is how long a claimed schedule stays reserved for this executor
+const DefaultLeaseDuration = 5 * time.Minute
+
+// DispatchWait is how long the executor offers a job to the worker pool before it ages the
+// ready queue and plans again
+const DispatchWait = WheelTick
+
+type Executor struct {
+	Id            string
+	store         db.Store
+	leaseDuration time.Duration
+	wheel         *utils.TimingWheel
+	policy        scheduler.SchedulingPolicy
+	queue         *scheduler.ReadyQueue
+	fairShare     *scheduler.FairShare
+	rateLimits    *scheduler.RateLimits
+	// authn checks the workers calling the gRPC WorkerService, nil when authentication is disabled
+	authn *auth.Authenticator
+	// claimed are the schedules of the queued jobs, only the Run loop touches them
+	claimed map[string]claim
 }
 
-func (e *Executor) PrioritizeJobs(jobs []*db.Job) {
-	pq := make(utils.PriorityQueue, len(jobs))
-	for i, job := range jobs {
-		pq[i] = &utils.JobItem{
-			Value:    job,
-			Priority: job.Priority,
-		}
+// claim is a schedule whose job waits in the queue, advanced is set once the schedule has been
+// moved on for a hand-off the worker didn't take
+type claim struct {
+	schedule db.Schedule
+	advanced bool
+}
+
+func NewExecutor(store db.Store) *Executor {
+	return &Executor{
+		Id:            utils.GenerateExecutorId(),
+		store:         store,
+		leaseDuration: DefaultLeaseDuration,
+		wheel:         utils.NewTimingWheel(WheelTick, WheelSize, time.Now()),
+		policy:        scheduler.StrictPriority{},
+		queue:         scheduler.NewReadyQueue(scheduler.Aging{Interval: scheduler.DefaultAgingInterval, Cap: scheduler.DefaultAgingCap}),
+		fairShare:     scheduler.NewFairShare(nil),
+		rateLimits:    scheduler.NewRateLimits(scheduler.DefaultRateLimits),
+		claimed:       make(map[string]claim),
 	}
+}
 
-	jobs = []*db.Job{}
-	heap.Init(&pq)
+// Queue is where due jobs wait until a worker takes them
+func (e *Executor) Queue() *scheduler.ReadyQueue {
+	return e.queue
+}
 
-	for pq.Len() > 0 {
-		jobs = append(jobs, heap.Pop(&pq).(*utils.JobItem).Value)
-	}
+// FairShare splits dispatches between tenants, weights can be changed while the executor runs
+func (e *Executor) FairShare() *scheduler.FairShare {
+	return e.fairShare
+}
+
+// RateLimits caps how fast each queue is dispatched, the buckets can be changed while the executor runs
+func (e *Executor) RateLimits() *scheduler.RateLimits {
+	return e.rateLimits
+}
+
+// SetAuthenticator makes gRPC workers authenticate with an agent or admin key, call it before Run
+func (e *Executor) SetAuthenticator(a *auth.Authenticator) {
+	e.authn = a
 }
 
 func (e *Executor) fetchSchedulesFromDB(maxRetries int) ([]db.Schedule, error) {
@@ -43,7 +95,7 @@ func (e *Executor) fetchSchedulesFromDB(maxRetries int) ([]db.Schedule, error) {
 	var err error
 	retryCount := 0
 	for retryCount < maxRetries {
-		schedules, err = db.GetAllDueSchedules()
+		schedules, err = e.store.ClaimDueSchedules(e.Id, e.leaseDuration, 0)
 		if err == nil {
 			return schedules, nil
 		}
@@ -69,43 +121,395 @@ func (e *Executor) Run(w *worker.WorkerPool) {
 		return
 	}
 
+	if lease := os.Getenv("SCHEDULE_LEASE_DURATION"); lease != "" {
+		if e.leaseDuration, err = time.ParseDuration(lease); err != nil {
+			log.Fatalf("Error loading SCHEDULE_LEASE_DURATION: %v", err)
+			return
+		}
+	}
+
+	if e.policy, err = scheduler.LoadSchedulingPolicy(); err != nil {
+		log.Fatalf("Error loading scheduling policy: %v", err)
+		return
+	}
+	log.Printf("Dispatching with the %s scheduling policy", e.policy.Name())
+
+	aging, err := scheduler.LoadAging()
+	if err != nil {
+		log.Fatalf("Error loading priority aging: %v", err)
+		return
+	}
+	e.queue.SetAging(aging)
+
+	weights, err := scheduler.LoadTenantWeights()
+	if err != nil {
+		log.Fatalf("Error loading tenant weights: %v", err)
+		return
+	}
+	for tenant, weight := range weights {
+		e.fairShare.SetWeight(tenant, weight)
+	}
+
+	limits, err := scheduler.LoadRateLimits()
+	if err != nil {
+		log.Fatalf("Error loading queue rate limits: %v", err)
+		return
+	}
+	for q, limit := range limits {
+		e.rateLimits.Set(scheduler.Queue(q), limit)
+	}
+	// Executors sharing the buckets dispatch each queue at one cluster-wide rate
+	if os.Getenv("RATE_LIMIT_BACKEND") == "redis" {
+		e.rateLimits.Share(redishandler.GetRedisClient().Rdb)
+		log.Println("Queue rate limits are shared through Redis")
+	}
+
+	go e.serveGRPC(w)
+
+	e.dispatchDue(w, maxRetries)
+	if e.loadUpcoming() {
+		e.dispatchDue(w, maxRetries)
+	}
+
+	tick := time.NewTicker(WheelTick)
+	defer tick.Stop()
+	load := time.NewTicker(ScheduleQueryFreq)
+	defer load.Stop()
+
 	for {
-		schedules, err := e.fetchSchedulesFromDB(maxRetries)
+		select {
+		case now := <-tick.C:
+			if len(e.wheel.Advance(now)) > 0 {
+				e.dispatchDue(w, maxRetries)
+			} else if e.distributeJobs(w) {
+				e.dispatchDue(w, maxRetries)
+			}
+		case <-load.C:
+			e.renewLeases()
+			if e.loadUpcoming() {
+				e.dispatchDue(w, maxRetries)
+			}
+		}
+	}
+}
+
+// loadUpcoming puts every schedule due within ScheduleLookAhead on the timing wheel,
+// it reports whether any of them is already due
+func (e *Executor) loadUpcoming() bool {
+	schedules, err := e.store.GetSchedulesDueBefore(time.Now().Add(ScheduleLookAhead))
+	if err != nil {
+		log.Printf("Error loading upcoming schedules: %v", err)
+		return false
+	}
+
+	due := false
+	for _, schedule := range schedules {
+		if !e.wheel.Add(schedule.JobID, schedule.NextRunTime) {
+			due = true
+		}
+	}
+	return due
+}
+
+// renewLeases keeps the schedules of queued jobs leased, a job can wait longer than a lease lasts.
+// Leases of an executor that stopped run out and its queued jobs are claimed again.
+func (e *Executor) renewLeases() {
+	if err := e.store.RenewScheduleLeases(e.Id, e.queue.JobIDs(), e.leaseDuration); err != nil {
+		log.Printf("Error renewing schedule leases: %v", err)
+	}
+}
+
+// dispatchDue claims every due schedule, queues the jobs for the worker pool and places what it can.
+// The wheel only decides when to look, the lease taken by the claim decides who runs a job.
+// Catch-up runs leave a schedule due again straight away, so keep going until nothing is due.
+func (e *Executor) dispatchDue(w *worker.WorkerPool, maxRetries int) {
+	for e.dispatchOnce(w, maxRetries) {
+	}
+}
+
+func (e *Executor) dispatchOnce(w *worker.WorkerPool, maxRetries int) bool {
+	schedules, err := e.fetchSchedulesFromDB(maxRetries)
+	if err != nil {
+		log.Fatalf("Error fetching schedules after retries: %v", err)
+		return false
+	}
+
+	schedules = e.applyMisfirePolicies(schedules, time.Now())
+	e.queueClaimed(schedules)
+	return e.distributeJobs(w)
+}
+
+// applyMisfirePolicies catches schedules the scheduler hasn't corrected yet after downtime,
+// only the schedules that are still due once their policy is applied are returned
+func (e *Executor) applyMisfirePolicies(schedules []db.Schedule, now time.Time) []db.Schedule {
+	sc, err := controller.CreateScheduleController("ScheduleOperationController", e.store)
+	if err != nil {
+		log.Printf("error initializing ScheduleOperationController: %v", err)
+		return schedules
+	}
+
+	due := []db.Schedule{}
+	for _, schedule := range schedules {
+		job, err := e.store.GetJob(schedule.JobID)
 		if err != nil {
-			log.Fatalf("Error fetching schedules after retries: %v", err)
-			return
+			// queueClaimed cleans up schedules of deleted jobs
+			due = append(due, schedule)
+			continue
 		}
 
-		jobs := []*db.Job{}
-		for _, schedule := range schedules {
-			jobs = append(jobs, &db.Job{
-				JobID:    schedule.JobID,
-				Priority: schedule.Priority,
-				Payload:  schedule.Payload,
-			})
+		updated, changed, err := scheduler.ApplyMisfirePolicy(job, schedule, now)
+		if err != nil {
+			log.Printf("Error applying misfire policy for job %s: %v", job.JobID, err)
+			continue
+		}
+		if changed && updated.NextRunTime.After(now) {
+			if err := sc.AdvanceSchedule(&updated, e.Id); err != nil {
+				log.Printf("Error applying misfire policy for job %s: %v", job.JobID, err)
+				continue
+			}
+			e.wheel.Add(updated.JobID, updated.NextRunTime)
+			continue
+		}
+		due = append(due, updated)
+	}
+
+	return due
+}
+
+// queueClaimed queues the jobs of claimed schedules, the schedules stay leased until their jobs are
+// handed out. A job that is still waiting keeps its place, it runs once however many of its ticks
+// came due meanwhile. Schedules of deleted jobs are removed.
+func (e *Executor) queueClaimed(schedules []db.Schedule) {
+	sc, err := controller.CreateScheduleController("ScheduleOperationController", e.store)
+	if err != nil {
+		log.Printf("error initializing ScheduleOperationController: %v", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		stored, err := e.store.GetJob(schedule.JobID)
+		if errors.Is(err, db.ErrNotFound) {
+			if err := sc.DeleteSchedule(schedule.JobID); err != nil {
+				log.Printf("Error removing schedule of deleted job %s: %v", schedule.JobID, err)
+			}
+			e.wheel.Remove(schedule.JobID)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error loading job %s: %v", schedule.JobID, err)
+			continue
+		}
+
+		e.queue.Push(readyJob(schedule, stored))
+		e.claimed[schedule.JobID] = claim{schedule: schedule}
+	}
+}
+
+// readyJob pairs a due schedule with its job, the policy needs the job's deadline, tenant,
+// resource request and selectors
+func readyJob(schedule db.Schedule, stored db.Job) scheduler.ReadyJob {
+	job := &db.Job{
+		JobID:           schedule.JobID,
+		Priority:        schedule.Priority,
+		Payload:         schedule.Payload,
+		UserID:          stored.UserID,
+		DeadlineSeconds: stored.DeadlineSeconds,
+		CPUSlots:        stored.CPUSlots,
+		MemoryMB:        stored.MemoryMB,
+		NodeSelector:    stored.NodeSelector,
+		AntiAffinity:    stored.AntiAffinity,
+	}
+	return scheduler.NewReadyJob(job, schedule.NextRunTime)
+}
+
+// advance moves the schedule of a job about to be handed out to its next cron tick and releases its
+// lease. It happens before the hand-off, a fast failure must find the schedule already moved on or
+// the retry it records would be undone. Schedules of one-shots, jobs that used up MaxRuns or passed
+// FinishAt are removed and the job is marked completed. It reports whether the schedule is already
+// due again, an error means the job must not be handed out.
+func (e *Executor) advance(jobID string, dispatchedAt time.Time) (bool, error) {
+	c, ok := e.claimed[jobID]
+	if !ok || c.advanced {
+		return false, nil
+	}
+	sc, err := controller.CreateScheduleController("ScheduleOperationController", e.store)
+	if err != nil {
+		return false, err
+	}
+
+	job, err := e.store.GetJob(jobID)
+	if errors.Is(err, db.ErrNotFound) {
+		if err := sc.DeleteSchedule(jobID); err != nil {
+			log.Printf("Error removing schedule of deleted job %s: %v", jobID, err)
+		}
+		e.wheel.Remove(jobID)
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	next, ok, err := scheduler.Reschedule(job, c.schedule, dispatchedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate cron: %v", err)
+	}
+	dueAgain := false
+	if !ok {
+		// Mark the job finished before its schedule goes, the scheduler recreates the schedule of
+		// a job that has none and isn't completed
+		job.Status = db.JobStatusCompleted
+		if err := controller.NewJobOperationController(e.store).UpdateJob(&job); err != nil {
+			log.Printf("Error marking job %s completed: %v", job.JobID, err)
+		}
+		if err := sc.DeleteSchedule(job.JobID); err != nil {
+			return false, err
+		}
+		e.wheel.Remove(job.JobID)
+	} else {
+		// Only the run bookkeeping is written, a retry recorded meanwhile keeps its RetryCount
+		if err := sc.AdvanceSchedule(&next, e.Id); err != nil {
+			return false, err
+		}
+		// Short intervals come round again before the next load, track them right away
+		dueAgain = !e.wheel.Add(next.JobID, next.NextRunTime)
+	}
+
+	c.advanced = true
+	e.claimed[jobID] = c
+	return dueAgain, nil
+}
+
+// distributeJobs places queued jobs on workers in the order the policy plans them, interleaved between
+// tenants by their fair share. Each job goes to the available worker it fits best among those its
+// selectors allow, its resources are reserved there and its schedule advanced before the worker is
+// offered the job. A job that fits nowhere stays queued with the reason, so does one whose queue is
+// over its rate and one the worker didn't take within DispatchWait. Queued jobs age and are planned
+// again on the next tick. A job whose schedule was taken over by another executor is dropped. It
+// reports whether a schedule is already due again.
+func (e *Executor) distributeJobs(w *worker.WorkerPool) bool {
+	e.rateLimits.Observe()
+	if e.queue.Len() == 0 {
+		return false
+	}
+
+	workers, err := e.availableWorkers(w)
+	if err != nil {
+		log.Printf("Error loading workers: %v", err)
+		return false
+	}
+
+	dueAgain := false
+
+	ready := e.queue.Ready(time.Now())
+	e.fairShare.Observe(ready)
+	for _, slot := range e.fairShare.Order(e.policy.Plan(ready)) {
+		request := scheduler.RequestOf(slot.Job)
+		constraints, err := scheduler.ConstraintsOf(slot.Job)
+		if err != nil {
+			e.queue.SetReason(slot.Job, err.Error())
+			continue
+		}
+		target, reason := scheduler.BestFit(request, constraints, workers)
+		if target == nil {
+			e.queue.SetReason(slot.Job, reason)
+			continue
+		}
+		if !e.rateLimits.Take(slot.Queue) {
+			e.queue.SetReason(slot.Job, fmt.Sprintf("the %s queue is over its rate, next token in %v", slot.Queue, e.rateLimits.Delay(slot.Queue).Round(time.Millisecond)))
+			continue
 		}
 
-		e.PrioritizeJobs(jobs)
+		if err := e.store.ReserveWorker(target.WorkerID, request.CPUSlots, request.MemoryMB); err != nil {
+			if !errors.Is(err, db.ErrInsufficientCapacity) {
+				log.Printf("Error reserving worker %s for job %s: %v", target.WorkerID, slot.Job.JobID, err)
+			}
+			e.rateLimits.Return(slot.Queue)
+			// Our view of the worker is stale, leave it alone until it is loaded again next tick
+			target.Status = db.WorkerInactive
+			e.queue.SetReason(slot.Job, fmt.Sprintf("worker %s filled up before the job was placed", target.WorkerID))
+			continue
+		}
+
+		attempt := e.claimed[slot.Job.JobID].schedule.RetryCount
+		again, err := e.advance(slot.Job.JobID, time.Now())
+		if err != nil {
+			if err := e.store.ReleaseWorker(target.WorkerID, request.CPUSlots, request.MemoryMB); err != nil {
+				log.Printf("Error releasing worker %s: %v", target.WorkerID, err)
+			}
+			e.rateLimits.Return(slot.Queue)
+			if errors.Is(err, db.ErrLeaseLost) {
+				log.Printf("Dropping job %s, another executor took its schedule over", slot.Job.JobID)
+			} else if !errors.Is(err, db.ErrNotFound) {
+				log.Printf("Error advancing schedule %s, it is claimed again once its lease runs out: %v", slot.Job.JobID, err)
+			}
+			e.queue.Remove(slot.Job)
+			delete(e.claimed, slot.Job.JobID)
+			continue
+		}
+		dueAgain = dueAgain || again
 
-		slotLength := len(jobs) / 3
-		high := jobs[0:slotLength]
-		mid := jobs[slotLength : 2*slotLength]
-		low := jobs[2*slotLength:]
+		placement := worker.Placement{
+			JobID:    slot.Job.JobID,
+			Queue:    slot.Queue,
+			CPUSlots: request.CPUSlots,
+			MemoryMB: request.MemoryMB,
+			Attempt:  attempt,
+		}
+		if !w.Offer(target.WorkerID, placement, DispatchWait) {
+			if err := e.store.ReleaseWorker(target.WorkerID, request.CPUSlots, request.MemoryMB); err != nil {
+				log.Printf("Error releasing worker %s: %v", target.WorkerID, err)
+			}
+			e.rateLimits.Return(slot.Queue)
+			// It stopped waiting for work, leave it alone until the next tick
+			target.Status = db.WorkerInactive
+			e.queue.SetReason(slot.Job, fmt.Sprintf("worker %s did not take the job", target.WorkerID))
+			continue
+		}
+
+		target.CurrentLoad += request.CPUSlots
+		target.MemoryUsedMB += request.MemoryMB
+		e.queue.Remove(slot.Job)
+		delete(e.claimed, slot.Job.JobID)
+		e.fairShare.Dispatched(slot.Job)
+	}
+	return dueAgain
+}
 
-		e.distributeJobs(w, high, mid, low)
+// availableWorkers loads the workers of the pool that are waiting for a job
+func (e *Executor) availableWorkers(w *worker.WorkerPool) ([]db.Worker, error) {
+	all, err := e.store.GetAllWorkers()
+	if err != nil {
+		return nil, err
+	}
 
-		time.Sleep(ScheduleQueryFreq)
+	available := w.Available()
+	workers := make([]db.Worker, 0, len(available))
+	for _, candidate := range all {
+		if available[candidate.WorkerID] {
+			workers = append(workers, candidate)
+		}
 	}
+	return workers, nil
 }
 
-func (e *Executor) distributeJobs(w *worker.WorkerPool, high, mid, low []*db.Job) {
-	for _, job := range high {
-		w.HighChan <- job.JobID
+// ExplainPlacement checks a job against every known worker and says which could run it and why the
+// others can't. Workers that aren't waiting for a job are reported as busy.
+func (e *Executor) ExplainPlacement(w *worker.WorkerPool, job *db.Job) ([]scheduler.WorkerFit, error) {
+	constraints, err := scheduler.ConstraintsOf(job)
+	if err != nil {
+		return nil, err
 	}
-	for _, job := range mid {
-		w.MidChan <- job.JobID
+	all, err := e.store.GetAllWorkers()
+	if err != nil {
+		return nil, err
 	}
-	for _, job := range low {
-		w.LowChan <- job.JobID
+
+	fits := scheduler.Explain(scheduler.RequestOf(job), constraints, all)
+	available := w.Available()
+	for i := range fits {
+		if fits[i].Fits && fits[i].Reason == "" && !available[fits[i].WorkerID] {
+			fits[i].Reason = "not waiting for a job"
+		}
 	}
+	return fits, nil
 }
@@ -0,0 +1,335 @@
+package executor
+
+import (
+	"context"
+	"doit/internal/auth"
+	"doit/internal/db"
+	"doit/internal/rpc/workerpb"
+	"doit/internal/services/worker"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultGRPCAddr is where the WorkerService listens unless GRPC_ADDR says otherwise
+const DefaultGRPCAddr = ":9090"
+
+// WorkerService is the executor's side of the gRPC worker protocol. A worker's Ready is answered by
+// WorkerPool.Lease, as the HTTP agent endpoints are, and the executor places jobs on gRPC, HTTP and
+// in-process workers alike. Only remote workers go through a transport though, in-process workers
+// take their placements straight from their inbox in the pool and never use this service.
+// Inboxes live in this process, a remote worker only gets work while its Ready is open on the
+// executor that places jobs.
+type WorkerService struct {
+	workerpb.UnimplementedWorkerServiceServer
+	store db.Store
+	pool  *worker.WorkerPool
+
+	mu       sync.Mutex
+	sessions map[string]*workerSession
+}
+
+// workerSession is the Connect stream of one worker, sends from lease goroutines are serialised
+type workerSession struct {
+	mu     sync.Mutex
+	stream workerpb.WorkerService_ConnectServer
+}
+
+func (ws *workerSession) send(msg *workerpb.ExecutorMessage) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.stream.Send(msg)
+}
+
+func NewWorkerService(store db.Store, pool *worker.WorkerPool) *WorkerService {
+	s := &WorkerService{
+		store:    store,
+		pool:     pool,
+		sessions: make(map[string]*workerSession),
+	}
+	worker.OnCancel(s.forwardCancel)
+	return s
+}
+
+// serveGRPC runs the WorkerService until the listener fails
+func (e *Executor) serveGRPC(pool *worker.WorkerPool) {
+	addr := os.Getenv("GRPC_ADDR")
+	if addr == "" {
+		addr = DefaultGRPCAddr
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Error starting gRPC worker service: %v", err)
+		return
+	}
+
+	var opts []grpc.ServerOption
+	if e.authn != nil {
+		opts = append(opts,
+			grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				ctx, err := authenticateWorker(ctx, e.authn)
+				if err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				ctx, err := authenticateWorker(ss.Context(), e.authn)
+				if err != nil {
+					return err
+				}
+				return handler(srv, authenticatedStream{ServerStream: ss, ctx: ctx})
+			}),
+		)
+	} else {
+		log.Println("gRPC worker authentication is disabled, anyone who can reach the worker service can take jobs")
+	}
+
+	server := grpc.NewServer(opts...)
+	workerpb.RegisterWorkerServiceServer(server, NewWorkerService(e.store, pool))
+	log.Printf("gRPC worker service listening on %s", addr)
+	if err := server.Serve(lis); err != nil {
+		log.Printf("gRPC worker service stopped: %v", err)
+	}
+}
+
+// principalKey holds the auth.Principal of an authenticated call in its context
+type principalKey struct{}
+
+// authenticatedStream is a stream whose context carries the caller's principal
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticateWorker checks the agent or admin key a worker sends as x-api-key or authorization
+// metadata, the same credentials the HTTP agent endpoints take. The returned context carries who the
+// worker authenticated as.
+func authenticateWorker(ctx context.Context, a *auth.Authenticator) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	p, err := a.AuthenticateAgent(first("x-api-key"), first("authorization"))
+	switch {
+	case err == nil:
+		return context.WithValue(ctx, principalKey{}, p), nil
+	case errors.Is(err, auth.ErrNotAgent):
+		return ctx, status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, auth.ErrUnauthenticated):
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	}
+	log.Printf("Error authenticating worker: %v", err)
+	return ctx, status.Error(codes.Internal, "failed to authenticate")
+}
+
+// actAs returns PERMISSION_DENIED unless the caller registered workerID, admins may act as any worker
+// and everyone may when authentication is disabled
+func (s *WorkerService) actAs(ctx context.Context, workerID string) error {
+	p, ok := ctx.Value(principalKey{}).(auth.Principal)
+	if !ok || p.Admin {
+		return nil
+	}
+	err := worker.CheckOwner(s.store, workerID, p.KeyID)
+	if errors.Is(err, worker.ErrWorkerOwned) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return rpcError(err)
+}
+
+// rpcError maps worker errors to status codes, NOT_FOUND tells the worker to register again
+func rpcError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, worker.ErrWorkerInactive), errors.Is(err, db.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, worker.ErrStaleExecution):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *WorkerService) Register(ctx context.Context, req *workerpb.RegisterRequest) (*workerpb.RegisterResponse, error) {
+	ip := req.IpAddress
+	if p, ok := peer.FromContext(ctx); ok && ip == "" {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			ip = host
+		}
+	}
+
+	if err := s.actAs(ctx, req.WorkerId); err != nil {
+		return nil, err
+	}
+	keyID := ""
+	if p, ok := ctx.Value(principalKey{}).(auth.Principal); ok {
+		keyID = p.KeyID
+	}
+
+	registered, err := s.pool.Registry().RegisterRemote(db.Worker{
+		WorkerID:  req.WorkerId,
+		IPAddress: ip,
+		Capacity:  int(req.Capacity),
+		MemoryMB:  int(req.MemoryMb),
+		Labels:    req.Labels,
+		KeyID:     keyID,
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return &workerpb.RegisterResponse{
+		WorkerId:                 registered.WorkerID,
+		HeartbeatIntervalSeconds: s.pool.Registry().Interval().Seconds(),
+	}, nil
+}
+
+func (s *WorkerService) Heartbeat(ctx context.Context, req *workerpb.HeartbeatRequest) (*workerpb.HeartbeatResponse, error) {
+	if err := s.actAs(ctx, req.WorkerId); err != nil {
+		return nil, err
+	}
+	status, err := s.pool.Registry().RemoteHeartbeat(req.WorkerId)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &workerpb.HeartbeatResponse{Status: status}, nil
+}
+
+func (s *WorkerService) Connect(stream workerpb.WorkerService_ConnectServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello := first.GetHello()
+	if hello == nil {
+		return status.Error(codes.InvalidArgument, "the first message must be a Hello")
+	}
+	workerID := hello.WorkerId
+	if err := s.actAs(stream.Context(), workerID); err != nil {
+		return err
+	}
+
+	registered, err := s.store.GetWorker(workerID)
+	if err != nil {
+		return rpcError(err)
+	}
+	if registered.Status == db.WorkerInactive {
+		return rpcError(worker.ErrWorkerInactive)
+	}
+
+	session := &workerSession{stream: stream}
+	s.mu.Lock()
+	s.sessions[workerID] = session
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.sessions[workerID] == session {
+			delete(s.sessions, workerID)
+		}
+		s.mu.Unlock()
+	}()
+
+	// Lease goroutines stop waiting for work once the stream is gone
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+
+		switch m := msg.Message.(type) {
+		case *workerpb.WorkerMessage_Ready:
+			go s.answerReady(ctx, session, workerID)
+		case *workerpb.WorkerMessage_Log:
+			if _, err := worker.AppendOutput(s.store, workerID, m.Log.ProcessId, m.Log.Stdout, m.Log.Stderr); err != nil {
+				log.Printf("Error storing output of execution %s: %v", m.Log.ProcessId, err)
+			}
+		}
+	}
+}
+
+// answerReady leases one job for the worker and sends it. A job that can't be delivered because the
+// stream broke is failed right away so it is retried instead of staying assigned to the worker.
+func (s *WorkerService) answerReady(ctx context.Context, session *workerSession, workerID string) {
+	for ctx.Err() == nil {
+		assignment, err := s.pool.Lease(ctx, workerID, worker.MaxLeaseWait)
+		if err != nil {
+			log.Printf("Error leasing a job to worker %s: %v", workerID, err)
+			return
+		}
+		if assignment == nil {
+			continue
+		}
+
+		msg := &workerpb.ExecutorMessage{Message: &workerpb.ExecutorMessage_Assignment{Assignment: &workerpb.Assignment{
+			ProcessId:      assignment.Execution.ProcessID,
+			JobId:          assignment.Execution.JobID,
+			ScriptName:     assignment.ScriptName,
+			Script:         assignment.Script,
+			TimeoutSeconds: int32(assignment.TimeoutSeconds),
+		}}}
+		if err := session.send(msg); err != nil {
+			report := worker.ExecutionReport{
+				Status:   db.JobStatusFailed,
+				ExitCode: -1,
+				Error:    fmt.Sprintf("could not be delivered to worker %s: %v", workerID, err),
+			}
+			if err := worker.CompleteExecution(s.store, workerID, assignment.Execution.ProcessID, report); err != nil {
+				log.Printf("Error failing undelivered execution %s: %v", assignment.Execution.ProcessID, err)
+			}
+		}
+		return
+	}
+}
+
+func (s *WorkerService) ReportResult(ctx context.Context, req *workerpb.ExecutionResult) (*workerpb.ReportResultResponse, error) {
+	if err := s.actAs(ctx, req.WorkerId); err != nil {
+		return nil, err
+	}
+	report := worker.ExecutionReport{
+		Status:   req.Status,
+		ExitCode: int(req.ExitCode),
+		Stdout:   req.Stdout,
+		Stderr:   req.Stderr,
+		Error:    req.Error,
+	}
+	if err := worker.CompleteExecution(s.store, req.WorkerId, req.ProcessId, report); err != nil {
+		return nil, rpcError(err)
+	}
+	return &workerpb.ReportResultResponse{}, nil
+}
+
+// forwardCancel pushes a cancellation to the connected worker running the execution
+func (s *WorkerService) forwardCancel(je db.JobExecution) {
+	s.mu.Lock()
+	session, ok := s.sessions[je.WorkerID]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	msg := &workerpb.ExecutorMessage{Message: &workerpb.ExecutorMessage_Cancel{Cancel: &workerpb.Cancel{ProcessId: je.ProcessID}}}
+	if err := session.send(msg); err != nil {
+		log.Printf("Error sending cancellation of execution %s to worker %s: %v", je.ProcessID, je.WorkerID, err)
+	}
+}
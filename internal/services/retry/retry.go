@@ -0,0 +1,145 @@
+package retry
+
+import (
+	"doit/internal/api/middlewares"
+	"doit/internal/controller"
+	"doit/internal/db"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Defaults for jobs that leave BackoffBaseSeconds or BackoffMaxSeconds unset
+const DefaultBackoffBase = 10 * time.Second
+const DefaultBackoffMax = 10 * time.Minute
+
+// Engine re-enqueues failed and timed out executions until the job's MaxRetries is used up
+type Engine struct {
+	store db.Store
+}
+
+func NewEngine(store db.Store) *Engine {
+	return &Engine{store: store}
+}
+
+// Backoff is the delay before retry number attempt (starting at 1) of job
+func Backoff(job db.Job, attempt int) time.Duration {
+	base := DefaultBackoffBase
+	if job.BackoffBaseSeconds > 0 {
+		base = time.Duration(job.BackoffBaseSeconds) * time.Second
+	}
+	max := DefaultBackoffMax
+	if job.BackoffMaxSeconds > 0 {
+		max = time.Duration(job.BackoffMaxSeconds) * time.Second
+	}
+	return middlewares.BackoffDelay(job.BackoffStrategy, attempt, base, max)
+}
+
+// HandleResult is called once an execution has finished. Successful runs reset the retry
+// budget, failed and timed out runs are scheduled again after the job's backoff.
+func (e *Engine) HandleResult(je db.JobExecution) error {
+	switch je.Status {
+	case db.JobStatusCompleted:
+		return e.resetRetries(je.JobID)
+	case db.JobStatusFailed, db.JobStatusTimedOut:
+	default:
+		return nil
+	}
+
+	job, err := e.store.GetJob(je.JobID)
+	if err != nil {
+		return fmt.Errorf("failed to load job %s for retry: %v", je.JobID, err)
+	}
+
+	// One-shots and jobs on their last run have no schedule left, a retry brings it back. Their
+	// schedule went on dispatch, the execution's Attempt is how many retries they have had.
+	schedule, err := e.store.GetSchedule(job.JobID)
+	exists := err == nil
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("failed to load schedule %s for retry: %v", job.JobID, err)
+	}
+	if !exists {
+		schedule = db.Schedule{
+			JobID:         job.JobID,
+			Priority:      job.Priority,
+			Payload:       job.Payload,
+			MaxRetries:    job.MaxRetries,
+			MisfirePolicy: job.MisfirePolicy,
+			RetryCount:    je.Attempt,
+		}
+	}
+
+	if schedule.RetryCount >= job.MaxRetries {
+		return e.deadLetter(job, je, exists)
+	}
+
+	schedule.RetryCount++
+	retryAt := time.Now().Add(Backoff(job, schedule.RetryCount))
+
+	sc, err := controller.CreateScheduleController("ScheduleOperationController", e.store)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		schedule.NextRunTime = retryAt
+		schedule.Retrying = true
+		if err := sc.CreateSchedule(&schedule); err != nil {
+			return fmt.Errorf("failed to schedule retry of job %s: %v", job.JobID, err)
+		}
+		log.Printf("Job %s %s, retry %d/%d at %v", job.JobID, je.Status, schedule.RetryCount, job.MaxRetries, retryAt)
+		return nil
+	}
+
+	// Only the retry columns are written, an executor advancing the schedule under its lease keeps its
+	// changes. A regular tick that comes sooner doubles as the retry, so does one being dispatched.
+	scheduled, err := sc.RetrySchedule(job.JobID, schedule.RetryCount, retryAt)
+	if err != nil {
+		return fmt.Errorf("failed to schedule retry of job %s: %v", job.JobID, err)
+	}
+	if !scheduled {
+		log.Printf("Job %s %s, retry %d/%d rides on the run being dispatched", job.JobID, je.Status, schedule.RetryCount, job.MaxRetries)
+		return nil
+	}
+
+	log.Printf("Job %s %s, retry %d/%d at %v", job.JobID, je.Status, schedule.RetryCount, job.MaxRetries, retryAt)
+	return nil
+}
+
+// deadLetter parks a job that used up its retries for triage, the next regular run starts with a fresh budget
+func (e *Engine) deadLetter(job db.Job, je db.JobExecution, scheduled bool) error {
+	dc, err := controller.NewDeadLetterController("DeadLetterOperationController", e.store)
+	if err != nil {
+		return err
+	}
+	deadLetter, err := dc.DeadLetterJob(&job, &je)
+	if err != nil {
+		return err
+	}
+	log.Printf("Job %s exhausted its %d retries and was dead-lettered as %s, last error: %s", job.JobID, job.MaxRetries, deadLetter.DeadLetterID, je.Error)
+
+	if scheduled {
+		return e.resetRetries(job.JobID)
+	}
+	return nil
+}
+
+func (e *Engine) resetRetries(jobID string) error {
+	schedule, err := e.store.GetSchedule(jobID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if schedule.RetryCount == 0 {
+		return nil
+	}
+
+	sc, err := controller.CreateScheduleController("ScheduleOperationController", e.store)
+	if err != nil {
+		return err
+	}
+	_, err = sc.RetrySchedule(jobID, 0, time.Time{})
+	return err
+}
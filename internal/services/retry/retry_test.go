@@ -0,0 +1,69 @@
+package retry
+
+import (
+	"doit/internal/db"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// failRun records a failed run of the job at the schedule's retry count and deletes the schedule, as
+// dispatching the last run of a job does
+func failRun(t *testing.T, store db.Store, engine *Engine, jobID string, run int) {
+	t.Helper()
+	attempt := 0
+	if schedule, err := store.GetSchedule(jobID); err == nil {
+		attempt = schedule.RetryCount
+		if err := store.DeleteSchedule(jobID); err != nil {
+			t.Fatalf("deleting schedule: %v", err)
+		}
+	}
+
+	je := db.JobExecution{
+		ProcessID: fmt.Sprintf("run-%d", run),
+		JobID:     jobID,
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		Status:    db.JobStatusFailed,
+		Error:     "exit status 1",
+		Attempt:   attempt,
+	}
+	if err := store.CreateJobExecution(&je); err != nil {
+		t.Fatalf("creating execution: %v", err)
+	}
+	if err := engine.HandleResult(je); err != nil {
+		t.Fatalf("handling run %d: %v", run, err)
+	}
+}
+
+func TestOneShotIsDeadLetteredAfterMaxRetries(t *testing.T) {
+	store := db.NewMemoryStore()
+	engine := NewEngine(store)
+	job := db.Job{JobID: "c0ffee", Kind: db.JobKindOnce, MaxRetries: 2, BackoffStrategy: db.BackoffFixed, BackoffBaseSeconds: 1}
+	if err := store.CreateJob(job); err != nil {
+		t.Fatalf("creating job: %v", err)
+	}
+
+	for run := 1; run <= 2; run++ {
+		failRun(t, store, engine, job.JobID, run)
+		schedule, err := store.GetSchedule(job.JobID)
+		if err != nil {
+			t.Fatalf("run %d failed without a retry scheduled: %v", run, err)
+		}
+		if schedule.RetryCount != run || !schedule.Retrying {
+			t.Fatalf("after run %d the schedule is at retry %d, retrying %v, want retry %d", run, schedule.RetryCount, schedule.Retrying, run)
+		}
+	}
+
+	failRun(t, store, engine, job.JobID, 3)
+	if _, err := store.GetSchedule(job.JobID); err == nil {
+		t.Fatalf("the third failure scheduled another retry, MaxRetries is 2")
+	}
+	deadLetters, err := store.GetAllDeadLetters(10, 0)
+	if err != nil {
+		t.Fatalf("loading dead letters: %v", err)
+	}
+	if len(deadLetters) != 1 || deadLetters[0].JobID != job.JobID || deadLetters[0].Attempts != 3 {
+		t.Fatalf("dead letters %+v, want one for %s with 3 attempts", deadLetters, job.JobID)
+	}
+}
@@ -0,0 +1,269 @@
+package scheduler
+
+import (
+	"doit/internal/db"
+	"doit/internal/metrics"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultTenant owns jobs without a UserID, tenants without a configured weight get DefaultTenantWeight
+const DefaultTenant = "default"
+const DefaultTenantWeight = 1
+
+// OtherTenants labels the metrics of tenants without a configured weight, a series per user would
+// grow with every user that ever ran a job
+const OtherTenants = "other"
+
+// TenantOf returns the tenant a job is accounted to
+func TenantOf(job *db.Job) string {
+	if job.UserID == "" {
+		return DefaultTenant
+	}
+	return job.UserID
+}
+
+// TenantShare reports how much of the dispatched work a tenant received
+type TenantShare struct {
+	Tenant     string  `json:"tenant"`
+	Weight     int     `json:"weight"`
+	Queued     int     `json:"queued"`
+	Dispatched int64   `json:"dispatched"`
+	Share      float64 `json:"share"`
+}
+
+// FairShare interleaves the jobs of different tenants by weight with start-time fair queuing. A tenant's
+// next job starts where its previous one finished, every dispatch moves that on by 1/weight, and the
+// tenant with the earliest start goes next. A tenant that was idle restarts at the current virtual
+// time, it can't bank credit.
+type FairShare struct {
+	mu         sync.Mutex
+	weights    map[string]int
+	finish     map[string]float64
+	vtime      float64
+	dispatched map[string]int64
+	queued     map[string]int
+	// labels are the tenant labels the queued, share and dispatched metrics have series for
+	labels map[string]bool
+}
+
+func NewFairShare(weights map[string]int) *FairShare {
+	fs := &FairShare{
+		weights:    make(map[string]int),
+		finish:     make(map[string]float64),
+		dispatched: make(map[string]int64),
+		queued:     make(map[string]int),
+		labels:     make(map[string]bool),
+	}
+	for tenant, weight := range weights {
+		fs.weights[tenant] = weight
+		metrics.TenantWeight.WithLabelValues(tenant).Set(float64(weight))
+	}
+	return fs
+}
+
+// LoadTenantWeights parses TENANT_WEIGHTS, a comma separated list of tenant=weight
+func LoadTenantWeights() (map[string]int, error) {
+	weights := make(map[string]int)
+	value := os.Getenv("TENANT_WEIGHTS")
+	if value == "" {
+		return weights, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		tenant, weight, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid TENANT_WEIGHTS entry: %q", pair)
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("invalid weight for tenant %s: %q", tenant, weight)
+		}
+		weights[strings.TrimSpace(tenant)] = w
+	}
+	return weights, nil
+}
+
+func (fs *FairShare) weight(tenant string) int {
+	if w, ok := fs.weights[tenant]; ok {
+		return w
+	}
+	return DefaultTenantWeight
+}
+
+// label is the metric label of a tenant, only DefaultTenant and tenants with a weight have their own
+func (fs *FairShare) label(tenant string) string {
+	if _, ok := fs.weights[tenant]; ok || tenant == DefaultTenant {
+		return tenant
+	}
+	return OtherTenants
+}
+
+// publish sets the queued and share metrics by label and drops the series of labels nothing is
+// counted under anymore, like a tenant whose weight was reset
+func (fs *FairShare) publish() {
+	queued := make(map[string]int)
+	dispatched := make(map[string]int64)
+	total := int64(0)
+	for tenant, n := range fs.queued {
+		queued[fs.label(tenant)] += n
+	}
+	for tenant, n := range fs.dispatched {
+		dispatched[fs.label(tenant)] += n
+		total += n
+	}
+
+	for label := range fs.labels {
+		_, isQueued := queued[label]
+		_, isDispatched := dispatched[label]
+		if !isQueued && !isDispatched {
+			metrics.TenantQueued.DeleteLabelValues(label)
+			metrics.TenantShare.DeleteLabelValues(label)
+			metrics.TenantDispatched.DeleteLabelValues(label)
+			delete(fs.labels, label)
+		}
+	}
+	for label, n := range queued {
+		fs.labels[label] = true
+		metrics.TenantQueued.WithLabelValues(label).Set(float64(n))
+	}
+	for label, n := range dispatched {
+		fs.labels[label] = true
+		metrics.TenantQueued.WithLabelValues(label).Set(float64(queued[label]))
+		metrics.TenantShare.WithLabelValues(label).Set(float64(n) / float64(total))
+	}
+}
+
+// SetWeight changes a tenant's weight, it applies from the tenant's next dispatch
+func (fs *FairShare) SetWeight(tenant string, weight int) error {
+	if weight < 1 {
+		return fmt.Errorf("weight must be at least 1, got %d", weight)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.weights[tenant] = weight
+	metrics.TenantWeight.WithLabelValues(tenant).Set(float64(weight))
+	fs.publish()
+	return nil
+}
+
+// ResetWeight puts a tenant back on DefaultTenantWeight, its metrics are counted under OtherTenants again
+func (fs *FairShare) ResetWeight(tenant string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.weights, tenant)
+	metrics.TenantWeight.DeleteLabelValues(tenant)
+	fs.publish()
+}
+
+// Order interleaves the tenants' slots by weight, each tenant's own slots keep the policy's order
+func (fs *FairShare) Order(slots []Slot) []Slot {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	pending := make(map[string][]Slot)
+	tenants := []string{}
+	for _, slot := range slots {
+		tenant := TenantOf(slot.Job)
+		if _, ok := pending[tenant]; !ok {
+			tenants = append(tenants, tenant)
+		}
+		pending[tenant] = append(pending[tenant], slot)
+	}
+	sort.Strings(tenants)
+
+	finish := make(map[string]float64, len(tenants))
+	for _, tenant := range tenants {
+		finish[tenant] = fs.finish[tenant]
+	}
+	vtime := fs.vtime
+
+	ordered := make([]Slot, 0, len(slots))
+	for len(ordered) < len(slots) {
+		next, nextStart, nextTag := "", 0.0, 0.0
+		for _, tenant := range tenants {
+			if len(pending[tenant]) == 0 {
+				continue
+			}
+			start := max(finish[tenant], vtime)
+			tag := start + 1/float64(fs.weight(tenant))
+			if next == "" || start < nextStart || (start == nextStart && tag < nextTag) {
+				next, nextStart, nextTag = tenant, start, tag
+			}
+		}
+		ordered = append(ordered, pending[next][0])
+		pending[next] = pending[next][1:]
+		finish[next] = nextTag
+		vtime = nextStart
+	}
+	return ordered
+}
+
+// Dispatched charges a dispatched job to its tenant
+func (fs *FairShare) Dispatched(job *db.Job) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	tenant := TenantOf(job)
+	start := max(fs.finish[tenant], fs.vtime)
+	fs.finish[tenant] = start + 1/float64(fs.weight(tenant))
+	fs.vtime = start
+	fs.dispatched[tenant]++
+	if fs.queued[tenant] > 0 {
+		fs.queued[tenant]--
+	}
+
+	metrics.TenantDispatched.WithLabelValues(fs.label(tenant)).Inc()
+	fs.publish()
+}
+
+// Observe records how many jobs of each tenant are waiting
+func (fs *FairShare) Observe(ready []ReadyJob) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Tenants with nothing waiting are forgotten, the map doesn't keep every tenant ever queued
+	fs.queued = make(map[string]int)
+	for _, r := range ready {
+		fs.queued[TenantOf(r.Job)]++
+	}
+	fs.publish()
+}
+
+// Shares lists every tenant that has a weight, queued jobs or dispatched jobs
+func (fs *FairShare) Shares() []TenantShare {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for tenant := range fs.weights {
+		seen[tenant] = true
+	}
+	for tenant := range fs.queued {
+		seen[tenant] = true
+	}
+	total := int64(0)
+	for tenant, n := range fs.dispatched {
+		seen[tenant] = true
+		total += n
+	}
+
+	shares := make([]TenantShare, 0, len(seen))
+	for tenant := range seen {
+		share := TenantShare{
+			Tenant:     tenant,
+			Weight:     fs.weight(tenant),
+			Queued:     fs.queued[tenant],
+			Dispatched: fs.dispatched[tenant],
+		}
+		if total > 0 {
+			share.Share = float64(share.Dispatched) / float64(total)
+		}
+		shares = append(shares, share)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Tenant < shares[j].Tenant })
+	return shares
+}
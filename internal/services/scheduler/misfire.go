@@ -0,0 +1,96 @@
+package scheduler
+
+import (
+	"doit/internal/db"
+	"doit/pkg/utils"
+	"time"
+)
+
+// MisfireThreshold is how late a NextRunTime may be before it counts as a missed run
+// rather than ordinary polling delay.
+const MisfireThreshold = 2 * time.Minute
+
+// DefaultCatchUpLimit bounds catch_up replays for jobs that don't set CatchUpLimit
+const DefaultCatchUpLimit = 10
+
+// ApplyMisfirePolicy rewrites a schedule whose NextRunTime fell behind during downtime.
+// It returns true when the schedule was changed and needs to be persisted.
+func ApplyMisfirePolicy(job db.Job, schedule db.Schedule, now time.Time) (db.Schedule, bool, error) {
+	// A schedule that is already replaying missed ticks is deliberately in the past,
+	// and a one-shot has a single run to give so it always fires however late
+	if job.IsOneShot() || schedule.MissedRuns > 0 || now.Sub(schedule.NextRunTime) < MisfireThreshold {
+		return schedule, false, nil
+	}
+
+	switch schedule.MisfirePolicy {
+	case db.MisfireSkip:
+		next, err := utils.NextCronTimeIn(job.CronExpr, job.TimeZone, now)
+		if err != nil {
+			return schedule, false, err
+		}
+		schedule.NextRunTime = next
+		return schedule, true, nil
+
+	case db.MisfireCatchUp:
+		limit := job.CatchUpLimit
+		if limit <= 0 {
+			limit = DefaultCatchUpLimit
+		}
+
+		missed, err := recentTicks(job, schedule.NextRunTime, now, limit)
+		if err != nil {
+			return schedule, false, err
+		}
+
+		schedule.NextRunTime = missed[0]
+		schedule.MissedRuns = len(missed) - 1
+		return schedule, true, nil
+
+	default:
+		// run_once: leave the schedule due so it fires a single time, Reschedule then jumps past now
+		return schedule, false, nil
+	}
+}
+
+// recentTicks returns the last limit ticks of job from the tick at from up to now. Rather than walking
+// every tick since from, which is tens of thousands for a seconds-level job after a long outage, it
+// walks back a window sized from the job's interval and only widens it while it holds fewer than
+// limit ticks.
+func recentTicks(job db.Job, from time.Time, now time.Time, limit int) ([]time.Time, error) {
+	next, err := utils.NextCronTimeIn(job.CronExpr, job.TimeZone, from)
+	if err != nil {
+		return nil, err
+	}
+	interval := next.Sub(from)
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	for window := time.Duration(limit+1) * interval; ; window *= 2 {
+		start := now.Add(-window)
+		var ticks []time.Time
+		if !start.After(from) {
+			start = from
+			ticks = []time.Time{from}
+		}
+
+		for tick := start; ; {
+			next, err := utils.NextCronTimeIn(job.CronExpr, job.TimeZone, tick)
+			if err != nil {
+				return nil, err
+			}
+			if next.After(now) {
+				break
+			}
+			ticks = append(ticks, next)
+			if len(ticks) > limit {
+				ticks = ticks[1:]
+			}
+			tick = next
+		}
+
+		if len(ticks) >= limit || start.Equal(from) {
+			return ticks, nil
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package scheduler
+
+import (
+	"doit/internal/db"
+	"fmt"
+)
+
+// Resources is what a run reserves on its worker
+type Resources struct {
+	CPUSlots int `json:"cpu_slots"`
+	MemoryMB int `json:"memory_mb"`
+}
+
+// RequestOf returns the resources a run of job needs, every run takes at least one CPU slot
+func RequestOf(job *db.Job) Resources {
+	request := Resources{CPUSlots: job.CPUSlots, MemoryMB: job.MemoryMB}
+	if request.CPUSlots < 1 {
+		request.CPUSlots = 1
+	}
+	return request
+}
+
+// fits reports whether request fits in what worker has left, or in all of it when total is set
+func fits(request Resources, worker db.Worker, total bool) bool {
+	cpu, memory := worker.Capacity-worker.CurrentLoad, worker.MemoryMB-worker.MemoryUsedMB
+	if total {
+		cpu, memory = worker.Capacity, worker.MemoryMB
+	}
+	if request.CPUSlots > cpu {
+		return false
+	}
+	return worker.MemoryMB == 0 || request.MemoryMB <= memory
+}
+
+// BestFit picks the active worker allowed by constraints that the request leaves the least room on, so
+// large jobs still find an empty worker later. Workers that don't track memory count as having none
+// left over. When no worker fits it returns nil and the reason the job has to wait.
+func BestFit(request Resources, constraints Constraints, workers []db.Worker) (*db.Worker, string) {
+	var best *db.Worker
+	bestCPU, bestMemory := 0, 0
+	active, allowed, everFits := 0, 0, false
+
+	for i := range workers {
+		worker := &workers[i]
+		if worker.Status != db.WorkerActive {
+			continue
+		}
+		active++
+		if ok, _ := constraints.Allows(worker.Labels); !ok {
+			continue
+		}
+		allowed++
+		if fits(request, *worker, true) {
+			everFits = true
+		}
+		if !fits(request, *worker, false) {
+			continue
+		}
+
+		leftCPU := worker.Capacity - worker.CurrentLoad - request.CPUSlots
+		leftMemory := 0
+		if worker.MemoryMB > 0 {
+			leftMemory = worker.MemoryMB - worker.MemoryUsedMB - request.MemoryMB
+		}
+		if best == nil || leftCPU < bestCPU || (leftCPU == bestCPU && leftMemory < bestMemory) {
+			best, bestCPU, bestMemory = worker, leftCPU, leftMemory
+		}
+	}
+
+	switch {
+	case best != nil:
+		return best, ""
+	case active == 0:
+		return nil, "no worker is available"
+	case allowed == 0:
+		return nil, fmt.Sprintf("no available worker matches %s", constraints)
+	case !everFits:
+		return nil, fmt.Sprintf("needs %d cpu slots and %d MB, more than any matching worker has", request.CPUSlots, request.MemoryMB)
+	}
+	return nil, fmt.Sprintf("waiting for a matching worker with %d free cpu slots and %d MB", request.CPUSlots, request.MemoryMB)
+}
+
+// WorkerFit says whether a job can be placed on a worker and why not
+type WorkerFit struct {
+	WorkerID string            `json:"worker_id"`
+	Labels   map[string]string `json:"labels"`
+	Fits     bool              `json:"fits"`
+	Reason   string            `json:"reason,omitempty"`
+}
+
+// Explain checks a job against every worker, it backs the API's answer to why a job is unschedulable
+func Explain(request Resources, constraints Constraints, workers []db.Worker) []WorkerFit {
+	fitsOn := make([]WorkerFit, 0, len(workers))
+	for _, worker := range workers {
+		fit := WorkerFit{WorkerID: worker.WorkerID, Labels: worker.Labels}
+		ok, reason := constraints.Allows(worker.Labels)
+		switch {
+		case worker.Status != db.WorkerActive:
+			fit.Reason = fmt.Sprintf("worker is %s", worker.Status)
+		case !ok:
+			fit.Reason = reason
+		case !fits(request, worker, true):
+			fit.Reason = fmt.Sprintf("has %d cpu slots and %d MB, the job needs %d and %d", worker.Capacity, worker.MemoryMB, request.CPUSlots, request.MemoryMB)
+		case !fits(request, worker, false):
+			fit.Fits = true
+			fit.Reason = fmt.Sprintf("busy, %d of %d cpu slots and %d of %d MB in use", worker.CurrentLoad, worker.Capacity, worker.MemoryUsedMB, worker.MemoryMB)
+		default:
+			fit.Fits = true
+		}
+		fitsOn = append(fitsOn, fit)
+	}
+	return fitsOn
+}
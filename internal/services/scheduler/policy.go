@@ -0,0 +1,213 @@
+package scheduler
+
+import (
+	"doit/internal/db"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scheduling policies, SCHEDULING_POLICY picks one (empty means strict_priority)
+const (
+	PolicyStrictPriority   = "strict_priority"
+	PolicyWeightedFair     = "wfq"
+	PolicyEarliestDeadline = "edf"
+)
+
+// Queue is one of the worker pool's queues, each is rate limited by its own token bucket
+type Queue int
+
+const (
+	QueueHigh Queue = iota
+	QueueMid
+	QueueLow
+)
+
+func (q Queue) String() string {
+	switch q {
+	case QueueHigh:
+		return "high"
+	case QueueMid:
+		return "mid"
+	}
+	return "low"
+}
+
+// Jobs with a Priority of at least HighPriority go to the high queue, at least MidPriority to the mid queue
+const HighPriority = 7
+const MidPriority = 4
+
+// DefaultWFQWeights are the shares of the high, mid and low queue, SCHEDULING_WFQ_WEIGHTS overrides them
+var DefaultWFQWeights = [3]int{4, 2, 1}
+
+// QueueFor returns the queue a priority belongs to
+func QueueFor(priority int) Queue {
+	switch {
+	case priority >= HighPriority:
+		return QueueHigh
+	case priority >= MidPriority:
+		return QueueMid
+	}
+	return QueueLow
+}
+
+// ReadyJob is a job whose schedule is due, Deadline is zero when the job has none.
+// Policies order and place jobs by EffectivePriority, which ages above Job.Priority while the job waits.
+type ReadyJob struct {
+	Job               *db.Job
+	DueAt             time.Time
+	Deadline          time.Time
+	EffectivePriority int
+}
+
+// NewReadyJob builds the ReadyJob for a run of job due at dueAt
+func NewReadyJob(job *db.Job, dueAt time.Time) ReadyJob {
+	ready := ReadyJob{Job: job, DueAt: dueAt, EffectivePriority: job.Priority}
+	if job.DeadlineSeconds > 0 {
+		ready.Deadline = dueAt.Add(time.Duration(job.DeadlineSeconds) * time.Second)
+	}
+	return ready
+}
+
+// Slot places a job on a queue, a plan's slots are dispatched in order
+type Slot struct {
+	Job   *db.Job
+	Queue Queue
+}
+
+// SchedulingPolicy decides the queue of every ready job and the order they are dispatched in
+type SchedulingPolicy interface {
+	Name() string
+	Plan(ready []ReadyJob) []Slot
+}
+
+// NewSchedulingPolicy returns the policy called name, weights only matter to wfq
+func NewSchedulingPolicy(name string, weights [3]int) (SchedulingPolicy, error) {
+	switch name {
+	case "", PolicyStrictPriority:
+		return StrictPriority{}, nil
+	case PolicyWeightedFair:
+		for _, w := range weights {
+			if w <= 0 {
+				return nil, fmt.Errorf("wfq weights must be positive, got %v", weights)
+			}
+		}
+		return WeightedFair{Weights: weights}, nil
+	case PolicyEarliestDeadline:
+		return EarliestDeadline{}, nil
+	}
+	return nil, fmt.Errorf("unknown scheduling policy: %s", name)
+}
+
+// LoadSchedulingPolicy builds the policy configured by SCHEDULING_POLICY and SCHEDULING_WFQ_WEIGHTS
+func LoadSchedulingPolicy() (SchedulingPolicy, error) {
+	weights := DefaultWFQWeights
+	if value := os.Getenv("SCHEDULING_WFQ_WEIGHTS"); value != "" {
+		parts := strings.Split(value, ",")
+		if len(parts) != len(weights) {
+			return nil, fmt.Errorf("SCHEDULING_WFQ_WEIGHTS needs a high, mid and low weight, got %q", value)
+		}
+		for i, part := range parts {
+			w, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				return nil, fmt.Errorf("invalid SCHEDULING_WFQ_WEIGHTS: %v", err)
+			}
+			weights[i] = w
+		}
+	}
+	return NewSchedulingPolicy(os.Getenv("SCHEDULING_POLICY"), weights)
+}
+
+// byPriority orders higher priorities first, then the longest waiting, then by JobID so plans are stable
+func byPriority(a, b ReadyJob) bool {
+	if a.EffectivePriority != b.EffectivePriority {
+		return a.EffectivePriority > b.EffectivePriority
+	}
+	if !a.DueAt.Equal(b.DueAt) {
+		return a.DueAt.Before(b.DueAt)
+	}
+	return a.Job.JobID < b.Job.JobID
+}
+
+func sortedBy(ready []ReadyJob, less func(a, b ReadyJob) bool) []ReadyJob {
+	sorted := append([]ReadyJob(nil), ready...)
+	sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+	return sorted
+}
+
+// StrictPriority dispatches higher priorities first, a low priority job only goes once nothing above it is ready
+type StrictPriority struct{}
+
+func (StrictPriority) Name() string { return PolicyStrictPriority }
+
+func (StrictPriority) Plan(ready []ReadyJob) []Slot {
+	slots := make([]Slot, 0, len(ready))
+	for _, r := range sortedBy(ready, byPriority) {
+		slots = append(slots, Slot{Job: r.Job, Queue: QueueFor(r.EffectivePriority)})
+	}
+	return slots
+}
+
+// WeightedFair interleaves the queues in proportion to their weights so a burst of high priority
+// jobs can't starve the lower queues. Every job of a queue advances that queue's virtual finish
+// time by 1/weight and slots go out in order of finish time, higher queues win ties.
+type WeightedFair struct {
+	Weights [3]int
+}
+
+func (WeightedFair) Name() string { return PolicyWeightedFair }
+
+func (p WeightedFair) Plan(ready []ReadyJob) []Slot {
+	type tagged struct {
+		slot   Slot
+		finish float64
+	}
+
+	var finish [3]float64
+	all := make([]tagged, 0, len(ready))
+	for _, r := range sortedBy(ready, byPriority) {
+		q := QueueFor(r.EffectivePriority)
+		finish[q] += 1 / float64(p.Weights[q])
+		all = append(all, tagged{slot: Slot{Job: r.Job, Queue: q}, finish: finish[q]})
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].finish != all[j].finish {
+			return all[i].finish < all[j].finish
+		}
+		return all[i].slot.Queue < all[j].slot.Queue
+	})
+
+	slots := make([]Slot, 0, len(all))
+	for _, t := range all {
+		slots = append(slots, t.slot)
+	}
+	return slots
+}
+
+// EarliestDeadline dispatches the job whose deadline comes first, jobs without a deadline follow
+// in priority order
+type EarliestDeadline struct{}
+
+func (EarliestDeadline) Name() string { return PolicyEarliestDeadline }
+
+func (EarliestDeadline) Plan(ready []ReadyJob) []Slot {
+	sorted := sortedBy(ready, func(a, b ReadyJob) bool {
+		switch {
+		case a.Deadline.IsZero() != b.Deadline.IsZero():
+			return !a.Deadline.IsZero()
+		case !a.Deadline.Equal(b.Deadline):
+			return a.Deadline.Before(b.Deadline)
+		}
+		return byPriority(a, b)
+	})
+
+	slots := make([]Slot, 0, len(sorted))
+	for _, r := range sorted {
+		slots = append(slots, Slot{Job: r.Job, Queue: QueueFor(r.EffectivePriority)})
+	}
+	return slots
+}
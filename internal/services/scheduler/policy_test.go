@@ -0,0 +1,137 @@
+package scheduler
+
+import (
+	"doit/internal/db"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC)
+
+func readyJob(jobID string, priority int, dueAt time.Time, deadline time.Duration) ReadyJob {
+	job := &db.Job{JobID: jobID, Priority: priority, DeadlineSeconds: int(deadline / time.Second)}
+	return NewReadyJob(job, dueAt)
+}
+
+// placed is a slot written as jobID@queue
+func placed(slots []Slot) []string {
+	out := make([]string, len(slots))
+	for i, slot := range slots {
+		out[i] = fmt.Sprintf("%s@%s", slot.Job.JobID, slot.Queue)
+	}
+	return out
+}
+
+func TestSchedulingPolicies(t *testing.T) {
+	// Three high, one mid and two low jobs, the low ones have the tightest deadline and the longest wait
+	mixed := []ReadyJob{
+		readyJob("l2", 0, t0.Add(-time.Minute), 0),
+		readyJob("h3", 7, t0, 0),
+		readyJob("m1", 5, t0, 10*time.Minute),
+		readyJob("h1", 9, t0, 0),
+		readyJob("l1", 1, t0, time.Minute),
+		readyJob("h2", 8, t0.Add(time.Second), 0),
+	}
+	// Aging lifted a priority 3 job into the high queue, it is placed by its effective priority
+	aged := readyJob("aged", 3, t0.Add(-5*time.Minute), 0)
+	aged.EffectivePriority = 8
+	withAged := []ReadyJob{readyJob("m1", 6, t0, 0), aged}
+	// The two-job case, the old thirds split put both in low whatever their priority
+	two := []ReadyJob{readyJob("b", 8, t0, 0), readyJob("a", 9, t0, 0)}
+
+	tests := []struct {
+		name   string
+		policy SchedulingPolicy
+		ready  []ReadyJob
+		want   []string
+	}{
+		{
+			name:   "strict priority empties the high queue first",
+			policy: StrictPriority{},
+			ready:  mixed,
+			want:   []string{"h1@high", "h2@high", "h3@high", "m1@mid", "l1@low", "l2@low"},
+		},
+		{
+			name:   "wfq interleaves the queues by weight",
+			policy: WeightedFair{Weights: DefaultWFQWeights},
+			ready:  mixed,
+			// Finish times are h1 1/4, h2 2/4, h3 3/4, m1 1/2, l1 1, l2 2, high wins the tie with m1
+			want: []string{"h1@high", "h2@high", "m1@mid", "h3@high", "l1@low", "l2@low"},
+		},
+		{
+			name:   "wfq with equal weights alternates",
+			policy: WeightedFair{Weights: [3]int{1, 1, 1}},
+			ready:  mixed,
+			want:   []string{"h1@high", "m1@mid", "l1@low", "h2@high", "l2@low", "h3@high"},
+		},
+		{
+			name:   "edf runs the earliest deadline first and the rest by priority",
+			policy: EarliestDeadline{},
+			ready:  mixed,
+			want:   []string{"l1@low", "m1@mid", "h1@high", "h2@high", "h3@high", "l2@low"},
+		},
+		{
+			name:   "strict priority places aged jobs by effective priority",
+			policy: StrictPriority{},
+			ready:  withAged,
+			want:   []string{"aged@high", "m1@mid"},
+		},
+		{
+			name:   "strict priority with two high jobs",
+			policy: StrictPriority{},
+			ready:  two,
+			want:   []string{"a@high", "b@high"},
+		},
+		{
+			name:   "wfq with two high jobs",
+			policy: WeightedFair{Weights: DefaultWFQWeights},
+			ready:  two,
+			want:   []string{"a@high", "b@high"},
+		},
+		{
+			name:   "edf with two high jobs",
+			policy: EarliestDeadline{},
+			ready:  two,
+			want:   []string{"a@high", "b@high"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := placed(tt.policy.Plan(tt.ready))
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("%s planned %v, want %v", tt.policy.Name(), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSchedulingPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights [3]int
+		want    string
+		wantErr bool
+	}{
+		{name: "", want: PolicyStrictPriority},
+		{name: PolicyStrictPriority, want: PolicyStrictPriority},
+		{name: PolicyWeightedFair, weights: DefaultWFQWeights, want: PolicyWeightedFair},
+		{name: PolicyWeightedFair, weights: [3]int{4, 0, 1}, wantErr: true},
+		{name: PolicyEarliestDeadline, want: PolicyEarliestDeadline},
+		{name: "fifo", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		policy, err := NewSchedulingPolicy(tt.name, tt.weights)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("NewSchedulingPolicy(%q, %v) built %s, want an error", tt.name, tt.weights, policy.Name())
+			}
+			continue
+		}
+		if err != nil || policy.Name() != tt.want {
+			t.Errorf("NewSchedulingPolicy(%q, %v) = %v, %v, want %s", tt.name, tt.weights, policy, err, tt.want)
+		}
+	}
+}
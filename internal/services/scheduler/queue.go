@@ -0,0 +1,219 @@
+package scheduler
+
+import (
+	"container/heap"
+	"doit/internal/db"
+	"doit/pkg/utils"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A waiting job gains one point of priority every DefaultAgingInterval, up to DefaultAgingCap points.
+// PRIORITY_AGING_INTERVAL and PRIORITY_AGING_CAP override them, an interval of 0 turns aging off.
+const DefaultAgingInterval = 30 * time.Second
+const DefaultAgingCap = 5
+
+// Aging raises the priority of jobs the longer they wait past their NextRunTime
+type Aging struct {
+	Interval time.Duration
+	Cap      int
+}
+
+// EffectivePriority is priority raised by one point per Interval waited, by at most Cap points
+func (a Aging) EffectivePriority(priority int, waited time.Duration) int {
+	if a.Interval <= 0 || waited <= 0 {
+		return priority
+	}
+	boost := int(waited / a.Interval)
+	if boost > a.Cap {
+		boost = a.Cap
+	}
+	return priority + boost
+}
+
+// LoadAging reads the aging configuration from PRIORITY_AGING_INTERVAL and PRIORITY_AGING_CAP
+func LoadAging() (Aging, error) {
+	aging := Aging{Interval: DefaultAgingInterval, Cap: DefaultAgingCap}
+	if value := os.Getenv("PRIORITY_AGING_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			return aging, fmt.Errorf("invalid PRIORITY_AGING_INTERVAL: %q", value)
+		}
+		aging.Interval = interval
+	}
+	if value := os.Getenv("PRIORITY_AGING_CAP"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return aging, fmt.Errorf("invalid PRIORITY_AGING_CAP: %q", value)
+		}
+		aging.Cap = limit
+	}
+	return aging, nil
+}
+
+// QueuedJob describes a job waiting in the ready queue
+type QueuedJob struct {
+	JobID             string    `json:"job_id"`
+	Priority          int       `json:"priority"`
+	EffectivePriority int       `json:"effective_priority"`
+	Queue             string    `json:"queue"`
+	DueAt             time.Time `json:"due_at"`
+	Deadline          time.Time `json:"deadline"`
+	WaitSeconds       float64   `json:"wait_seconds"`
+	Resources         Resources `json:"resources"`
+	Reason            string    `json:"reason,omitempty"`
+}
+
+// ReadyQueue holds due jobs until a worker takes them. It is a utils.PriorityQueue ordered by
+// effective priority, Age raises the priority of waiting jobs and fixes their place in the heap.
+// Jobs are queued by JobID, a job holds one place however many of its runs come due while it waits.
+type ReadyQueue struct {
+	mu    sync.Mutex
+	pq    utils.PriorityQueue
+	items map[string]*utils.JobItem
+	aging Aging
+	// reasons says why a job couldn't be placed the last time it was planned
+	reasons map[string]string
+}
+
+func NewReadyQueue(aging Aging) *ReadyQueue {
+	return &ReadyQueue{
+		items:   make(map[string]*utils.JobItem),
+		aging:   aging,
+		reasons: make(map[string]string),
+	}
+}
+
+// SetAging replaces the aging configuration, queued jobs pick it up the next time they age
+func (q *ReadyQueue) SetAging(aging Aging) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.aging = aging
+}
+
+func (q *ReadyQueue) Aging() Aging {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.aging
+}
+
+func (q *ReadyQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pq.Len()
+}
+
+// Push queues a due job, it reports false when the job is already waiting and keeps its place
+func (q *ReadyQueue) Push(ready ReadyJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.items[ready.Job.JobID]; ok {
+		return false
+	}
+	item := &utils.JobItem{Value: ready.Job, Priority: ready.EffectivePriority, ReadyAt: ready.DueAt}
+	heap.Push(&q.pq, item)
+	q.items[ready.Job.JobID] = item
+	return true
+}
+
+// JobIDs lists the queued jobs
+func (q *ReadyQueue) JobIDs() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobIDs := make([]string, 0, len(q.items))
+	for jobID := range q.items {
+		jobIDs = append(jobIDs, jobID)
+	}
+	return jobIDs
+}
+
+// Remove takes a dispatched job off the queue
+func (q *ReadyQueue) Remove(job *db.Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.items[job.JobID]
+	if !ok {
+		return
+	}
+	heap.Remove(&q.pq, item.Index)
+	delete(q.items, job.JobID)
+	delete(q.reasons, job.JobID)
+}
+
+// SetReason records why a queued job is still waiting
+func (q *ReadyQueue) SetReason(job *db.Job, reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.items[job.JobID]; ok {
+		q.reasons[job.JobID] = reason
+	}
+}
+
+// Age recomputes the effective priority of every queued job as of now
+func (q *ReadyQueue) Age(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.age(now)
+}
+
+func (q *ReadyQueue) age(now time.Time) {
+	for _, item := range q.items {
+		if priority := q.aging.EffectivePriority(item.Value.Priority, now.Sub(item.ReadyAt)); priority != item.Priority {
+			q.pq.Update(item, priority)
+		}
+	}
+}
+
+// Ready ages the queue and returns its jobs highest effective priority first
+func (q *ReadyQueue) Ready(now time.Time) []ReadyJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.age(now)
+
+	items := append(utils.PriorityQueue(nil), q.pq...)
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Priority != items[j].Priority {
+			return items[i].Priority > items[j].Priority
+		}
+		return items[i].ReadyAt.Before(items[j].ReadyAt)
+	})
+
+	ready := make([]ReadyJob, 0, len(items))
+	for _, item := range items {
+		r := NewReadyJob(item.Value, item.ReadyAt)
+		r.EffectivePriority = item.Priority
+		ready = append(ready, r)
+	}
+	return ready
+}
+
+// Inspect describes the queued jobs as of now, highest effective priority first
+func (q *ReadyQueue) Inspect(now time.Time) []QueuedJob {
+	ready := q.Ready(now)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queued := make([]QueuedJob, 0, len(ready))
+	for _, r := range ready {
+		queued = append(queued, QueuedJob{
+			JobID:             r.Job.JobID,
+			Priority:          r.Job.Priority,
+			EffectivePriority: r.EffectivePriority,
+			Queue:             QueueFor(r.EffectivePriority).String(),
+			DueAt:             r.DueAt,
+			Deadline:          r.Deadline,
+			WaitSeconds:       now.Sub(r.DueAt).Seconds(),
+			Resources:         RequestOf(r.Job),
+			Reason:            q.reasons[r.Job.JobID],
+		})
+	}
+	return queued
+}
@@ -0,0 +1,184 @@
+package scheduler
+
+import (
+	"doit/internal/metrics"
+	"doit/pkg/utils"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Default bucket of each queue, it holds up to the Cap tokens and gains one every RefillRate
+const HighCap = 70
+const MidCap = 20
+const LowCap = 10
+
+const HighRefillRate = 70 * time.Millisecond
+const MidRefillRate = 20 * time.Millisecond
+const LowRefillRate = 10 * time.Millisecond
+
+// RateLimit is the size of a queue's token bucket and how many tokens it gains per second
+type RateLimit struct {
+	Capacity        int     `json:"capacity"`
+	RefillPerSecond float64 `json:"refill_per_second"`
+}
+
+func (l RateLimit) validate() error {
+	if l.Capacity < 1 {
+		return fmt.Errorf("capacity must be at least 1, got %d", l.Capacity)
+	}
+	if l.RefillPerSecond <= 0 {
+		return fmt.Errorf("refill_per_second must be positive, got %v", l.RefillPerSecond)
+	}
+	return nil
+}
+
+func perSecond(every time.Duration) float64 {
+	return float64(time.Second) / float64(every)
+}
+
+// DefaultRateLimits are the buckets of the high, mid and low queue, QUEUE_RATE_LIMITS overrides them
+var DefaultRateLimits = [3]RateLimit{
+	{Capacity: HighCap, RefillPerSecond: perSecond(HighRefillRate)},
+	{Capacity: MidCap, RefillPerSecond: perSecond(MidRefillRate)},
+	{Capacity: LowCap, RefillPerSecond: perSecond(LowRefillRate)},
+}
+
+// ParseQueue returns the queue called name
+func ParseQueue(name string) (Queue, error) {
+	for _, q := range []Queue{QueueHigh, QueueMid, QueueLow} {
+		if q.String() == name {
+			return q, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown queue: %q", name)
+}
+
+// LoadRateLimits parses QUEUE_RATE_LIMITS, a comma separated list of queue=capacity:refill_per_second
+// like high=70:14,low=10:100. Queues it leaves out keep their default.
+func LoadRateLimits() ([3]RateLimit, error) {
+	limits := DefaultRateLimits
+	value := os.Getenv("QUEUE_RATE_LIMITS")
+	if value == "" {
+		return limits, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		name, limit, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		capacity, refill, ok2 := strings.Cut(limit, ":")
+		if !ok || !ok2 {
+			return limits, fmt.Errorf("invalid QUEUE_RATE_LIMITS entry: %q", entry)
+		}
+		q, err := ParseQueue(strings.TrimSpace(name))
+		if err != nil {
+			return limits, err
+		}
+		c, err := strconv.Atoi(capacity)
+		if err != nil {
+			return limits, fmt.Errorf("invalid capacity for the %s queue: %q", q, capacity)
+		}
+		r, err := strconv.ParseFloat(refill, 64)
+		if err != nil {
+			return limits, fmt.Errorf("invalid refill rate for the %s queue: %q", q, refill)
+		}
+		l := RateLimit{Capacity: c, RefillPerSecond: r}
+		if err := l.validate(); err != nil {
+			return limits, fmt.Errorf("invalid rate limit for the %s queue: %v", q, err)
+		}
+		limits[q] = l
+	}
+	return limits, nil
+}
+
+// QueueBucket reports the state of a queue's token bucket
+type QueueBucket struct {
+	Queue string `json:"queue"`
+	utils.BucketState
+}
+
+// RateLimitKeyPrefix prefixes the Redis keys of shared queue buckets
+const RateLimitKeyPrefix = "doit:ratelimit:queue:"
+
+// RateLimits caps how fast each queue's jobs are dispatched. A job whose queue is out of tokens stays
+// queued until the bucket refills. The buckets are the process' own until Share puts them in Redis.
+type RateLimits struct {
+	mu      sync.RWMutex
+	buckets [3]utils.Limiter
+}
+
+func NewRateLimits(limits [3]RateLimit) *RateLimits {
+	rl := &RateLimits{}
+	for q, l := range limits {
+		rl.buckets[q] = utils.NewTokenBucket(l.Capacity, l.RefillPerSecond)
+	}
+	rl.Observe()
+	return rl
+}
+
+// Share moves the buckets to Redis so every executor using client draws from the same tokens, the
+// current settings become the shared ones
+func (rl *RateLimits) Share(client redis.Cmdable) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for q, bucket := range rl.buckets {
+		state := bucket.State()
+		rl.buckets[q] = utils.NewRedisTokenBucket(client, RateLimitKeyPrefix+Queue(q).String(), state.Capacity, state.RefillPerSecond)
+	}
+}
+
+func (rl *RateLimits) bucket(q Queue) utils.Limiter {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.buckets[q]
+}
+
+// Take draws a token for a job of queue, it reports false when the queue is over its rate
+func (rl *RateLimits) Take(q Queue) bool {
+	if rl.bucket(q).Take() {
+		return true
+	}
+	metrics.QueueThrottled.WithLabelValues(q.String()).Inc()
+	return false
+}
+
+// Return gives back a token drawn for a job that wasn't dispatched after all
+func (rl *RateLimits) Return(q Queue) {
+	rl.bucket(q).Return()
+}
+
+// Delay is how long until queue has a token again
+func (rl *RateLimits) Delay(q Queue) time.Duration {
+	return rl.bucket(q).Delay()
+}
+
+// Set changes the bucket of a queue at runtime, a shared bucket changes for every executor
+func (rl *RateLimits) Set(q Queue, limit RateLimit) error {
+	if err := limit.validate(); err != nil {
+		return err
+	}
+	rl.bucket(q).Set(limit.Capacity, limit.RefillPerSecond)
+	rl.Observe()
+	return nil
+}
+
+// Buckets reports every queue's bucket
+func (rl *RateLimits) Buckets() []QueueBucket {
+	buckets := make([]QueueBucket, 0, 3)
+	for _, q := range []Queue{QueueHigh, QueueMid, QueueLow} {
+		buckets = append(buckets, QueueBucket{Queue: q.String(), BucketState: rl.bucket(q).State()})
+	}
+	return buckets
+}
+
+// Observe exports the buckets' state as metrics
+func (rl *RateLimits) Observe() {
+	for _, b := range rl.Buckets() {
+		metrics.QueueBucketTokens.WithLabelValues(b.Queue).Set(b.Tokens)
+		metrics.QueueBucketCapacity.WithLabelValues(b.Queue).Set(float64(b.Capacity))
+		metrics.QueueBucketRefill.WithLabelValues(b.Queue).Set(b.RefillPerSecond)
+	}
+}
@@ -199,19 +199,23 @@ import (
 	"time"
 )
 
+// JobPageSize is how many jobs the scheduler loads from the store per poll
+const JobPageSize = 10
+
 type Scheduler struct {
+	store   db.Store
 	jobChan chan *db.Job
 }
 
-func NewScheduler() *Scheduler {
-	return &Scheduler{jobChan: make(chan *db.Job)}
+func NewScheduler(store db.Store) *Scheduler {
+	return &Scheduler{store: store, jobChan: make(chan *db.Job)}
 }
 
 func (s *Scheduler) Run() {
 	go func() {
-		limit := 0
+		offset := 0
 		for {
-			jobs, err := db.GetAllJobs(limit, 10)
+			jobs, err := s.store.GetAllJobs(JobPageSize, offset)
 			if err != nil {
 				log.Printf("Error fetching jobs from database: %v", err)
 			}
@@ -219,32 +223,151 @@ func (s *Scheduler) Run() {
 				s.jobChan <- &job
 			}
 			time.Sleep(3 * time.Second)
-			limit += 10
+			// Wrap around once the last page has been read so new jobs are picked up
+			if len(jobs) < JobPageSize {
+				offset = 0
+			} else {
+				offset += JobPageSize
+			}
 		}
 	}()
 
 	for job := range s.jobChan {
-        if job.TriggerAt.Compare(time.Now()) == 1 || job.FinishAt.Compare(time.Now()) != 1 {
-            continue
-        }
-		nextRunTime, err := utils.EvalCronExpr(job.CronExpr)
+		now := time.Now()
+		if finished(job, now) {
+			continue
+		}
+		// An existing schedule is owned by the executor, which advances it after every dispatch,
+		// the scheduler only steps in when it has fallen behind
+		if schedule, err := s.store.GetSchedule(job.JobID); err == nil {
+			s.handleMisfire(*job, schedule)
+			continue
+		}
+		// The page can be seconds old, the executor may have finished the job and dropped its
+		// schedule since. It marks the job completed first, so a fresh read tells.
+		fresh, err := s.store.GetJob(job.JobID)
+		if err != nil || finished(&fresh, now) {
+			continue
+		}
+		job = &fresh
+		nextRunTime, err := FirstRunTime(*job, now)
 		if err != nil {
 			log.Printf("Error evaluating cron for job %s: %v", job.JobID, err)
 			continue
 		}
-		sc, err := controller.CreateScheduleController("ScheduleOperationController")
+		if !job.FinishAt.IsZero() && nextRunTime.After(job.FinishAt) {
+			continue
+		}
+		sc, err := controller.CreateScheduleController("ScheduleOperationController", s.store)
 		if err != nil {
 			log.Fatalf("error initializing ScheduleOperationController")
 		}
 		if err := sc.CreateSchedule(&db.Schedule{
-			JobID:       job.JobID,
-			Priority:    job.Priority,
-			Payload:     job.Payload,
-			MaxRetries:  job.MaxRetries,
-			RcreTime:    job.RcreTime,
-			NextRunTime: nextRunTime,
+			JobID:         job.JobID,
+			Priority:      job.Priority,
+			Payload:       job.Payload,
+			MaxRetries:    job.MaxRetries,
+			RcreTime:      job.RcreTime,
+			NextRunTime:   nextRunTime,
+			MisfirePolicy: job.MisfirePolicy,
 		}); err != nil {
 			log.Printf("Error creating schedule for job %s: %v", job.JobID, err)
 		}
 	}
 }
+
+// finished reports whether job has no runs left to schedule
+func finished(job *db.Job, now time.Time) bool {
+	return job.Status == db.JobStatusCompleted || (!job.FinishAt.IsZero() && !job.FinishAt.After(now))
+}
+
+// handleMisfire applies the job's misfire policy to a schedule that fell behind. Only NextRunTime and
+// MissedRuns are written, and only while no executor holds the lease and the schedule is still at the
+// missed run, a lease taken or a retry recorded meanwhile wins.
+func (s *Scheduler) handleMisfire(job db.Job, schedule db.Schedule) {
+	now := time.Now()
+	// Leave schedules alone while an executor holds them
+	if schedule.LeaseOwner != "" && schedule.LeaseExpiresAt.After(now) {
+		return
+	}
+
+	updated, changed, err := ApplyMisfirePolicy(job, schedule, now)
+	if err != nil {
+		log.Printf("Error applying misfire policy for job %s: %v", job.JobID, err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	sc, err := controller.CreateScheduleController("ScheduleOperationController", s.store)
+	if err != nil {
+		log.Fatalf("error initializing ScheduleOperationController")
+	}
+	moved, err := sc.MisfireSchedule(&updated, schedule.NextRunTime)
+	if err != nil {
+		log.Printf("Error applying misfire policy for job %s: %v", job.JobID, err)
+		return
+	}
+	if !moved {
+		return
+	}
+	log.Printf("Job %s missed its run at %v, %s policy moved it to %v", job.JobID, schedule.NextRunTime, updated.MisfirePolicy, updated.NextRunTime)
+}
+
+// FirstRunTime is when a newly scheduled job fires first: TriggerAt for one-shots, otherwise the
+// first cron tick at or after TriggerAt (or after now, whichever is later)
+func FirstRunTime(job db.Job, now time.Time) (time.Time, error) {
+	if job.IsOneShot() {
+		if job.TriggerAt.IsZero() {
+			return now, nil
+		}
+		return job.TriggerAt, nil
+	}
+
+	from := now
+	if job.TriggerAt.After(from) {
+		// Step back a hair so a tick landing exactly on TriggerAt still counts
+		from = job.TriggerAt.Add(-time.Nanosecond)
+	}
+	return utils.NextCronTimeIn(job.CronExpr, job.TimeZone, from)
+}
+
+// Reschedule records a run of schedule at runAt and moves NextRunTime to the following cron tick.
+// It returns false when the job has no further runs, because it is a one-shot, has used up MaxRuns
+// or has passed FinishAt, and the schedule should be dropped.
+func Reschedule(job db.Job, schedule db.Schedule, runAt time.Time) (db.Schedule, bool, error) {
+	schedule.LastRunTime = runAt
+	schedule.LeaseOwner = ""
+	schedule.LeaseExpiresAt = time.Time{}
+	if schedule.Retrying {
+		schedule.Retrying = false
+	} else {
+		schedule.RunCount++
+	}
+
+	if job.IsOneShot() || (job.MaxRuns > 0 && schedule.RunCount >= job.MaxRuns) {
+		return schedule, false, nil
+	}
+
+	// Never step backwards, a late dispatch must not fire the tick it just served again.
+	// While catching up, step one tick at a time from the tick that was just served.
+	from := runAt
+	if schedule.NextRunTime.After(from) || schedule.MissedRuns > 0 {
+		from = schedule.NextRunTime
+	}
+	if schedule.MissedRuns > 0 {
+		schedule.MissedRuns--
+	}
+
+	next, err := utils.NextCronTimeIn(job.CronExpr, job.TimeZone, from)
+	if err != nil {
+		return schedule, false, err
+	}
+	if !job.FinishAt.IsZero() && next.After(job.FinishAt) {
+		return schedule, false, nil
+	}
+
+	schedule.NextRunTime = next
+	return schedule, true, nil
+}
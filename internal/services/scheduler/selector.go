@@ -0,0 +1,61 @@
+package scheduler
+
+import (
+	"doit/internal/db"
+	"doit/pkg/utils"
+	"fmt"
+	"strings"
+)
+
+// Constraints restrict the workers a job may run on. A worker has to match every NodeSelector
+// requirement and must not match any AntiAffinity requirement.
+type Constraints struct {
+	NodeSelector []utils.Requirement
+	AntiAffinity []utils.Requirement
+}
+
+// ConstraintsOf parses the selectors of a job
+func ConstraintsOf(job *db.Job) (Constraints, error) {
+	var c Constraints
+	for _, expr := range job.NodeSelector {
+		r, err := utils.ParseRequirement(expr)
+		if err != nil {
+			return c, err
+		}
+		c.NodeSelector = append(c.NodeSelector, r)
+	}
+	for _, expr := range job.AntiAffinity {
+		r, err := utils.ParseRequirement(expr)
+		if err != nil {
+			return c, err
+		}
+		c.AntiAffinity = append(c.AntiAffinity, r)
+	}
+	return c, nil
+}
+
+// Allows reports whether a worker with labels may run the job, and which requirement rules it out if not
+func (c Constraints) Allows(labels map[string]string) (bool, string) {
+	for _, r := range c.NodeSelector {
+		if !r.Matches(labels) {
+			return false, fmt.Sprintf("does not match node selector %q", r)
+		}
+	}
+	for _, r := range c.AntiAffinity {
+		if r.Matches(labels) {
+			return false, fmt.Sprintf("matches anti-affinity %q", r)
+		}
+	}
+	return true, ""
+}
+
+func (c Constraints) String() string {
+	parts := []string{}
+	for _, r := range c.NodeSelector {
+		parts = append(parts, r.String())
+	}
+	for _, r := range c.AntiAffinity {
+		parts = append(parts, "not "+r.String())
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,369 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"doit/internal/api/middlewares"
+	"doit/internal/db"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AgentLeaseWait is how long an agent's lease request waits on the server for work
+const AgentLeaseWait = 30 * time.Second
+
+// errReregister is returned by a transport when the server no longer knows the agent as active
+var errReregister = errors.New("agent has to register again")
+
+// agentTransport is how an agent talks to the server, over plain HTTP or over the gRPC WorkerService
+type agentTransport interface {
+	register(ctx context.Context, worker db.Worker) (*db.Worker, time.Duration, error)
+	// heartbeat returns the status the server has for the worker
+	heartbeat(ctx context.Context, workerID string, load int) (string, error)
+	// lease waits for one job, it returns nil when none came up in time
+	lease(ctx context.Context, workerID string) (*Assignment, error)
+	reporter(workerID string) reporter
+}
+
+// Agent runs jobs on a remote machine. It registers as a db.Worker with Capacity CPU slots, MemoryMB
+// of memory and its labels, each slot leases a job from the server, runs its script and reports the execution back.
+// The executor never places more than the agent advertises, so no slot waits on a job that won't fit.
+// The status the server answers heartbeats with pauses the slots, or drains the agent, it finishes the
+// jobs it runs and stops.
+type Agent struct {
+	transport agentTransport
+	capacity  int
+	memoryMB  int
+	labels    map[string]string
+
+	mu        sync.Mutex
+	workerID  string
+	heartbeat time.Duration
+	status    string
+
+	load atomic.Int32
+}
+
+// NewAgent creates an agent that pulls work from the HTTP API at server, authenticating with apiKey,
+// an agent or admin key
+func NewAgent(server string, apiKey string, capacity int, memoryMB int, labels map[string]string) *Agent {
+	return newAgent(&httpTransport{
+		server: server,
+		apiKey: apiKey,
+		client: &http.Client{Timeout: AgentLeaseWait + 15*time.Second},
+	}, capacity, memoryMB, labels)
+}
+
+func newAgent(transport agentTransport, capacity int, memoryMB int, labels map[string]string) *Agent {
+	return &Agent{transport: transport, capacity: capacity, memoryMB: memoryMB, labels: labels}
+}
+
+func (a *Agent) id() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.workerID
+}
+
+func (a *Agent) state() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.status
+}
+
+func (a *Agent) interval() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.heartbeat
+}
+
+// setState records the status the server has for the agent
+func (a *Agent) setState(status string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if status == a.status {
+		return
+	}
+	switch status {
+	case db.WorkerPaused:
+		log.Printf("Agent %s paused, running jobs carry on", a.workerID)
+	case db.WorkerDraining:
+		log.Printf("Agent %s draining, it stops once running jobs have been reported", a.workerID)
+	case db.WorkerCordoned:
+		log.Printf("Agent %s cordoned, no new jobs are placed on it", a.workerID)
+	default:
+		log.Printf("Agent %s is %s", a.workerID, status)
+	}
+	a.status = status
+}
+
+// register announces the agent to the server, keeping its id across re-registrations
+func (a *Agent) register(ctx context.Context) error {
+	worker := db.Worker{
+		WorkerID:  a.id(),
+		IPAddress: localIP(),
+		Capacity:  a.capacity,
+		MemoryMB:  a.memoryMB,
+		Labels:    a.labels,
+	}
+
+	registered, interval, err := a.transport.register(ctx, worker)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.workerID = registered.WorkerID
+	a.heartbeat = interval
+	if a.heartbeat <= 0 {
+		a.heartbeat = DefaultHeartbeatInterval
+	}
+	// A cordon, pause or drain outlasts registering again
+	a.status = registered.Status
+	if a.status == "" {
+		a.status = db.WorkerActive
+	}
+	a.mu.Unlock()
+
+	log.Printf("Agent registered as worker %s with %d cpu slots and %d MB", registered.WorkerID, a.capacity, a.memoryMB)
+	return nil
+}
+
+// registerUntilDone retries register with backoff until it succeeds or ctx is cancelled
+func (a *Agent) registerUntilDone(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		err := a.register(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Error registering agent: %v", err)
+		if !sleepCtx(ctx, middlewares.BackoffDelay(db.BackoffExponentialJitter, attempt, time.Second, time.Minute)) {
+			return ctx.Err()
+		}
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Run works until ctx is cancelled or the agent is drained, then waits for the scripts already running
+// to be reported
+func (a *Agent) Run(ctx context.Context) error {
+	if err := a.registerUntilDone(ctx); err != nil {
+		return err
+	}
+
+	go a.sendHeartbeats(ctx)
+
+	var wg sync.WaitGroup
+	for i := 0; i < a.capacity; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.work(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (a *Agent) sendHeartbeats(ctx context.Context) {
+	for {
+		if !sleepCtx(ctx, a.interval()) {
+			return
+		}
+
+		status, err := a.transport.heartbeat(ctx, a.id(), int(a.load.Load()))
+		if err == nil {
+			a.setState(status)
+		}
+		if errors.Is(err, errReregister) && a.state() == db.WorkerDraining {
+			log.Printf("Agent %s drained", a.id())
+			return
+		}
+		if errors.Is(err, errReregister) {
+			log.Printf("Server declared agent %s dead, registering again", a.id())
+			err = a.registerUntilDone(ctx)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error sending heartbeat: %v", err)
+		}
+	}
+}
+
+// work is one slot of the agent, it leases and runs one job at a time. A paused slot waits without
+// leasing, a draining one stops.
+func (a *Agent) work(ctx context.Context) {
+	failures := 0
+	for ctx.Err() == nil {
+		switch a.state() {
+		case db.WorkerDraining:
+			return
+		case db.WorkerPaused:
+			if !sleepCtx(ctx, a.interval()) {
+				return
+			}
+			continue
+		}
+
+		assignment, err := a.transport.lease(ctx, a.id())
+		if err != nil {
+			if ctx.Err() != nil || a.state() == db.WorkerDraining {
+				return
+			}
+			failures++
+			log.Printf("Error leasing a job: %v", err)
+			if !sleepCtx(ctx, middlewares.BackoffDelay(db.BackoffExponentialJitter, failures, time.Second, time.Minute)) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		if assignment == nil {
+			continue
+		}
+
+		a.load.Add(1)
+		a.execute(*assignment)
+		a.load.Add(-1)
+	}
+}
+
+// execute runs an assignment and reports the result. It isn't tied to the agent's context, a script
+// that has started is always seen through.
+func (a *Agent) execute(assignment Assignment) {
+	processID := assignment.Execution.ProcessID
+	rep := a.transport.reporter(a.id())
+	report := runAssignment(context.Background(), assignment, rep)
+
+	// The server may be restarting, keep the outcome until it is accepted or the server rejects it
+	for attempt := 1; attempt <= 5; attempt++ {
+		err := rep.Complete(processID, report)
+		if err == nil {
+			log.Printf("Execution %s of job %s reported as %s", processID, assignment.Execution.JobID, report.Status)
+			return
+		}
+		if errors.Is(err, errRejected) || errors.Is(err, errReregister) {
+			log.Printf("Server rejected the result of execution %s: %v", processID, err)
+			return
+		}
+		log.Printf("Error reporting execution %s: %v", processID, err)
+		time.Sleep(middlewares.BackoffDelay(db.BackoffExponential, attempt, time.Second, 30*time.Second))
+	}
+}
+
+// httpTransport talks to the /api/v1/agent endpoints
+type httpTransport struct {
+	server string
+	apiKey string
+	client *http.Client
+}
+
+// call posts body as JSON to path and decodes the answer into out. A 204 leaves out untouched.
+func (t *httpTransport) call(ctx context.Context, path string, body interface{}, out interface{}) (int, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.server+"/api/v1/agent"+path, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.apiKey != "" {
+		req.Header.Set("X-API-Key", t.apiKey)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return resp.StatusCode, errReregister
+	case resp.StatusCode == http.StatusConflict:
+		return resp.StatusCode, errRejected
+	case resp.StatusCode >= 300:
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return resp.StatusCode, fmt.Errorf("server answered %s: %s", resp.Status, apiErr.Error)
+	case resp.StatusCode == http.StatusNoContent || out == nil:
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (t *httpTransport) register(ctx context.Context, worker db.Worker) (*db.Worker, time.Duration, error) {
+	var registration struct {
+		Worker                   db.Worker `json:"worker"`
+		HeartbeatIntervalSeconds float64   `json:"heartbeat_interval_seconds"`
+	}
+	if _, err := t.call(ctx, "/register", worker, &registration); err != nil {
+		return nil, 0, err
+	}
+	return &registration.Worker, time.Duration(registration.HeartbeatIntervalSeconds * float64(time.Second)), nil
+}
+
+func (t *httpTransport) heartbeat(ctx context.Context, workerID string, load int) (string, error) {
+	var answer struct {
+		Status string `json:"status"`
+	}
+	_, err := t.call(ctx, "/"+workerID+"/heartbeat", map[string]int{"current_load": load}, &answer)
+	return answer.Status, err
+}
+
+func (t *httpTransport) lease(ctx context.Context, workerID string) (*Assignment, error) {
+	var assignment Assignment
+	status, err := t.call(ctx, fmt.Sprintf("/%s/lease?wait=%s", workerID, AgentLeaseWait), struct{}{}, &assignment)
+	if err != nil || status == http.StatusNoContent {
+		return nil, err
+	}
+	return &assignment, nil
+}
+
+func (t *httpTransport) reporter(workerID string) reporter {
+	return httpReporter{transport: t, workerID: workerID}
+}
+
+// httpReporter sends output and results to the server. HTTP can't push, so the answer to every
+// output flush says whether the execution has been cancelled in the meantime.
+type httpReporter struct {
+	transport *httpTransport
+	workerID  string
+}
+
+func (r httpReporter) Output(processID string, stdout string, stderr string) error {
+	var answer struct {
+		Cancel bool `json:"cancel"`
+	}
+	chunk := map[string]string{"stdout": stdout, "stderr": stderr}
+	if _, err := r.transport.call(context.Background(), "/"+r.workerID+"/executions/"+processID+"/logs", chunk, &answer); err != nil {
+		return err
+	}
+	if answer.Cancel && cancelLocal(processID) {
+		log.Printf("Execution %s cancelled by the server", processID)
+	}
+	return nil
+}
+
+func (r httpReporter) Complete(processID string, report ExecutionReport) error {
+	_, err := r.transport.call(context.Background(), "/"+r.workerID+"/executions/"+processID+"/complete", report, nil)
+	return err
+}
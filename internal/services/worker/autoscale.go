@@ -0,0 +1,170 @@
+package worker
+
+import (
+	"doit/internal/db"
+	"doit/internal/metrics"
+	"doit/internal/services/scheduler"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Autoscaling bounds how many local workers the pool runs and how fast it changes. The pool grows
+// when a job a local worker could run has waited UpWait, by enough workers for the jobs waiting, and
+// not again within UpCooldown. It shrinks back towards Min by draining idle workers once nothing has
+// waited and nothing was scaled for DownCooldown.
+type Autoscaling struct {
+	Min          int
+	Max          int
+	UpWait       time.Duration
+	UpCooldown   time.Duration
+	DownCooldown time.Duration
+	Interval     time.Duration
+}
+
+var DefaultAutoscaling = Autoscaling{
+	Min:          1,
+	Max:          MaxWorkers,
+	UpWait:       10 * time.Second,
+	UpCooldown:   30 * time.Second,
+	DownCooldown: 5 * time.Minute,
+	Interval:     5 * time.Second,
+}
+
+// LoadAutoscaling reads WORKER_POOL_MIN, WORKER_POOL_MAX, WORKER_SCALE_UP_WAIT,
+// WORKER_SCALE_UP_COOLDOWN, WORKER_SCALE_DOWN_COOLDOWN and WORKER_SCALE_INTERVAL on top of DefaultAutoscaling
+func LoadAutoscaling() (Autoscaling, error) {
+	scaling := DefaultAutoscaling
+	for name, value := range map[string]*int{"WORKER_POOL_MIN": &scaling.Min, "WORKER_POOL_MAX": &scaling.Max} {
+		if env := os.Getenv(name); env != "" {
+			n, err := strconv.Atoi(env)
+			if err != nil {
+				return scaling, fmt.Errorf("invalid %s: %q", name, env)
+			}
+			*value = n
+		}
+	}
+	durations := map[string]*time.Duration{
+		"WORKER_SCALE_UP_WAIT":       &scaling.UpWait,
+		"WORKER_SCALE_UP_COOLDOWN":   &scaling.UpCooldown,
+		"WORKER_SCALE_DOWN_COOLDOWN": &scaling.DownCooldown,
+		"WORKER_SCALE_INTERVAL":      &scaling.Interval,
+	}
+	for name, value := range durations {
+		if env := os.Getenv(name); env != "" {
+			d, err := time.ParseDuration(env)
+			if err != nil || d < 0 {
+				return scaling, fmt.Errorf("invalid %s: %q", name, env)
+			}
+			*value = d
+		}
+	}
+
+	if scaling.Min < 1 {
+		return scaling, fmt.Errorf("WORKER_POOL_MIN must be at least 1, got %d", scaling.Min)
+	}
+	if scaling.Max < scaling.Min {
+		return scaling, fmt.Errorf("WORKER_POOL_MAX (%d) cannot be below WORKER_POOL_MIN (%d)", scaling.Max, scaling.Min)
+	}
+	if scaling.Interval <= 0 {
+		return scaling, fmt.Errorf("WORKER_SCALE_INTERVAL must be positive")
+	}
+	return scaling, nil
+}
+
+// AutoscaleOn makes the pool scale its local workers on the jobs waiting in queue, it has to be
+// called before Run. Without it the pool runs a fixed Max workers.
+func (wp *WorkerPool) AutoscaleOn(queue *scheduler.ReadyQueue) {
+	wp.queue = queue
+}
+
+// demand counts the queued jobs a new local worker could run and how long the oldest of them waited.
+// Jobs only another worker's labels or size can take don't make the pool grow.
+func (wp *WorkerPool) demand(now time.Time) (int, time.Duration) {
+	template := db.Worker{
+		Status:   db.WorkerActive,
+		Capacity: wp.registry.capacity,
+		MemoryMB: wp.registry.memoryMB,
+		Labels:   wp.registry.labels,
+	}
+
+	waiting, oldest := 0, time.Duration(0)
+	for _, ready := range wp.queue.Ready(now) {
+		constraints, err := scheduler.ConstraintsOf(ready.Job)
+		if err != nil {
+			continue
+		}
+		if !scheduler.Explain(scheduler.RequestOf(ready.Job), constraints, []db.Worker{template})[0].Fits {
+			continue
+		}
+		waiting++
+		oldest = max(oldest, now.Sub(ready.DueAt))
+	}
+	return waiting, oldest
+}
+
+// autoscale checks the demand every Interval until the pool stops
+func (wp *WorkerPool) autoscale() {
+	ticker := time.NewTicker(wp.scaling.Interval)
+	defer ticker.Stop()
+
+	var lastUp, lastDown, lastBusy time.Time
+	for now := range ticker.C {
+		waiting, oldest := wp.demand(now)
+		metrics.PoolWaitingJobs.Set(float64(waiting))
+		metrics.PoolOldestWait.Set(oldest.Seconds())
+		if waiting > 0 {
+			lastBusy = now
+		}
+
+		size := wp.Size()
+		switch {
+		case waiting > 0 && oldest >= wp.scaling.UpWait && size < wp.scaling.Max && now.Sub(lastUp) >= wp.scaling.UpCooldown:
+			// Every new worker takes up to capacity jobs at once
+			capacity := max(wp.registry.capacity, 1)
+			add := min((waiting+capacity-1)/capacity, wp.scaling.Max-size)
+			for i := 0; i < add; i++ {
+				wp.spawn()
+			}
+			lastUp = now
+			metrics.PoolScaleEvents.WithLabelValues("up").Inc()
+			log.Printf("Scaled worker pool up from %d to %d workers, %d jobs waiting, the oldest for %v", size, wp.Size(), waiting, oldest.Round(time.Second))
+
+		case waiting == 0 && size > wp.scaling.Min && now.Sub(lastBusy) >= wp.scaling.DownCooldown &&
+			now.Sub(lastUp) >= wp.scaling.DownCooldown && now.Sub(lastDown) >= wp.scaling.DownCooldown:
+			drained := wp.drainIdle(size - wp.scaling.Min)
+			if drained == 0 {
+				continue
+			}
+			lastDown = now
+			metrics.PoolScaleEvents.WithLabelValues("down").Inc()
+			log.Printf("Scaled worker pool down from %d to %d workers, no jobs waited for %v", size, wp.Size(), now.Sub(lastBusy).Round(time.Second))
+		}
+	}
+}
+
+// drainIdle drains up to n local workers that run nothing, they leave the pool once the drain finishes
+func (wp *WorkerPool) drainIdle(n int) int {
+	drained := 0
+	for _, workerId := range wp.localWorkers() {
+		if drained == n {
+			break
+		}
+		worker, err := wp.store.GetWorker(workerId)
+		if err != nil || worker.Status != db.WorkerActive || worker.CurrentLoad > 0 {
+			continue
+		}
+		if err := wp.registry.Drain(workerId); err != nil {
+			log.Printf("Error draining idle worker %s: %v", workerId, err)
+			continue
+		}
+		wp.mu.Lock()
+		delete(wp.locals, workerId)
+		wp.mu.Unlock()
+		drained++
+	}
+	metrics.PoolSize.Set(float64(wp.Size()))
+	return drained
+}
@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"context"
+	"doit/internal/db"
+	"sync"
+)
+
+// running holds the cancel funcs of the executions this process is running, in-process or as an agent
+var running = struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+}{cancels: make(map[string]context.CancelFunc)}
+
+// cancelRequests holds executions whose cancellation hasn't reached the remote worker running them yet
+var cancelRequests = struct {
+	sync.Mutex
+	pending   map[string]bool
+	notifiers []func(db.JobExecution)
+}{pending: make(map[string]bool)}
+
+func trackRunning(processID string, cancel context.CancelFunc) {
+	running.Lock()
+	defer running.Unlock()
+	running.cancels[processID] = cancel
+}
+
+func untrackRunning(processID string) {
+	running.Lock()
+	defer running.Unlock()
+	delete(running.cancels, processID)
+}
+
+// cancelLocal stops an execution running in this process, it reports whether there was one
+func cancelLocal(processID string) bool {
+	running.Lock()
+	defer running.Unlock()
+	cancel, ok := running.cancels[processID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// OnCancel registers a transport that can push cancellations to the remote workers it is connected to
+func OnCancel(notify func(db.JobExecution)) {
+	cancelRequests.Lock()
+	defer cancelRequests.Unlock()
+	cancelRequests.notifiers = append(cancelRequests.notifiers, notify)
+}
+
+// CancelExecution stops a running execution wherever it runs. Remote workers learn about it through
+// their transport, the execution is recorded as cancelled once the worker reports back.
+func CancelExecution(store db.Store, processID string) error {
+	jobExecution, err := store.GetJobExecution(processID)
+	if err != nil {
+		return err
+	}
+	if jobExecution.Status != db.JobStatusRunning {
+		return ErrStaleExecution
+	}
+	if cancelLocal(processID) {
+		return nil
+	}
+
+	cancelRequests.Lock()
+	cancelRequests.pending[processID] = true
+	notifiers := cancelRequests.notifiers
+	cancelRequests.Unlock()
+
+	for _, notify := range notifiers {
+		notify(jobExecution)
+	}
+	return nil
+}
+
+func cancelRequested(processID string) bool {
+	cancelRequests.Lock()
+	defer cancelRequests.Unlock()
+	return cancelRequests.pending[processID]
+}
+
+func clearCancelRequest(processID string) {
+	cancelRequests.Lock()
+	defer cancelRequests.Unlock()
+	delete(cancelRequests.pending, processID)
+}
@@ -0,0 +1,177 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"doit/internal/db"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LogFlushInterval is how often the output of a running script is passed on to the reporter
+const LogFlushInterval = time.Second
+
+// reporter receives what a running execution produces. In-process workers write it to the store,
+// remote workers send it to the server over their transport.
+type reporter interface {
+	Output(processID string, stdout string, stderr string) error
+	Complete(processID string, report ExecutionReport) error
+}
+
+// errRejected means the server won't accept more reports for an execution, it is no longer
+// running on this worker
+var errRejected = errors.New("execution rejected by the server")
+
+type storeReporter struct {
+	store    db.Store
+	workerID string
+}
+
+func (r storeReporter) Output(processID string, stdout string, stderr string) error {
+	_, err := AppendOutput(r.store, r.workerID, processID, stdout, stderr)
+	return err
+}
+
+func (r storeReporter) Complete(processID string, report ExecutionReport) error {
+	return CompleteExecution(r.store, r.workerID, processID, report)
+}
+
+// runAssignment runs the script of an assignment, streams its output to rep every LogFlushInterval
+// and returns the outcome. Cancelling ctx, or CancelExecution, stops the script.
+func runAssignment(ctx context.Context, assignment Assignment, rep reporter) ExecutionReport {
+	processID := assignment.Execution.ProcessID
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	trackRunning(processID, cancel)
+	defer untrackRunning(processID)
+
+	path := assignment.scriptPath
+	if path == "" {
+		dir, err := os.MkdirTemp("", "doit-agent-")
+		if err != nil {
+			return reportFromResult(scriptResult{exitCode: -1, err: fmt.Errorf("failed to create script directory: %v", err)})
+		}
+		defer os.RemoveAll(dir)
+
+		path = filepath.Join(dir, filepath.Base(assignment.ScriptName))
+		if err := os.WriteFile(path, []byte(assignment.Script), 0o644); err != nil {
+			return reportFromResult(scriptResult{exitCode: -1, err: fmt.Errorf("failed to write script: %v", err)})
+		}
+	}
+
+	timeout := DefaultJobTimeout
+	if assignment.TimeoutSeconds > 0 {
+		timeout = time.Duration(assignment.TimeoutSeconds) * time.Second
+	}
+
+	stream := newLogStream(rep, processID)
+	defer stream.close()
+
+	log.Printf("Job %s running %s as execution %s", assignment.Execution.JobID, assignment.ScriptName, processID)
+	return reportFromResult(runScript(ctx, path, timeout, stream.stdout(), stream.stderr()))
+}
+
+func reportFromResult(result scriptResult) ExecutionReport {
+	report := ExecutionReport{
+		Status:   db.JobStatusCompleted,
+		ExitCode: result.exitCode,
+		Stdout:   result.stdout,
+		Stderr:   result.stderr,
+	}
+	switch {
+	case result.cancelled:
+		report.Status = db.JobStatusCancelled
+	case result.timedOut:
+		report.Status = db.JobStatusTimedOut
+	case result.err != nil:
+		report.Status = db.JobStatusFailed
+	}
+	if result.err != nil {
+		report.Error = result.err.Error()
+	}
+	return report
+}
+
+// logStream collects script output and hands it to a reporter every LogFlushInterval. Writes never
+// fail, output that can't be delivered is dropped, the final report carries the full output anyway.
+type logStream struct {
+	rep       reporter
+	processID string
+
+	mu      sync.Mutex
+	pending [2]bytes.Buffer
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type logStreamWriter struct {
+	stream *logStream
+	index  int
+}
+
+func (w logStreamWriter) Write(p []byte) (int, error) {
+	w.stream.mu.Lock()
+	defer w.stream.mu.Unlock()
+	if room := MaxOutputSize - w.stream.pending[w.index].Len(); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		w.stream.pending[w.index].Write(p[:room])
+	}
+	return len(p), nil
+}
+
+func newLogStream(rep reporter, processID string) *logStream {
+	s := &logStream{
+		rep:       rep,
+		processID: processID,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *logStream) stdout() logStreamWriter { return logStreamWriter{stream: s, index: 0} }
+func (s *logStream) stderr() logStreamWriter { return logStreamWriter{stream: s, index: 1} }
+
+func (s *logStream) run() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(LogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// flush passes on the pending output. It runs even without new output, reporters that poll
+// for cancellation rely on it.
+func (s *logStream) flush() {
+	s.mu.Lock()
+	stdout, stderr := s.pending[0].String(), s.pending[1].String()
+	s.pending[0].Reset()
+	s.pending[1].Reset()
+	s.mu.Unlock()
+
+	if err := s.rep.Output(s.processID, stdout, stderr); err != nil {
+		log.Printf("Error streaming output of execution %s: %v", s.processID, err)
+	}
+}
+
+// close stops streaming, whatever is still pending goes out with the final report
+func (s *logStream) close() {
+	close(s.done)
+	<-s.stopped
+}
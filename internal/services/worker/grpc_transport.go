@@ -0,0 +1,259 @@
+package worker
+
+import (
+	"context"
+	"doit/internal/db"
+	"doit/internal/rpc/workerpb"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// NewGRPCAgent creates an agent that pulls work from the executor's WorkerService at addr,
+// authenticating with apiKey, an agent or admin key
+func NewGRPCAgent(ctx context.Context, addr string, apiKey string, capacity int, memoryMB int, labels map[string]string) (*Agent, error) {
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if apiKey != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(apiKeyCredentials(apiKey)))
+	}
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	return newAgent(&grpcTransport{
+		client:      workerpb.NewWorkerServiceClient(conn),
+		shutdown:    ctx,
+		assignments: make(chan *Assignment, capacity),
+	}, capacity, memoryMB, labels), nil
+}
+
+// apiKeyCredentials sends the agent's key as x-api-key metadata on every call. The connection is
+// plaintext like the HTTP transport, so it doesn't ask for transport security.
+type apiKeyCredentials string
+
+func (k apiKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"x-api-key": string(k)}, nil
+}
+
+func (k apiKeyCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// grpcTransport keeps one Connect stream per agent. Every lease sends a Ready and waits for the
+// Assignment that answers it, output goes over the same stream and cancellations come back on it.
+type grpcTransport struct {
+	client workerpb.WorkerServiceClient
+	// shutdown is the agent's context, assignments that arrive after it ended are handed back
+	shutdown context.Context
+
+	mu       sync.Mutex
+	stream   workerpb.WorkerService_ConnectClient
+	broken   chan struct{}
+	workerID string
+
+	sendMu      sync.Mutex
+	assignments chan *Assignment
+}
+
+// grpcError maps the status codes of the WorkerService to the errors the agent acts on
+func grpcError(err error) error {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return fmt.Errorf("%w: %v", errReregister, err)
+	case codes.FailedPrecondition:
+		return fmt.Errorf("%w: %v", errRejected, err)
+	}
+	return err
+}
+
+func (t *grpcTransport) register(ctx context.Context, worker db.Worker) (*db.Worker, time.Duration, error) {
+	resp, err := t.client.Register(ctx, &workerpb.RegisterRequest{
+		WorkerId:  worker.WorkerID,
+		IpAddress: worker.IPAddress,
+		Capacity:  int32(worker.Capacity),
+		MemoryMb:  int32(worker.MemoryMB),
+		Labels:    worker.Labels,
+	})
+	if err != nil {
+		return nil, 0, grpcError(err)
+	}
+
+	// A new registration starts a new stream, closing ours ends the server's side of the old one
+	t.mu.Lock()
+	if t.stream != nil {
+		t.sendMu.Lock()
+		t.stream.CloseSend()
+		t.sendMu.Unlock()
+		t.stream = nil
+	}
+	t.mu.Unlock()
+
+	worker.WorkerID = resp.WorkerId
+	return &worker, time.Duration(resp.HeartbeatIntervalSeconds * float64(time.Second)), nil
+}
+
+func (t *grpcTransport) heartbeat(ctx context.Context, workerID string, load int) (string, error) {
+	resp, err := t.client.Heartbeat(ctx, &workerpb.HeartbeatRequest{WorkerId: workerID, CurrentLoad: int32(load)})
+	if err != nil {
+		return "", grpcError(err)
+	}
+	return resp.Status, nil
+}
+
+// connect returns the open stream, opening a new one if there is none
+func (t *grpcTransport) connect(workerID string) (workerpb.WorkerService_ConnectClient, chan struct{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stream != nil {
+		return t.stream, t.broken, nil
+	}
+
+	// The stream outlives the agent's context, running scripts keep streaming output on it
+	stream, err := t.client.Connect(context.Background())
+	if err != nil {
+		return nil, nil, grpcError(err)
+	}
+	hello := &workerpb.WorkerMessage{Message: &workerpb.WorkerMessage_Hello{Hello: &workerpb.Hello{WorkerId: workerID}}}
+	if err := stream.Send(hello); err != nil {
+		return nil, nil, grpcError(err)
+	}
+
+	t.stream = stream
+	t.broken = make(chan struct{})
+	t.workerID = workerID
+	go t.receive(stream, t.broken)
+	return stream, t.broken, nil
+}
+
+func (t *grpcTransport) receive(stream workerpb.WorkerService_ConnectClient, broken chan struct{}) {
+	defer close(broken)
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			log.Printf("Connect stream closed: %v", grpcError(err))
+			t.mu.Lock()
+			if t.stream == stream {
+				t.stream = nil
+			}
+			t.mu.Unlock()
+			return
+		}
+
+		switch m := msg.Message.(type) {
+		case *workerpb.ExecutorMessage_Assignment:
+			t.deliver(m.Assignment)
+		case *workerpb.ExecutorMessage_Cancel:
+			if cancelLocal(m.Cancel.ProcessId) {
+				log.Printf("Execution %s cancelled by the server", m.Cancel.ProcessId)
+			}
+		}
+	}
+}
+
+// deliver hands an assignment to a waiting slot. One that arrives while the agent shuts down answers
+// a Ready no slot waits for anymore, it is failed right away so the retry engine picks it up.
+// The same goes for an assignment no slot has room for, which only happens if the server answers
+// more Readys than it was sent.
+func (t *grpcTransport) deliver(a *workerpb.Assignment) {
+	assignment := &Assignment{
+		Execution: db.JobExecution{
+			ProcessID: a.ProcessId,
+			JobID:     a.JobId,
+			Status:    db.JobStatusRunning,
+		},
+		ScriptName:     a.ScriptName,
+		Script:         a.Script,
+		TimeoutSeconds: int(a.TimeoutSeconds),
+	}
+	if t.shutdown.Err() == nil {
+		select {
+		case t.assignments <- assignment:
+			return
+		default:
+		}
+	}
+
+	t.mu.Lock()
+	workerID := t.workerID
+	t.mu.Unlock()
+
+	report := ExecutionReport{Status: db.JobStatusFailed, ExitCode: -1, Error: "agent could not take the job"}
+	if err := t.reporter(workerID).Complete(a.ProcessId, report); err != nil {
+		log.Printf("Error handing back execution %s: %v", a.ProcessId, err)
+	}
+}
+
+func (t *grpcTransport) send(stream workerpb.WorkerService_ConnectClient, msg *workerpb.WorkerMessage) error {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	return stream.Send(msg)
+}
+
+func (t *grpcTransport) lease(ctx context.Context, workerID string) (*Assignment, error) {
+	stream, broken, err := t.connect(workerID)
+	if err != nil {
+		return nil, err
+	}
+	ready := &workerpb.WorkerMessage{Message: &workerpb.WorkerMessage_Ready{Ready: &workerpb.Ready{}}}
+	if err := t.send(stream, ready); err != nil {
+		return nil, grpcError(err)
+	}
+
+	select {
+	case assignment := <-t.assignments:
+		return assignment, nil
+	case <-broken:
+		return nil, errors.New("connect stream closed")
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+func (t *grpcTransport) reporter(workerID string) reporter {
+	return grpcReporter{transport: t, workerID: workerID}
+}
+
+type grpcReporter struct {
+	transport *grpcTransport
+	workerID  string
+}
+
+func (r grpcReporter) Output(processID string, stdout string, stderr string) error {
+	if stdout == "" && stderr == "" {
+		return nil
+	}
+
+	r.transport.mu.Lock()
+	stream := r.transport.stream
+	r.transport.mu.Unlock()
+	if stream == nil {
+		return errors.New("connect stream closed")
+	}
+
+	chunk := &workerpb.WorkerMessage{Message: &workerpb.WorkerMessage_Log{Log: &workerpb.LogChunk{
+		ProcessId: processID,
+		Stdout:    stdout,
+		Stderr:    stderr,
+	}}}
+	return grpcError(r.transport.send(stream, chunk))
+}
+
+func (r grpcReporter) Complete(processID string, report ExecutionReport) error {
+	_, err := r.transport.client.ReportResult(context.Background(), &workerpb.ExecutionResult{
+		WorkerId:  r.workerID,
+		ProcessId: processID,
+		Status:    report.Status,
+		ExitCode:  int32(report.ExitCode),
+		Stdout:    report.Stdout,
+		Stderr:    report.Stderr,
+		Error:     report.Error,
+	})
+	return grpcError(err)
+}
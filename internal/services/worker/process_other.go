@@ -0,0 +1,13 @@
+//go:build !unix
+
+package worker
+
+import (
+	"os/exec"
+	"time"
+)
+
+// isolate falls back to killing just the script process where process groups aren't available
+func isolate(cmd *exec.Cmd, grace time.Duration) func() {
+	return func() {}
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package worker
+
+import (
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// isolate starts the command in its own process group and makes cancellation signal the whole
+// group: SIGTERM first, then SIGKILL once grace has passed, so children the script forked die too.
+// The returned func must be called after Wait so a pending SIGKILL can't hit a recycled group id.
+func isolate(cmd *exec.Cmd, grace time.Duration) func() {
+	var mu sync.Mutex
+	var kill *time.Timer
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		mu.Lock()
+		kill = time.AfterFunc(grace, func() {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		mu.Unlock()
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if kill != nil {
+			kill.Stop()
+		}
+	}
+}
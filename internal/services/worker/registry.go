@@ -0,0 +1,398 @@
+package worker
+
+import (
+	"doit/internal/db"
+	"doit/internal/services/retry"
+	"doit/pkg/utils"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeatInterval is how often a pool reports its workers alive, WORKER_HEARTBEAT_INTERVAL overrides it
+const DefaultHeartbeatInterval = 5 * time.Second
+
+// A worker that hasn't sent a heartbeat for HeartbeatMisses intervals is considered dead
+const HeartbeatMisses = 3
+
+// WorkerCapacity is how many CPU slots a local worker advertises unless WORKER_CPU_SLOTS says otherwise,
+// WORKER_MEMORY_MB sets its memory (0 doesn't track memory)
+const WorkerCapacity = 1
+
+// Registry keeps the db.Worker rows of one pool's workers up to date. The heartbeat is sent by the
+// pool rather than by each worker, a worker busy with a long script is still alive.
+type Registry struct {
+	store    db.Store
+	mu       sync.Mutex
+	workers  map[string]*db.Worker
+	interval time.Duration
+	capacity int
+	memoryMB int
+	labels   map[string]string
+}
+
+func NewRegistry(store db.Store) *Registry {
+	return &Registry{
+		store:    store,
+		workers:  make(map[string]*db.Worker),
+		interval: DefaultHeartbeatInterval,
+		capacity: WorkerCapacity,
+	}
+}
+
+// localLabels reads the labels of the local workers from WORKER_LABELS, a comma separated list of key=value
+func localLabels() (map[string]string, error) {
+	labels, err := utils.ParseLabels(os.Getenv("WORKER_LABELS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WORKER_LABELS: %v", err)
+	}
+	return labels, nil
+}
+
+// localResources reads what each local worker advertises from WORKER_CPU_SLOTS and WORKER_MEMORY_MB
+func localResources() (int, int, error) {
+	capacity, memoryMB := WorkerCapacity, 0
+	if value := os.Getenv("WORKER_CPU_SLOTS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("invalid WORKER_CPU_SLOTS: %q", value)
+		}
+		capacity = n
+	}
+	if value := os.Getenv("WORKER_MEMORY_MB"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid WORKER_MEMORY_MB: %q", value)
+		}
+		memoryMB = n
+	}
+	return capacity, memoryMB, nil
+}
+
+func heartbeatInterval() (time.Duration, error) {
+	interval := os.Getenv("WORKER_HEARTBEAT_INTERVAL")
+	if interval == "" {
+		return DefaultHeartbeatInterval, nil
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WORKER_HEARTBEAT_INTERVAL: %v", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("WORKER_HEARTBEAT_INTERVAL must be positive")
+	}
+	return d, nil
+}
+
+// localIP is the first non-loopback address of this host, empty if there is none
+func localIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			return ipNet.IP.String()
+		}
+	}
+	return ""
+}
+
+// Register records a new worker as active
+func (r *Registry) Register(workerID string) error {
+	worker := &db.Worker{
+		WorkerID:      workerID,
+		IPAddress:     localIP(),
+		Status:        db.WorkerActive,
+		LastHeartbeat: time.Now(),
+		Capacity:      r.capacity,
+		MemoryMB:      r.memoryMB,
+		Labels:        r.labels,
+	}
+	if err := r.store.CreateWorker(worker); err != nil {
+		return fmt.Errorf("failed to register worker %s: %v", workerID, err)
+	}
+
+	r.mu.Lock()
+	r.workers[workerID] = worker
+	r.mu.Unlock()
+	return nil
+}
+
+// Heartbeat refreshes LastHeartbeat of every registered worker. A worker that was wrongly
+// declared dead, say after a long pause of the process, comes back as active.
+func (r *Registry) Heartbeat() {
+	now := time.Now()
+
+	r.mu.Lock()
+	workerIDs := make([]string, 0, len(r.workers))
+	for workerID := range r.workers {
+		workerIDs = append(workerIDs, workerID)
+	}
+	r.mu.Unlock()
+
+	for _, workerID := range workerIDs {
+		if err := r.store.HeartbeatWorker(workerID, now); err != nil {
+			log.Printf("Error sending heartbeat of worker %s: %v", workerID, err)
+			continue
+		}
+		worker, err := r.store.GetWorker(workerID)
+		if err != nil || worker.Status != db.WorkerInactive {
+			continue
+		}
+		// The reaper already failed its executions and cleared its load
+		worker.Status = db.WorkerActive
+		if err := r.store.UpdateWorker(worker); err != nil {
+			log.Printf("Error reactivating worker %s: %v", workerID, err)
+		}
+	}
+}
+
+// Interval is how often workers of this registry, remote ones included, are expected to send a heartbeat
+func (r *Registry) Interval() time.Duration {
+	return r.interval
+}
+
+// ErrWorkerOwned is returned when a key acts as a worker that was registered with another key
+var ErrWorkerOwned = errors.New("worker was registered with another key")
+
+// CheckOwner returns ErrWorkerOwned unless keyID registered workerID, a worker that doesn't exist yet
+// may be registered by anyone
+func CheckOwner(store db.Store, workerID string, keyID string) error {
+	if workerID == "" {
+		return nil
+	}
+	worker, err := store.GetWorker(workerID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if worker.KeyID == "" || worker.KeyID != keyID {
+		return fmt.Errorf("%w: %s", ErrWorkerOwned, workerID)
+	}
+	return nil
+}
+
+// RegisterRemote records a worker running on another machine as active. A worker that registers
+// again under its old id, after being declared dead, is reactivated. One that was cordoned, paused or
+// draining stays so.
+func (r *Registry) RegisterRemote(worker db.Worker) (*db.Worker, error) {
+	if worker.Capacity < 1 {
+		return nil, fmt.Errorf("capacity must be at least 1")
+	}
+	if worker.MemoryMB < 0 {
+		return nil, fmt.Errorf("memory cannot be negative")
+	}
+	if err := utils.ValidateLabels(worker.Labels); err != nil {
+		return nil, err
+	}
+	worker.Status = db.WorkerActive
+	worker.LastHeartbeat = time.Now()
+	worker.CurrentLoad = 0
+	worker.MemoryUsedMB = 0
+
+	if worker.WorkerID != "" {
+		if existing, err := r.store.GetWorker(worker.WorkerID); err == nil {
+			if existing.Status != db.WorkerInactive {
+				worker.Status = existing.Status
+			}
+			if err := r.store.UpdateWorker(worker); err != nil {
+				return nil, fmt.Errorf("failed to register worker %s: %v", worker.WorkerID, err)
+			}
+			return &worker, nil
+		}
+	} else {
+		worker.WorkerID = utils.GenerateWorkerId()
+	}
+
+	if err := r.store.CreateWorker(&worker); err != nil {
+		return nil, fmt.Errorf("failed to register worker %s: %v", worker.WorkerID, err)
+	}
+	return &worker, nil
+}
+
+// RemoteHeartbeat refreshes a remote worker and returns its status, a worker declared dead has to
+// register again. Its load is what the executor reserved on it, the load the worker reports itself is
+// not recorded.
+func (r *Registry) RemoteHeartbeat(workerID string) (string, error) {
+	worker, err := r.store.GetWorker(workerID)
+	if err != nil {
+		return "", err
+	}
+	if worker.Status == db.WorkerInactive {
+		return "", ErrWorkerInactive
+	}
+	return worker.Status, r.store.HeartbeatWorker(workerID, time.Now())
+}
+
+// setStatus moves a worker from one of the statuses in from to status
+func (r *Registry) setStatus(workerID string, from []string, status string) error {
+	err := r.store.SetWorkerStatus(workerID, from, status)
+	if errors.Is(err, db.ErrWorkerStatus) {
+		if worker, getErr := r.store.GetWorker(workerID); getErr == nil {
+			return fmt.Errorf("%w: worker %s is %s", err, workerID, worker.Status)
+		}
+	}
+	if err == nil {
+		log.Printf("Worker %s is now %s", workerID, status)
+	}
+	return err
+}
+
+// Cordon stops placing jobs on an active worker, the jobs it runs carry on
+func (r *Registry) Cordon(workerID string) error {
+	return r.setStatus(workerID, []string{db.WorkerActive}, db.WorkerCordoned)
+}
+
+// Uncordon makes a cordoned worker active again, it also calls off a drain that hasn't finished
+func (r *Registry) Uncordon(workerID string) error {
+	return r.setStatus(workerID, []string{db.WorkerCordoned, db.WorkerDraining}, db.WorkerActive)
+}
+
+// Pause tells a worker to stop asking for jobs until it is resumed, the jobs it runs carry on
+func (r *Registry) Pause(workerID string) error {
+	return r.setStatus(workerID, []string{db.WorkerActive, db.WorkerCordoned}, db.WorkerPaused)
+}
+
+// Resume makes a paused worker active again
+func (r *Registry) Resume(workerID string) error {
+	return r.setStatus(workerID, []string{db.WorkerPaused}, db.WorkerActive)
+}
+
+// Drain stops placing jobs on a worker and marks it inactive once the jobs it runs have finished, the
+// worker then leaves
+func (r *Registry) Drain(workerID string) error {
+	return r.setStatus(workerID, []string{db.WorkerActive, db.WorkerCordoned, db.WorkerPaused}, db.WorkerDraining)
+}
+
+// finishDrains marks draining workers that have nothing running or reserved any more inactive, local
+// ones stop sending heartbeats
+func (r *Registry) finishDrains() error {
+	workers, err := r.store.GetAllWorkers()
+	if err != nil {
+		return fmt.Errorf("failed to load workers: %v", err)
+	}
+
+	for _, worker := range workers {
+		if worker.Status != db.WorkerDraining || worker.CurrentLoad > 0 || worker.MemoryUsedMB > 0 {
+			continue
+		}
+		running, err := r.store.GetJobExecutionsByWorker(worker.WorkerID, db.JobStatusRunning)
+		if err != nil {
+			log.Printf("Error loading executions of worker %s: %v", worker.WorkerID, err)
+			continue
+		}
+		if len(running) > 0 {
+			continue
+		}
+		if err := r.store.SetWorkerStatus(worker.WorkerID, []string{db.WorkerDraining}, db.WorkerInactive); err != nil {
+			if !errors.Is(err, db.ErrWorkerStatus) {
+				log.Printf("Error marking drained worker %s inactive: %v", worker.WorkerID, err)
+			}
+			continue
+		}
+		r.mu.Lock()
+		delete(r.workers, worker.WorkerID)
+		r.mu.Unlock()
+		log.Printf("Worker %s drained, marking it inactive", worker.WorkerID)
+	}
+	return nil
+}
+
+// isLocal reports whether workerID is one of this pool's own workers that hasn't left
+func (r *Registry) isLocal(workerID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.workers[workerID]
+	return ok
+}
+
+// Run sends heartbeats, reaps dead workers and finishes drains every interval
+func (r *Registry) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.Heartbeat()
+		if err := ReapDeadWorkers(r.store, HeartbeatMisses*r.interval); err != nil {
+			log.Printf("Error reaping dead workers: %v", err)
+		}
+		if err := r.finishDrains(); err != nil {
+			log.Printf("Error finishing drains: %v", err)
+		}
+	}
+}
+
+// ReapDeadWorkers marks active workers whose last heartbeat is older than timeout inactive, then fails
+// the executions still running on inactive workers and hands them to the retry engine
+func ReapDeadWorkers(store db.Store, timeout time.Duration) error {
+	workers, err := store.GetAllWorkers()
+	if err != nil {
+		return fmt.Errorf("failed to load workers: %v", err)
+	}
+
+	deadline := time.Now().Add(-timeout)
+	for _, worker := range workers {
+		if worker.Status != db.WorkerInactive && worker.LastHeartbeat.Before(deadline) {
+			log.Printf("Worker %s missed its heartbeats since %v, marking it inactive", worker.WorkerID, worker.LastHeartbeat)
+			worker.Status = db.WorkerInactive
+			worker.CurrentLoad = 0
+			worker.MemoryUsedMB = 0
+			if err := store.UpdateWorker(worker); err != nil {
+				log.Printf("Error marking worker %s inactive: %v", worker.WorkerID, err)
+				continue
+			}
+		}
+		if worker.Status == db.WorkerInactive {
+			if err := recoverOrphans(store, worker.WorkerID); err != nil {
+				log.Printf("Error recovering jobs of worker %s: %v", worker.WorkerID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// recoverOrphans fails the executions a dead worker left running, the job's retry policy decides
+// whether and when they run again. Every executor reaps, only the one whose update fails the
+// execution hands it to the retry engine, so an orphan is retried or dead-lettered once.
+func recoverOrphans(store db.Store, workerID string) error {
+	orphans, err := store.GetJobExecutionsByWorker(workerID, db.JobStatusRunning)
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	engine := retry.NewEngine(store)
+
+	for i := range orphans {
+		je := &orphans[i]
+		je.Status = db.JobStatusFailed
+		je.EndTime = time.Now()
+		je.ExitCode = -1
+		je.Error = fmt.Sprintf("worker %s stopped sending heartbeats", workerID)
+		failed, err := store.FinishRunningExecution(*je)
+		if err != nil {
+			log.Printf("Error failing orphaned execution %s: %v", je.ProcessID, err)
+			continue
+		}
+		if !failed {
+			continue
+		}
+
+		clearCancelRequest(je.ProcessID)
+		log.Printf("Recovered execution %s of job %s from dead worker %s", je.ProcessID, je.JobID, workerID)
+		if err := engine.HandleResult(*je); err != nil {
+			log.Printf("Error requeueing job %s: %v", je.JobID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package worker
+
+import (
+	"context"
+	"doit/internal/db"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MaxLeaseWait caps how long a remote worker's lease request is held open
+const MaxLeaseWait = 60 * time.Second
+
+var ErrWorkerInactive = errors.New("worker is not active, register again")
+var ErrStaleExecution = errors.New("execution is no longer running on this worker")
+
+// Assignment is a job handed to a worker together with the script it has to run. Remote workers
+// get the script itself, in-process workers run it from the script directory.
+type Assignment struct {
+	Execution      db.JobExecution `json:"execution"`
+	ScriptName     string          `json:"script_name"`
+	Script         string          `json:"script"`
+	TimeoutSeconds int             `json:"timeout_seconds"`
+
+	scriptPath string
+}
+
+// ExecutionReport is the final outcome of a run as reported by a worker
+type ExecutionReport struct {
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	Error    string `json:"error"`
+}
+
+// Lease waits up to wait for the executor to place a job on the remote worker workerID and starts an
+// execution of it. While the request is open the worker counts as available for placement. It returns
+// nil when nothing was placed in time.
+func (wp *WorkerPool) Lease(ctx context.Context, workerID string, wait time.Duration) (*Assignment, error) {
+	worker, err := wp.store.GetWorker(workerID)
+	if err != nil {
+		return nil, err
+	}
+	if worker.Status == db.WorkerInactive {
+		return nil, ErrWorkerInactive
+	}
+
+	if wait > MaxLeaseWait {
+		wait = MaxLeaseWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	jobs, done := wp.receive(workerID)
+	defer done()
+
+	for {
+		var placement Placement
+		select {
+		case placement = <-jobs:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, nil
+		}
+		assignment, err := assign(wp.store, placement, workerID, true)
+		if err != nil {
+			log.Printf("Error assigning job %s to remote worker %s: %v", placement.JobID, workerID, err)
+			continue
+		}
+		if assignment == nil {
+			continue
+		}
+		log.Printf("Job %s leased to remote worker %s", placement.JobID, workerID)
+		return assignment, nil
+	}
+}
+
+// assign starts an execution of the placed job on workerID, remote workers get the script content. A
+// job whose script can't be found fails right away so the retry engine sees it, it returns nil in that
+// case. The placement's reservation belongs to the execution from here on.
+func assign(store db.Store, placement Placement, workerID string, remote bool) (*Assignment, error) {
+	jobExecution, err := beginExecution(store, placement, workerID)
+	if err != nil {
+		release(store, workerID, placement.CPUSlots, placement.MemoryMB)
+		return nil, err
+	}
+
+	job, err := store.GetJob(placement.JobID)
+	if err != nil {
+		result := scriptResult{exitCode: -1, err: fmt.Errorf("failed to load job: %v", err)}
+		return nil, finishExecution(store, jobExecution, result)
+	}
+
+	assignment := &Assignment{
+		Execution:      *jobExecution,
+		ScriptName:     filepath.Base(job.Payload),
+		TimeoutSeconds: int(jobTimeout(job) / time.Second),
+	}
+	assignment.scriptPath, err = resolveScriptPath(job.Payload)
+	if err == nil && remote {
+		var script []byte
+		script, err = os.ReadFile(assignment.scriptPath)
+		if err != nil {
+			err = fmt.Errorf("failed to read script: %v", err)
+		}
+		assignment.Script = string(script)
+	}
+	if err != nil {
+		return nil, finishExecution(store, jobExecution, scriptResult{exitCode: -1, err: err})
+	}
+	return assignment, nil
+}
+
+// runningExecution loads an execution a remote worker reports on, it must still be running on that worker
+func runningExecution(store db.Store, workerID string, processID string) (*db.JobExecution, error) {
+	jobExecution, err := store.GetJobExecution(processID)
+	if err != nil {
+		return nil, err
+	}
+	// An execution the reaper already failed has been handed to the retry engine
+	if jobExecution.WorkerID != workerID || jobExecution.Status != db.JobStatusRunning {
+		return nil, ErrStaleExecution
+	}
+	return &jobExecution, nil
+}
+
+// AppendOutput adds output streamed by a worker to a running execution. It reports whether the
+// execution has been cancelled, for workers that can't be told otherwise. Only the output is written and
+// only while the execution runs, a chunk racing the reaper or the completion can't revive it.
+func AppendOutput(store db.Store, workerID string, processID string, stdout string, stderr string) (bool, error) {
+	jobExecution, err := runningExecution(store, workerID, processID)
+	if err != nil {
+		return false, err
+	}
+	if stdout == "" && stderr == "" {
+		return cancelRequested(processID), nil
+	}
+
+	running, err := store.SetRunningExecutionOutput(processID, appendCapped(jobExecution.Stdout, stdout), appendCapped(jobExecution.Stderr, stderr))
+	if err != nil {
+		return false, err
+	}
+	if !running {
+		return false, ErrStaleExecution
+	}
+	return cancelRequested(processID), nil
+}
+
+// CompleteExecution records the final report of a worker, the report's output replaces what was streamed
+func CompleteExecution(store db.Store, workerID string, processID string, report ExecutionReport) error {
+	jobExecution, err := runningExecution(store, workerID, processID)
+	if err != nil {
+		return err
+	}
+
+	result := scriptResult{
+		exitCode: report.ExitCode,
+		stdout:   appendCapped("", report.Stdout),
+		stderr:   appendCapped("", report.Stderr),
+	}
+	switch report.Status {
+	case db.JobStatusCompleted:
+	case db.JobStatusFailed, db.JobStatusTimedOut, db.JobStatusCancelled:
+		result.timedOut = report.Status == db.JobStatusTimedOut
+		result.cancelled = report.Status == db.JobStatusCancelled
+		result.err = errors.New(report.Error)
+		if report.Error == "" {
+			result.err = fmt.Errorf("exited with code %d", report.ExitCode)
+		}
+	default:
+		return fmt.Errorf("invalid execution status: %s", report.Status)
+	}
+
+	return finishExecution(store, jobExecution, result)
+}
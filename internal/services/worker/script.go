@@ -0,0 +1,164 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"doit/internal/db"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultInterpreter runs uploaded scripts unless PYTHON_BIN points somewhere else
+const DefaultInterpreter = "python3"
+
+// DefaultJobTimeout applies to jobs that don't set TimeoutSeconds
+const DefaultJobTimeout = 30 * time.Minute
+
+// KillGracePeriod is how long a timed out script has between SIGTERM and SIGKILL
+const KillGracePeriod = 10 * time.Second
+
+// MaxOutputSize caps how much of stdout and stderr is kept on the JobExecution
+const MaxOutputSize = 64 * 1024
+
+type scriptResult struct {
+	exitCode  int
+	stdout    string
+	stderr    string
+	timedOut  bool
+	cancelled bool
+	err       error
+}
+
+// cappedBuffer keeps the first MaxOutputSize bytes and silently drops the rest,
+// so a chatty script can't blow up the execution row
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := MaxOutputSize - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]"
+	}
+	return b.buf.String()
+}
+
+// appendCapped appends chunk to output without letting it grow past MaxOutputSize
+func appendCapped(output string, chunk string) string {
+	const marker = "\n[output truncated]"
+	if strings.HasSuffix(output, marker) {
+		return output
+	}
+	if room := MaxOutputSize - len(output); room < len(chunk) {
+		if room < 0 {
+			room = 0
+		}
+		return output + chunk[:room] + marker
+	}
+	return output + chunk
+}
+
+func interpreter() string {
+	if bin := os.Getenv("PYTHON_BIN"); bin != "" {
+		return bin
+	}
+	return DefaultInterpreter
+}
+
+// resolveScriptPath turns a job payload into an absolute script path. Payloads are written by
+// UploadJob as paths under db.ScriptPath, older ones carry a "doit/scripts/" prefix instead.
+func resolveScriptPath(payload string) (string, error) {
+	if payload == "" {
+		return "", errors.New("job has no uploaded script")
+	}
+
+	path := payload
+	if strings.HasPrefix(payload, "doit/scripts/") {
+		path = filepath.Join(db.ScriptPath, filepath.Base(payload))
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid script path %q: %v", payload, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("script not found: %v", err)
+	}
+	return path, nil
+}
+
+func jobTimeout(job db.Job) time.Duration {
+	if job.TimeoutSeconds > 0 {
+		return time.Duration(job.TimeoutSeconds) * time.Second
+	}
+	return DefaultJobTimeout
+}
+
+// runScript runs the script from its own directory, the worker process never changes directory.
+// The script and anything it spawns are terminated once timeout has passed or parent is cancelled.
+// Output is also copied to stdoutTee and stderrTee as it is written when they are not nil.
+func runScript(parent context.Context, path string, timeout time.Duration, stdoutTee, stderrTee io.Writer) scriptResult {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, interpreter(), filepath.Base(path))
+	cmd.Dir = filepath.Dir(path)
+	stop := isolate(cmd, KillGracePeriod)
+	defer stop()
+	// Stop waiting on output pipes held open by stray grandchildren once the group has been killed
+	cmd.WaitDelay = 2 * KillGracePeriod
+
+	var stdout, stderr cappedBuffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if stdoutTee != nil {
+		cmd.Stdout = io.MultiWriter(&stdout, stdoutTee)
+	}
+	if stderrTee != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, stderrTee)
+	}
+
+	err := cmd.Run()
+	result := scriptResult{
+		exitCode: 0,
+		stdout:   stdout.String(),
+		stderr:   stderr.String(),
+		err:      err,
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		result.exitCode = exitErr.ExitCode()
+	default:
+		result.exitCode = -1
+	}
+
+	switch {
+	case err != nil && errors.Is(parent.Err(), context.Canceled):
+		result.cancelled = true
+		result.err = errors.New("cancelled")
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result.timedOut = true
+		result.err = fmt.Errorf("timed out after %v", timeout)
+	}
+	return result
+}
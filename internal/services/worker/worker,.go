@@ -1,175 +1,335 @@
 package worker
 
 import (
+	"context"
 	"doit/internal/controller"
 	"doit/internal/db"
+	"doit/internal/metrics"
+	"doit/internal/services/retry"
+	"doit/internal/services/scheduler"
 	"doit/pkg/utils"
-	"errors"
 	"log"
-	"os"
-	"os/exec"
-	"strings"
 	"sync"
 	"time"
 )
 
+// MaxWorkers is how many local workers the pool runs at most unless WORKER_POOL_MAX says otherwise
 const MaxWorkers = 9
 
-const HighCap = 70
-const MidCap = 20
-const LowCap = 10
-
-const HighRefillRate = 70 * time.Millisecond
-const MidRefillRate = 20 * time.Millisecond
-const LowRefillRate = 10 * time.Millisecond
+type Worker struct {
+	Id       string
+	store    db.Store
+	registry *Registry
+}
 
-var (
-	highBucket = utils.NewTokenBucket(HighCap, HighRefillRate)
-	midBucket  = utils.NewTokenBucket(MidCap, MidRefillRate)
-	lowBucket  = utils.NewTokenBucket(LowCap, LowRefillRate)
-)
+// Placement is a job the executor placed on a worker, CPUSlots and MemoryMB are already reserved on
+// the worker and the execution gives them back when it ends. Queue is the queue it was dispatched from,
+// its rate limit was already applied.
+type Placement struct {
+	JobID    string
+	Queue    scheduler.Queue
+	CPUSlots int
+	MemoryMB int
+	// Attempt is the retry the run is, 0 for a first try
+	Attempt int
+}
 
-type Worker struct {
-	Id string
+// inbox is where the executor hands jobs to one worker, waiting counts the receivers ready for one
+type inbox struct {
+	jobs    chan Placement
+	waiting int
 }
 
+// WorkerPool runs the local workers and hands placed jobs to them and to remote workers. locals are
+// the local workers that haven't been drained to scale the pool down.
 type WorkerPool struct {
+	store    db.Store
+	registry *Registry
 	pool     *sync.Pool
-	HighChan chan string
-	MidChan  chan string
-	LowChan  chan string
+	mu       sync.Mutex
+	inboxes  map[string]*inbox
+	locals   map[string]bool
 	wg       sync.WaitGroup
-	size     int
+	scaling  Autoscaling
+	queue    *scheduler.ReadyQueue
 }
 
-func NewWorkerPool() *WorkerPool {
+func NewWorkerPool(store db.Store) *WorkerPool {
+	registry := NewRegistry(store)
 	wp := &WorkerPool{
+		store:    store,
+		registry: registry,
 		pool: &sync.Pool{
 			New: func() interface{} {
-				return &Worker{}
+				return &Worker{store: store, registry: registry}
 			},
 		},
-		HighChan: make(chan string),
-		MidChan:  make(chan string),
-		LowChan:  make(chan string),
-		size:     MaxWorkers,
+		inboxes: make(map[string]*inbox),
+		locals:  make(map[string]bool),
+		scaling: DefaultAutoscaling,
 	}
 	return wp
 }
 
-func dummyJob(jobId string, workerId string) {
-	log.Printf("\nJob %s started on worker %v", jobId, workerId)
-	time.Sleep(10 * time.Second)
-	log.Printf("\nJob %s ended on worker %v", jobId, workerId)
-}
+// receive marks a receiver of workerID as ready for a job, done has to be called once it stops waiting
+func (wp *WorkerPool) receive(workerID string) (jobs <-chan Placement, done func()) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
 
-func errorJob(jobId string, workerId string) error {
-	log.Printf("\nJob %s started on worker %v", jobId, workerId)
-	time.Sleep(10 * time.Second)
-	return errors.New("job error")
+	in, ok := wp.inboxes[workerID]
+	if !ok {
+		in = &inbox{jobs: make(chan Placement)}
+		wp.inboxes[workerID] = in
+	}
+	in.waiting++
+	return in.jobs, func() {
+		wp.mu.Lock()
+		in.waiting--
+		wp.mu.Unlock()
+	}
 }
 
-func (w *Worker)Start(jobId string) error {
-	// Assuming scriptPath is given as "../doit/scripts/123.py"
-	scriptPath := "../doit/scripts/123.py"
+// Available returns the workers of this pool that are waiting for a job right now, local workers
+// always are and remote workers are while they hold a lease request open
+func (wp *WorkerPool) Available() map[string]bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	available := make(map[string]bool)
+	for workerID, in := range wp.inboxes {
+		if in.waiting > 0 {
+			available[workerID] = true
+		}
+	}
+	return available
+}
 
-	paths := strings.Split(scriptPath, "/")
-	dir := strings.Join(paths[:len(paths)-1], "/")
-	pythonScript := paths[len(paths)-1]
+// Offer hands a placed job to workerID, it reports false when the worker didn't take it within wait
+func (wp *WorkerPool) Offer(workerID string, placement Placement, wait time.Duration) bool {
+	wp.mu.Lock()
+	in, ok := wp.inboxes[workerID]
+	ok = ok && in.waiting > 0
+	wp.mu.Unlock()
+	if !ok {
+		return false
+	}
 
-	// Optionally, log the paths to check if everything is correct
-	log.Printf("Changing to directory: %s", dir)
-	log.Printf("Running Python script: %s", pythonScript)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case in.jobs <- placement:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
 
-	// Change to the script directory
-	err := os.Chdir(dir)
-	if err != nil {
-		return errors.New("Error changing directory: " + err.Error())
+// release gives resources reserved on a worker back
+func release(store db.Store, workerID string, cpuSlots int, memoryMB int) {
+	if err := store.ReleaseWorker(workerID, cpuSlots, memoryMB); err != nil {
+		log.Printf("Error releasing resources on worker %s: %v", workerID, err)
 	}
+}
 
-	// Install dependencies and build image (for your comment placeholder)
-	// You can implement dependency installation logic here if needed
+// Start runs the script uploaded for the placed job and records the outcome as a JobExecution. It runs
+// the same code as a remote agent, only the output goes straight to the store.
+func (w *Worker) Start(placement Placement) error {
+	assignment, err := assign(w.store, placement, w.Id, false)
+	if err != nil || assignment == nil {
+		return err
+	}
 
-	// Create a command to run the Python script
-	startTime := time.Now()
-	cmd := exec.Command("python", pythonScript) // or use "python3" depending on your environment
+	rep := storeReporter{store: w.store, workerID: w.Id}
+	report := runAssignment(context.Background(), *assignment, rep)
+	return rep.Complete(assignment.Execution.ProcessID, report)
+}
 
-	// Run the command and capture the output
-	status := db.JobStatusCompleted
-	output, err := cmd.CombinedOutput()
+// beginExecution records that workerId has started running the placed job
+func beginExecution(store db.Store, placement Placement, workerId string) (*db.JobExecution, error) {
+	jec, err := controller.NewJobExecutionController("JobExecutionOperationController", store)
 	if err != nil {
-		status = db.JobStatusFailed
-		log.Printf("Error running Python script: %v\nOutput: %s", err, string(output))
+		return nil, err
+	}
+
+	jobExecution := &db.JobExecution{
+		JobID:     placement.JobID,
+		WorkerID:  workerId,
+		StartTime: time.Now(),
+		Status:    db.JobStatusRunning,
+		CPUSlots:  placement.CPUSlots,
+		MemoryMB:  placement.MemoryMB,
+		Attempt:   placement.Attempt,
+	}
+	if err := jec.CreateJobExecution(jobExecution); err != nil {
+		return nil, err
 	}
+	return jobExecution, nil
+}
 
-	jec, err := controller.NewJobExecutionController("JobExecutionOperationController")
+// finishExecution records the outcome of a run and lets the retry engine decide what happens next
+func finishExecution(store db.Store, jobExecution *db.JobExecution, result scriptResult) error {
+	jec, err := controller.NewJobExecutionController("JobExecutionOperationController", store)
 	if err != nil {
 		return err
 	}
 
-	jobExecution := &db.JobExecution{
-		JobID:     jobId,
-		WorkerID:  w.Id,
-		StartTime: startTime,
-		EndTime:   time.Now(),
-		Status:    status,
-		Error:     err.Error(),
+	jobExecution.EndTime = time.Now()
+	jobExecution.ExitCode = result.exitCode
+	jobExecution.Stdout = result.stdout
+	jobExecution.Stderr = result.stderr
+	jobExecution.Status = db.JobStatusCompleted
+	switch {
+	case result.cancelled:
+		jobExecution.Status = db.JobStatusCancelled
+		jobExecution.Error = result.err.Error()
+		log.Printf("Job %s cancelled on worker %s", jobExecution.JobID, jobExecution.WorkerID)
+	case result.err != nil:
+		jobExecution.Status = db.JobStatusFailed
+		if result.timedOut {
+			jobExecution.Status = db.JobStatusTimedOut
+		}
+		jobExecution.Error = result.err.Error()
+		log.Printf("Job %s failed on worker %s: %v", jobExecution.JobID, jobExecution.WorkerID, result.err)
 	}
-	if err := jec.CreateJobExecution(jobExecution); err != nil {
+
+	if err := jec.UpdateJobExecution(jobExecution); err != nil {
 		return err
 	}
+	clearCancelRequest(jobExecution.ProcessID)
+	release(store, jobExecution.WorkerID, jobExecution.CPUSlots, jobExecution.MemoryMB)
 
-	return nil
+	return retry.NewEngine(store).HandleResult(*jobExecution)
 }
 
+// Registry is where the pool's workers, local and remote, are registered
+func (wp *WorkerPool) Registry() *Registry {
+	return wp.registry
+}
 
 func (wp *WorkerPool) Run() {
-	defer close(wp.HighChan)
-	defer close(wp.MidChan)
-	defer close(wp.LowChan)
-
-	go highBucket.Refill()
-	go midBucket.Refill()
-	go lowBucket.Refill()
-
-	for i := 0; i < wp.size; i++ {
-		wp.wg.Add(1)
-		go func() {
-            workerId := utils.GenerateWorkerId()
-			log.Printf("\nWorker %s created", workerId)
-			defer wp.wg.Done()
-
-			for {  
-				select {
-				case jobId := <-wp.HighChan:
-					if highBucket.Take() {
-						w := wp.pool.Get().(*Worker)
-						w.Id = workerId
-						if err := w.Start(jobId); err != nil {
-							log.Printf("Error executing high-priority job: %v", err)
-						}
-						wp.pool.Put(w)
-					}
-				case jobId := <-wp.MidChan:
-					if midBucket.Take() { 
-						w := wp.pool.Get().(*Worker)
-						w.Id = workerId
-						dummyJob(jobId, workerId)
-						wp.pool.Put(w)
-					}
-				case jobId := <-wp.LowChan:
-					if lowBucket.Take() {
-						w := wp.pool.Get().(*Worker)
-						w.Id = workerId
-						errorJob(jobId, workerId)
-						wp.pool.Put(w)
-					}
-				default:
-					time.Sleep(10 * time.Millisecond)
-				}
-			}
-		}()
+	interval, err := heartbeatInterval()
+	if err != nil {
+		log.Fatalf("Error loading worker heartbeat interval: %v", err)
+		return
+	}
+	wp.registry.interval = interval
+	if wp.registry.capacity, wp.registry.memoryMB, err = localResources(); err != nil {
+		log.Fatalf("Error loading worker resources: %v", err)
+		return
+	}
+	if wp.registry.labels, err = localLabels(); err != nil {
+		log.Fatalf("Error loading worker labels: %v", err)
+		return
+	}
+	if wp.scaling, err = LoadAutoscaling(); err != nil {
+		log.Fatalf("Error loading worker pool autoscaling: %v", err)
+		return
+	}
+	go wp.registry.Run()
+
+	size := wp.scaling.Max
+	if wp.queue != nil {
+		size = wp.scaling.Min
+		log.Printf("Autoscaling the worker pool between %d and %d workers", wp.scaling.Min, wp.scaling.Max)
+	}
+	for i := 0; i < size; i++ {
+		wp.spawn()
+	}
+	if wp.queue != nil {
+		go wp.autoscale()
 	}
 
 	wp.wg.Wait()
 }
+
+// spawn registers a new local worker and starts it
+func (wp *WorkerPool) spawn() {
+	workerId := utils.GenerateWorkerId()
+	if err := wp.registry.Register(workerId); err != nil {
+		log.Printf("Error registering worker %s: %v", workerId, err)
+		return
+	}
+	log.Printf("\nWorker %s created", workerId)
+
+	wp.mu.Lock()
+	wp.locals[workerId] = true
+	wp.mu.Unlock()
+	metrics.PoolSize.Set(float64(wp.Size()))
+
+	wp.wg.Add(1)
+	go func() {
+		defer wp.wg.Done()
+		wp.runLocal(workerId)
+
+		wp.mu.Lock()
+		delete(wp.locals, workerId)
+		wp.mu.Unlock()
+		metrics.PoolSize.Set(float64(wp.Size()))
+	}()
+}
+
+// Size is how many local workers the pool runs, workers drained to scale it down no longer count
+func (wp *WorkerPool) Size() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return len(wp.locals)
+}
+
+func (wp *WorkerPool) localWorkers() []string {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	workerIds := make([]string, 0, len(wp.locals))
+	for workerId := range wp.locals {
+		workerIds = append(workerIds, workerId)
+	}
+	return workerIds
+}
+
+// runLocal runs every job placed on a local worker at once, the executor never places more than its
+// capacity. Every heartbeat interval it looks at the worker's status, a paused or draining worker stops
+// waiting for jobs and a drained one leaves the pool.
+func (wp *WorkerPool) runLocal(workerId string) {
+	jobs, done := wp.receive(workerId)
+	ticker := time.NewTicker(wp.registry.Interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case placement := <-jobs:
+			go func(placement Placement) {
+				w := wp.pool.Get().(*Worker)
+				w.Id = workerId
+				if err := w.Start(placement); err != nil {
+					log.Printf("Error executing %s-priority job: %v", placement.Queue, err)
+				}
+				wp.pool.Put(w)
+			}(placement)
+		case <-ticker.C:
+			worker, err := wp.store.GetWorker(workerId)
+			if err != nil {
+				continue
+			}
+			switch worker.Status {
+			case db.WorkerPaused, db.WorkerDraining:
+				if jobs != nil {
+					done()
+					jobs = nil
+				}
+			case db.WorkerInactive:
+				if wp.registry.isLocal(workerId) {
+					continue
+				}
+				if jobs != nil {
+					done()
+				}
+				log.Printf("Worker %s drained, leaving the pool", workerId)
+				return
+			default:
+				if jobs == nil {
+					jobs, done = wp.receive(workerId)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// cronParser accepts the standard 5-field form, a leading seconds field, and descriptors such as @every 15s
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// splitCronTZ strips a leading CRON_TZ= or TZ= prefix and returns the zone name and the bare spec
+func splitCronTZ(cronExpr string) (string, string) {
+	cronExpr = strings.TrimSpace(cronExpr)
+	for _, prefix := range []string{"CRON_TZ=", "TZ="} {
+		if strings.HasPrefix(cronExpr, prefix) {
+			fields := strings.SplitN(cronExpr, " ", 2)
+			if len(fields) < 2 {
+				return strings.TrimPrefix(fields[0], prefix), ""
+			}
+			return strings.TrimPrefix(fields[0], prefix), strings.TrimSpace(fields[1])
+		}
+	}
+	return "", cronExpr
+}
+
+// LoadCronLocation resolves the zone a cron expression runs in: a CRON_TZ= prefix wins over
+// timeZone, and an empty zone means the server's local time
+func LoadCronLocation(cronExpr string, timeZone string) (*time.Location, error) {
+	if prefixed, _ := splitCronTZ(cronExpr); prefixed != "" {
+		timeZone = prefixed
+	}
+	if timeZone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %v", timeZone, err)
+	}
+	return loc, nil
+}
+
+// NextCronTimeIn returns the first activation of cronExpr after from, evaluated on the wall clock
+// of timeZone (or of the expression's CRON_TZ= prefix).
+//
+// Cron fields describe wall-clock times, so DST transitions are resolved as follows:
+//   - a wall time skipped by a spring-forward gap fires once, shifted forward by the gap
+//     (02:30 becomes 03:30 when clocks jump from 02:00 to 03:00)
+//   - a wall time repeated by a fall-back overlap fires once, on its first occurrence
+func NextCronTimeIn(cronExpr string, timeZone string, from time.Time) (time.Time, error) {
+	loc, err := LoadCronLocation(cronExpr, timeZone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, spec := splitCronTZ(cronExpr)
+
+	sched, err := cronParser.Parse(spec)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron expression: %v", err)
+	}
+
+	// Interval schedules (@every) don't follow the wall clock
+	specSched, ok := sched.(*cron.SpecSchedule)
+	if !ok {
+		return sched.Next(from), nil
+	}
+
+	// Walk the schedule over naive wall-clock times, expressed as UTC so no transition applies
+	specSched.Location = time.UTC
+	wall := wallClock(from.In(loc))
+	for {
+		wall = specSched.Next(wall)
+		if wall.IsZero() {
+			return time.Time{}, fmt.Errorf("cron expression %q never fires", cronExpr)
+		}
+		// A wall time that resolves to an instant not after from has already been served,
+		// this is what keeps the second pass through an overlap from firing again
+		if next := resolveWallClock(wall, loc); next.After(from) {
+			return next, nil
+		}
+	}
+}
+
+// wallClock reinterprets the local wall-clock reading of t as a UTC time
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// resolveWallClock maps a naive wall-clock time back to an instant in loc. Ambiguous times
+// resolve to the earlier instant and times inside a gap are shifted forward by the gap.
+func resolveWallClock(wall time.Time, loc *time.Location) time.Time {
+	// Offsets in effect a day before and after the wall time cover both sides of any transition
+	_, before := wall.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := wall.Add(24 * time.Hour).In(loc).Zone()
+
+	var resolved time.Time
+	for _, offset := range []int{before, after} {
+		candidate := wall.Add(-time.Duration(offset) * time.Second).In(loc)
+		if !wallClock(candidate).Equal(wall) {
+			continue
+		}
+		if resolved.IsZero() || candidate.Before(resolved) {
+			resolved = candidate
+		}
+	}
+	if !resolved.IsZero() {
+		return resolved
+	}
+
+	// Nothing matched, the wall time falls in a gap: read it with the pre-transition offset
+	return wall.Add(-time.Duration(before) * time.Second).In(loc)
+}
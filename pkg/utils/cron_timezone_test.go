@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"testing"
+	"time"
+	// Zone data of its own, so the transitions don't depend on the host's tzdata
+	_ "time/tzdata"
+)
+
+func utc(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// firings collects the activations of cronExpr in timeZone from from up to, not including, until
+func firings(t *testing.T, cronExpr, timeZone string, from, until time.Time) []time.Time {
+	var fired []time.Time
+	for at := from; ; {
+		next, err := NextCronTimeIn(cronExpr, timeZone, at)
+		if err != nil {
+			t.Fatalf("NextCronTimeIn(%q, %q, %v): %v", cronExpr, timeZone, at, err)
+		}
+		if !next.Before(until) {
+			return fired
+		}
+		fired = append(fired, next)
+		at = next
+	}
+}
+
+func TestNextCronTimeInDSTTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		zone  string
+		cron  string
+		from  string
+		until string
+		want  []string
+	}{
+		{
+			// 02:00 EST jumps to 03:00 EDT, the skipped 02:30 fires once at 03:30
+			name: "new york spring forward skips 02:30",
+			zone: "America/New_York", cron: "30 2 * * *",
+			from: "2026-03-07T00:00:00Z", until: "2026-03-10T00:00:00Z",
+			want: []string{"2026-03-07T07:30:00Z", "2026-03-08T07:30:00Z", "2026-03-09T06:30:00Z"},
+		},
+		{
+			// 02:00 EDT falls back to 01:00 EST, 01:30 happens twice and fires on the first
+			name: "new york fall back repeats 01:30",
+			zone: "America/New_York", cron: "30 1 * * *",
+			from: "2026-10-31T00:00:00Z", until: "2026-11-03T00:00:00Z",
+			want: []string{"2026-10-31T05:30:00Z", "2026-11-01T05:30:00Z", "2026-11-02T06:30:00Z"},
+		},
+		{
+			// The second pass through 01:00-02:00 EST has already been served
+			name: "new york fall back every half hour",
+			zone: "America/New_York", cron: "*/30 * * * *",
+			from: "2026-11-01T03:59:00Z", until: "2026-11-01T07:30:00Z",
+			want: []string{"2026-11-01T04:00:00Z", "2026-11-01T04:30:00Z", "2026-11-01T05:00:00Z", "2026-11-01T05:30:00Z", "2026-11-01T07:00:00Z"},
+		},
+		{
+			// 02:00 CET jumps to 03:00 CEST
+			name: "berlin spring forward skips 02:30",
+			zone: "Europe/Berlin", cron: "30 2 * * *",
+			from: "2026-03-28T00:00:00Z", until: "2026-03-31T00:00:00Z",
+			want: []string{"2026-03-28T01:30:00Z", "2026-03-29T01:30:00Z", "2026-03-30T00:30:00Z"},
+		},
+		{
+			// 03:00 CEST falls back to 02:00 CET, 02:30 happens twice
+			name: "berlin fall back repeats 02:30",
+			zone: "Europe/Berlin", cron: "30 2 * * *",
+			from: "2026-10-24T00:00:00Z", until: "2026-10-27T00:00:00Z",
+			want: []string{"2026-10-24T00:30:00Z", "2026-10-25T00:30:00Z", "2026-10-26T01:30:00Z"},
+		},
+		{
+			// The southern hemisphere springs forward in October, 02:00 AEST jumps to 03:00 AEDT
+			name: "sydney spring forward skips 02:30",
+			zone: "Australia/Sydney", cron: "30 2 * * *",
+			from: "2026-10-02T00:00:00Z", until: "2026-10-05T00:00:00Z",
+			want: []string{"2026-10-02T16:30:00Z", "2026-10-03T16:30:00Z", "2026-10-04T15:30:00Z"},
+		},
+		{
+			// 03:00 AEDT falls back to 02:00 AEST in April
+			name: "sydney fall back repeats 02:30",
+			zone: "Australia/Sydney", cron: "30 2 * * *",
+			from: "2026-04-03T00:00:00Z", until: "2026-04-06T00:00:00Z",
+			want: []string{"2026-04-03T15:30:00Z", "2026-04-04T15:30:00Z", "2026-04-05T16:30:00Z"},
+		},
+		{
+			name: "cron_tz prefix wins over the job's zone",
+			zone: "UTC", cron: "CRON_TZ=Europe/Berlin 30 2 * * *",
+			from: "2026-03-29T00:00:00Z", until: "2026-03-30T00:00:00Z",
+			want: []string{"2026-03-29T01:30:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := firings(t, tt.cron, tt.zone, utc(tt.from), utc(tt.until))
+			if len(got) != len(tt.want) {
+				t.Fatalf("fired %d times %v, want %v", len(got), got, tt.want)
+			}
+			for i, want := range tt.want {
+				if !got[i].Equal(utc(want)) {
+					t.Errorf("firing %d at %v, want %v", i, got[i].UTC(), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Selector operators, a requirement is written as one of
+//
+//	key=value  key!=value  key in (a,b)  key notin (a,b)  key  !key
+const (
+	OpEquals    = "="
+	OpNotEquals = "!="
+	OpIn        = "in"
+	OpNotIn     = "notin"
+	OpExists    = "exists"
+	OpNotExists = "!exists"
+)
+
+var labelKey = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_./-]*[A-Za-z0-9])?$`)
+var setExpr = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+
+// Requirement is one parsed label selector expression, jobs use them to pick the workers they run on
+type Requirement struct {
+	Key    string
+	Op     string
+	Values []string
+	expr   string
+}
+
+func (r Requirement) String() string {
+	return r.expr
+}
+
+// ParseRequirement parses a selector expression
+func ParseRequirement(expr string) (Requirement, error) {
+	expr = strings.TrimSpace(expr)
+	r := Requirement{expr: expr}
+
+	switch {
+	case setExpr.MatchString(expr):
+		m := setExpr.FindStringSubmatch(expr)
+		r.Key, r.Op = m[1], m[2]
+		for _, value := range strings.Split(m[3], ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				r.Values = append(r.Values, value)
+			}
+		}
+		if len(r.Values) == 0 {
+			return r, fmt.Errorf("invalid selector %q: %s needs at least one value", expr, r.Op)
+		}
+	case strings.Contains(expr, "!="):
+		key, value, _ := strings.Cut(expr, "!=")
+		r.Key, r.Op, r.Values = strings.TrimSpace(key), OpNotEquals, []string{strings.TrimSpace(value)}
+	case strings.Contains(expr, "="):
+		key, value, _ := strings.Cut(expr, "=")
+		r.Key, r.Op, r.Values = strings.TrimSpace(key), OpEquals, []string{strings.TrimSpace(strings.TrimPrefix(value, "="))}
+	case strings.HasPrefix(expr, "!"):
+		r.Key, r.Op = strings.TrimSpace(expr[1:]), OpNotExists
+	default:
+		r.Key, r.Op = expr, OpExists
+	}
+
+	if !labelKey.MatchString(r.Key) {
+		return r, fmt.Errorf("invalid selector %q: bad label key %q", expr, r.Key)
+	}
+	return r, nil
+}
+
+// Matches reports whether labels satisfy the requirement, != and notin also match a missing label
+func (r Requirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Op {
+	case OpExists:
+		return ok
+	case OpNotExists:
+		return !ok
+	case OpEquals:
+		return ok && value == r.Values[0]
+	case OpNotEquals:
+		return !ok || value != r.Values[0]
+	case OpIn:
+		return ok && containsValue(r.Values, value)
+	case OpNotIn:
+		return !ok || !containsValue(r.Values, value)
+	}
+	return false
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseLabels parses a comma separated list of key=value worker labels
+func ParseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(pair, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if !ok || !labelKey.MatchString(key) {
+			return nil, fmt.Errorf("invalid label %q", pair)
+		}
+		labels[key] = val
+	}
+	return labels, nil
+}
+
+// ValidateLabels checks the keys of labels a worker registers with
+func ValidateLabels(labels map[string]string) error {
+	for key := range labels {
+		if !labelKey.MatchString(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+	}
+	return nil
+}
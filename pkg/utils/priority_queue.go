@@ -1,13 +1,18 @@
 package utils
 
 import (
+	"container/heap"
 	"doit/internal/db"
+	"time"
 )
 
+// JobItem is a queued job, Priority is the effective priority the queue orders by and may differ
+// from Value.Priority once the job has aged. ReadyAt is when the job became due.
 type JobItem struct {
 	Value    *db.Job
 	Priority int
 	Index    int
+	ReadyAt  time.Time
 }
 
 type PriorityQueue []*JobItem
@@ -37,4 +42,10 @@ func (pq *PriorityQueue) Pop() interface{} {
 	JobItem := old[n-1]
 	*pq = old[0 : n-1]
 	return JobItem
-}
\ No newline at end of file
+}
+
+// Update changes the priority of an item already in the queue and restores the heap order in place
+func (pq *PriorityQueue) Update(item *JobItem, priority int) {
+	item.Priority = priority
+	heap.Fix(pq, item.Index)
+}
@@ -0,0 +1,297 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Limiter is a token bucket, TokenBucket keeps it in the process and RedisTokenBucket shares it
+// between every process using the same Redis key
+type Limiter interface {
+	Take() bool
+	Return()
+	Delay() time.Duration
+	Set(capacity int, refillPerSecond float64)
+	State() BucketState
+}
+
+// takeScript refills the bucket at KEYS[1] for the time since it was last used and takes ARGV[3]
+// tokens from it if it has them. A negative cost gives tokens back, 0 only refills. The clock is
+// Redis', so processes with skewed clocks share one rate. Capacity and refill stored in the bucket
+// by Set win over ARGV[1] and ARGV[2], buckets without them expire once they would be full anyway.
+var takeScript = redis.NewScript(`
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts', 'capacity', 'refill')
+local capacity = tonumber(bucket[3]) or tonumber(ARGV[1])
+local refill = tonumber(bucket[4]) or tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) / 1000 * refill)
+end
+
+local allowed = 0
+if cost <= 0 or tokens >= cost then
+	tokens = math.min(capacity, tokens - cost)
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+if not bucket[3] then
+	redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / refill * 2000))
+end
+return {allowed, tostring(tokens), tostring(capacity), tostring(refill)}
+`)
+
+// seedScript stores ARGV[1] and ARGV[2] as the settings of the bucket at KEYS[1] unless it has
+// some already, and answers the settings the bucket ends up with
+var seedScript = redis.NewScript(`
+if redis.call('HSETNX', KEYS[1], 'capacity', ARGV[1]) == 1 then
+	redis.call('HSET', KEYS[1], 'refill', ARGV[2])
+	redis.call('PERSIST', KEYS[1])
+end
+return redis.call('HMGET', KEYS[1], 'capacity', 'refill')
+`)
+
+// bucketResult is what takeScript answers
+type bucketResult struct {
+	allowed bool
+	state   BucketState
+}
+
+// takeFrom runs takeScript for key
+func takeFrom(ctx context.Context, client redis.Scripter, key string, capacity int, refillPerSecond float64, cost int) (bucketResult, error) {
+	reply, err := takeScript.Run(ctx, client, []string{key}, capacity, refillPerSecond, cost).Slice()
+	if err != nil {
+		return bucketResult{}, err
+	}
+
+	result := bucketResult{allowed: reply[0].(int64) == 1}
+	result.state.Tokens, _ = strconv.ParseFloat(reply[1].(string), 64)
+	c, _ := strconv.ParseFloat(reply[2].(string), 64)
+	result.state.Capacity = int(c)
+	result.state.RefillPerSecond, _ = strconv.ParseFloat(reply[3].(string), 64)
+	return result, nil
+}
+
+// RedisTokenBucket is a token bucket kept in Redis, the update is one Lua script so every process
+// draws from the same tokens. While Redis can't be reached it falls back to a bucket of its own.
+type RedisTokenBucket struct {
+	client redis.Cmdable
+	key    string
+
+	mu       sync.Mutex
+	local    *TokenBucket
+	degraded bool
+}
+
+// NewRedisTokenBucket shares the bucket at key. capacity and refillPerSecond are stored with it if
+// it has no settings yet, settings stored before, by an earlier process or Set, are kept and apply.
+func NewRedisTokenBucket(client redis.Cmdable, key string, capacity int, refillPerSecond float64) *RedisTokenBucket {
+	tb := &RedisTokenBucket{
+		client: client,
+		key:    key,
+		local:  NewTokenBucket(capacity, refillPerSecond),
+	}
+	tb.seed(capacity, refillPerSecond)
+	return tb
+}
+
+// seed stores the settings unless the shared bucket has some and gives the local bucket the stored ones
+func (tb *RedisTokenBucket) seed(capacity int, refillPerSecond float64) {
+	reply, err := seedScript.Run(context.Background(), tb.client, []string{tb.key}, capacity, refillPerSecond).Slice()
+	if err != nil {
+		log.Printf("Error seeding the settings of token bucket %s: %v", tb.key, err)
+		return
+	}
+
+	storedCapacity, _ := reply[0].(string)
+	storedRefill, _ := reply[1].(string)
+	c, errCapacity := strconv.Atoi(storedCapacity)
+	r, errRefill := strconv.ParseFloat(storedRefill, 64)
+	if errCapacity != nil || errRefill != nil {
+		log.Printf("Token bucket %s has unreadable settings %q and %q", tb.key, storedCapacity, storedRefill)
+		return
+	}
+	tb.local.Set(c, r)
+}
+
+// run applies cost to the shared bucket, on error the local bucket answers instead
+func (tb *RedisTokenBucket) run(cost int) (bucketResult, bool) {
+	state := tb.local.State()
+	result, err := takeFrom(context.Background(), tb.client, tb.key, state.Capacity, state.RefillPerSecond, cost)
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if err != nil {
+		if !tb.degraded {
+			log.Printf("Token bucket %s falls back to a local bucket, Redis failed: %v", tb.key, err)
+		}
+		tb.degraded = true
+		return bucketResult{}, false
+	}
+	if tb.degraded {
+		log.Printf("Token bucket %s is shared through Redis again", tb.key)
+	}
+	tb.degraded = false
+	return result, true
+}
+
+func (tb *RedisTokenBucket) Take() bool {
+	result, ok := tb.run(1)
+	if !ok {
+		return tb.local.Take()
+	}
+	return result.allowed
+}
+
+func (tb *RedisTokenBucket) Return() {
+	if _, ok := tb.run(-1); !ok {
+		tb.local.Return()
+	}
+}
+
+func (tb *RedisTokenBucket) Delay() time.Duration {
+	result, ok := tb.run(0)
+	if !ok {
+		return tb.local.Delay()
+	}
+	if result.state.Tokens >= 1 {
+		return 0
+	}
+	if result.state.RefillPerSecond <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration((1 - result.state.Tokens) / result.state.RefillPerSecond * float64(time.Second))
+}
+
+// Set stores a new capacity and refill rate with the shared bucket, every process picks it up on its next take
+func (tb *RedisTokenBucket) Set(capacity int, refillPerSecond float64) {
+	tb.local.Set(capacity, refillPerSecond)
+
+	ctx := context.Background()
+	if err := tb.client.HSet(ctx, tb.key, "capacity", capacity, "refill", refillPerSecond).Err(); err != nil {
+		log.Printf("Error storing the settings of token bucket %s: %v", tb.key, err)
+		return
+	}
+	tb.client.Persist(ctx, tb.key)
+}
+
+func (tb *RedisTokenBucket) State() BucketState {
+	result, ok := tb.run(0)
+	if !ok {
+		return tb.local.State()
+	}
+	return result.state
+}
+
+// RateDecision is the answer of a keyed rate limiter. Reset is when the bucket would be full again,
+// RetryAfter how long a denied caller has to wait for a token.
+type RateDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+func decide(allowed bool, state BucketState) RateDecision {
+	d := RateDecision{Allowed: allowed, Limit: state.Capacity, Remaining: int(state.Tokens)}
+	if state.RefillPerSecond > 0 {
+		d.Reset = time.Duration((float64(state.Capacity) - state.Tokens) / state.RefillPerSecond * float64(time.Second))
+		if !allowed {
+			d.RetryAfter = time.Duration((1 - state.Tokens) / state.RefillPerSecond * float64(time.Second))
+		}
+	}
+	return d
+}
+
+// RedisRateLimiter gives every key, like a client or an API key, a bucket of its own shared through
+// Redis. Buckets of keys nobody used for a while expire.
+type RedisRateLimiter struct {
+	client          redis.Scripter
+	prefix          string
+	capacity        int
+	refillPerSecond float64
+}
+
+func NewRedisRateLimiter(client redis.Scripter, prefix string, capacity int, refillPerSecond float64) *RedisRateLimiter {
+	return &RedisRateLimiter{
+		client:          client,
+		prefix:          prefix,
+		capacity:        capacity,
+		refillPerSecond: refillPerSecond,
+	}
+}
+
+// Allow takes a token from key's bucket
+func (rl *RedisRateLimiter) Allow(key string) (RateDecision, error) {
+	result, err := takeFrom(context.Background(), rl.client, rl.prefix+key, rl.capacity, rl.refillPerSecond, 1)
+	if err != nil {
+		return RateDecision{}, err
+	}
+	return decide(result.allowed, result.state), nil
+}
+
+// KeyedLimiter rate limits every key on its own
+type KeyedLimiter interface {
+	Allow(key string) (RateDecision, error)
+}
+
+// MemoryRateLimiter is a KeyedLimiter for a single process, buckets of keys that would be full again
+// are dropped
+type MemoryRateLimiter struct {
+	mu              sync.Mutex
+	buckets         map[string]*TokenBucket
+	capacity        int
+	refillPerSecond float64
+	lastPrune       time.Time
+}
+
+func NewMemoryRateLimiter(capacity int, refillPerSecond float64) *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		buckets:         make(map[string]*TokenBucket),
+		capacity:        capacity,
+		refillPerSecond: refillPerSecond,
+		lastPrune:       time.Now(),
+	}
+}
+
+// Allow takes a token from key's bucket
+func (rl *MemoryRateLimiter) Allow(key string) (RateDecision, error) {
+	rl.mu.Lock()
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = NewTokenBucket(rl.capacity, rl.refillPerSecond)
+		rl.buckets[key] = bucket
+	}
+	rl.prune()
+	rl.mu.Unlock()
+
+	allowed := bucket.Take()
+	return decide(allowed, bucket.State()), nil
+}
+
+// prune drops full buckets once per refill period, a new bucket starts full anyway
+func (rl *MemoryRateLimiter) prune() {
+	full := time.Duration(float64(rl.capacity) / rl.refillPerSecond * float64(time.Second))
+	if time.Since(rl.lastPrune) < full {
+		return
+	}
+	rl.lastPrune = time.Now()
+	for key, bucket := range rl.buckets {
+		if bucket.State().Tokens >= float64(rl.capacity) {
+			delete(rl.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// sharedRedis starts a miniredis whose clock, which the script reads through TIME, stands still until moved
+func sharedRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	mr := miniredis.RunT(t)
+	mr.SetTime(utc("2026-01-05T12:00:00Z"))
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	t.Cleanup(func() { client.Close() })
+	return mr, client
+}
+
+// takes counts how many of n takes from b are allowed
+func takes(b Limiter, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if b.Take() {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestRedisTokenBucketSharesOneRate(t *testing.T) {
+	mr, client := sharedRedis(t)
+	a := NewRedisTokenBucket(client, "bucket:high", 4, 2)
+	b := NewRedisTokenBucket(client, "bucket:high", 4, 2)
+
+	allowed := 0
+	for i := 0; i < 3; i++ {
+		allowed += takes(a, 1) + takes(b, 1)
+	}
+	if allowed != 4 {
+		t.Fatalf("two buckets on one key allowed %d takes, want the capacity of 4", allowed)
+	}
+	if state := a.State(); state.Tokens != 0 {
+		t.Fatalf("a sees %v tokens after b drained the bucket, want 0", state.Tokens)
+	}
+
+	// Half a second at 2 tokens a second refills one token, for both of them
+	mr.SetTime(utc("2026-01-05T12:00:00.5Z"))
+	if !b.Take() {
+		t.Fatalf("b was denied the refilled token")
+	}
+	if a.Take() {
+		t.Fatalf("a took a token b already took")
+	}
+
+	b.Return()
+	if !a.Take() {
+		t.Fatalf("a was denied the token b returned")
+	}
+}
+
+func TestRedisTokenBucketSetOverridesCapacityAndRefill(t *testing.T) {
+	mr, client := sharedRedis(t)
+	a := NewRedisTokenBucket(client, "bucket:low", 4, 2)
+	b := NewRedisTokenBucket(client, "bucket:low", 4, 2)
+
+	a.Set(10, 5)
+	if state := b.State(); state.Capacity != 10 || state.RefillPerSecond != 5 {
+		t.Fatalf("b sees capacity %d refilling %v a second, want what a set: 10 and 5", state.Capacity, state.RefillPerSecond)
+	}
+	if allowed := takes(b, 12); allowed != 10 {
+		t.Fatalf("b took %d tokens, want the capacity a set of 10", allowed)
+	}
+
+	// 200ms at the 5 a second a set is one token, at b's own 2 a second it would be none
+	mr.SetTime(utc("2026-01-05T12:00:00.2Z"))
+	if allowed := takes(b, 2); allowed != 1 {
+		t.Fatalf("b took %d refilled tokens, want 1", allowed)
+	}
+	if ttl := mr.TTL("bucket:low"); ttl != 0 {
+		t.Errorf("a bucket with stored settings expires in %v, it must persist", ttl)
+	}
+}
+
+func TestRedisTokenBucketKeepsStoredSettings(t *testing.T) {
+	_, client := sharedRedis(t)
+	a := NewRedisTokenBucket(client, "bucket:admin", 4, 2)
+	a.Set(10, 5)
+
+	// A process starting later with the configured defaults doesn't undo what was set at runtime
+	b := NewRedisTokenBucket(client, "bucket:admin", 4, 2)
+	if state := b.State(); state.Capacity != 10 || state.RefillPerSecond != 5 {
+		t.Fatalf("b sees capacity %d refilling %v a second, want what a set: 10 and 5", state.Capacity, state.RefillPerSecond)
+	}
+	if state := b.local.State(); state.Capacity != 10 || state.RefillPerSecond != 5 {
+		t.Fatalf("b falls back to capacity %d refilling %v a second, want the stored 10 and 5", state.Capacity, state.RefillPerSecond)
+	}
+	if allowed := takes(a, 12); allowed != 10 {
+		t.Fatalf("a took %d tokens, want the capacity it set of 10", allowed)
+	}
+}
+
+func TestRedisTokenBucketFallsBackToLocalBucket(t *testing.T) {
+	mr, client := sharedRedis(t)
+	b := NewRedisTokenBucket(client, "bucket:mid", 2, 1)
+	if !b.Take() {
+		t.Fatalf("first take from the shared bucket was denied")
+	}
+
+	// The local bucket hasn't been drawn from, it has its full capacity
+	mr.Close()
+	if allowed := takes(b, 3); allowed != 2 {
+		t.Fatalf("took %d tokens with Redis down, want the local capacity of 2", allowed)
+	}
+	if state := b.State(); state.Capacity != 2 {
+		t.Fatalf("state with Redis down has capacity %d, want the local 2", state.Capacity)
+	}
+
+	// Back on the shared bucket, one token is left from before Redis went down
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("restarting miniredis: %v", err)
+	}
+	if allowed := takes(b, 2); allowed != 1 {
+		t.Fatalf("took %d tokens once Redis was back, want the 1 left in the shared bucket", allowed)
+	}
+}
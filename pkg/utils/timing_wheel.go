@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+type wheelEntry struct {
+	key string
+	at  time.Time
+}
+
+// wheelLevel is one ring of the hierarchy, each slot spans tick and the ring spans tick*len(slots).
+// An entry is due once currentTime has reached its deadline.
+type wheelLevel struct {
+	tick        time.Duration
+	currentTime time.Time
+	slots       [][]wheelEntry
+	overflow    *wheelLevel
+	// cascade marks overflow levels, which hand a slot down as soon as they reach it
+	cascade bool
+}
+
+func newWheelLevel(tick time.Duration, size int, start time.Time) *wheelLevel {
+	return &wheelLevel{
+		tick:        tick,
+		currentTime: floorTick(start, tick),
+		slots:       make([][]wheelEntry, size),
+	}
+}
+
+// floorTick rounds t down to a multiple of tick counted from the Unix epoch, the same base slot
+// counts in. time.Truncate counts from the zero time instead, which coarse overflow ticks don't
+// divide evenly, so a level aligned with it would read its slots out of step with add.
+func floorTick(t time.Time, tick time.Duration) time.Time {
+	return time.Unix(0, t.UnixNano()/int64(tick)*int64(tick))
+}
+
+func (l *wheelLevel) slot(at time.Time) int {
+	return int((at.UnixNano() / int64(l.tick)) % int64(len(l.slots)))
+}
+
+func (l *wheelLevel) take(at time.Time) []wheelEntry {
+	i := l.slot(at)
+	entries := l.slots[i]
+	l.slots[i] = nil
+	return entries
+}
+
+// add places e in this level or an overflow level, it returns false if e is already due
+func (l *wheelLevel) add(e wheelEntry) bool {
+	span := l.tick * time.Duration(len(l.slots))
+	switch {
+	case !e.at.After(l.currentTime):
+		return false
+	case e.at.Before(l.currentTime.Add(span)):
+		i := l.slot(e.at)
+		l.slots[i] = append(l.slots[i], e)
+		return true
+	default:
+		if l.overflow == nil {
+			l.overflow = newWheelLevel(span, len(l.slots), l.currentTime)
+			l.overflow.cascade = true
+		}
+		return l.overflow.add(e)
+	}
+}
+
+// advance moves the level forward to now one tick at a time and hands slot entries to reinsert.
+// The finest level releases a slot once it has moved past it, so entries are never reported
+// early and at worst fire one tick late. Overflow levels release a slot when they reach it so
+// its entries can be spread over the finer level in time.
+func (l *wheelLevel) advance(now time.Time, reinsert func(wheelEntry)) {
+	for !l.currentTime.Add(l.tick).After(now) {
+		var entries []wheelEntry
+		if !l.cascade {
+			entries = l.take(l.currentTime)
+		}
+
+		l.currentTime = l.currentTime.Add(l.tick)
+		if l.cascade {
+			entries = l.take(l.currentTime)
+		}
+		if l.overflow != nil {
+			l.overflow.advance(l.currentTime, reinsert)
+		}
+		for _, e := range entries {
+			reinsert(e)
+		}
+	}
+}
+
+// TimingWheel is a hierarchical timing wheel keyed by string. Adding a key that is already
+// present replaces its deadline, Advance reports every key whose deadline has passed.
+type TimingWheel struct {
+	mu        sync.Mutex
+	root      *wheelLevel
+	deadlines map[string]time.Time
+}
+
+func NewTimingWheel(tick time.Duration, size int, start time.Time) *TimingWheel {
+	return &TimingWheel{
+		root:      newWheelLevel(tick, size, start),
+		deadlines: make(map[string]time.Time),
+	}
+}
+
+// Add schedules key to expire at at, it returns false when at is already due and the key was not stored
+func (tw *TimingWheel) Add(key string, at time.Time) bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if !tw.root.add(wheelEntry{key: key, at: at}) {
+		delete(tw.deadlines, key)
+		return false
+	}
+	tw.deadlines[key] = at
+	return true
+}
+
+func (tw *TimingWheel) Remove(key string) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	delete(tw.deadlines, key)
+}
+
+func (tw *TimingWheel) Len() int {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	return len(tw.deadlines)
+}
+
+// Advance moves the wheel to now and returns the keys that expired on the way
+func (tw *TimingWheel) Advance(now time.Time) []string {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	var expired []string
+	tw.root.advance(now, func(e wheelEntry) {
+		// Entries superseded by a later Add or dropped by Remove are stale copies
+		if at, ok := tw.deadlines[e.key]; !ok || !at.Equal(e.at) {
+			return
+		}
+		if !tw.root.add(e) {
+			delete(tw.deadlines, e.key)
+			expired = append(expired, e.key)
+		}
+	})
+	return expired
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	testTick = 100 * time.Millisecond
+	testSize = 64
+)
+
+// Level spans of the test wheel: 6.4s for the finest level, 409.6s and 26214.4s for the overflow levels
+var testSpans = []time.Duration{testTick * testSize, testTick * testSize * testSize, testTick * testSize * testSize * testSize}
+
+// runWheel advances tw tick by tick from start to until and records when each key expired
+func runWheel(tw *TimingWheel, start, until time.Time) map[string]time.Time {
+	fired := make(map[string]time.Time)
+	for now := start; !now.After(until); now = now.Add(testTick) {
+		for _, key := range tw.Advance(now) {
+			if _, ok := fired[key]; ok {
+				panic(fmt.Sprintf("%s expired twice", key))
+			}
+			fired[key] = now
+		}
+	}
+	return fired
+}
+
+// checkFired fails unless key expired no earlier than at and within two ticks, one for the
+// wheel's own granularity and one for runWheel's steps, which are out of phase with it
+func checkFired(t *testing.T, fired map[string]time.Time, key string, at time.Time) {
+	t.Helper()
+	got, ok := fired[key]
+	if !ok {
+		t.Errorf("%s due at %v never expired", key, at)
+		return
+	}
+	if got.Before(at) || got.Sub(at) >= 2*testTick {
+		t.Errorf("%s due at %v expired at %v, %v off", key, at, got, got.Sub(at))
+	}
+}
+
+func TestTimingWheelLevelBoundaries(t *testing.T) {
+	// Neither the wheel's start nor the level boundaries line up with round times
+	for _, start := range []time.Time{utc("2026-01-05T12:00:00Z"), utc("2026-01-05T12:03:17.45Z")} {
+		t.Run(start.Format(time.RFC3339Nano), func(t *testing.T) {
+			tw := NewTimingWheel(testTick, testSize, start)
+			due := make(map[string]time.Time)
+			for level, span := range testSpans {
+				for _, delay := range []time.Duration{span - testTick, span - time.Millisecond, span, span + time.Millisecond, span + testTick, 2*span + 30*time.Millisecond} {
+					key := fmt.Sprintf("level%d+%v", level, delay)
+					due[key] = start.Add(delay)
+					if !tw.Add(key, due[key]) {
+						t.Fatalf("adding %s reported it due", key)
+					}
+				}
+			}
+
+			fired := runWheel(tw, start, start.Add(2*testSpans[2]+time.Second))
+			for key, at := range due {
+				checkFired(t, fired, key, at)
+			}
+			if tw.Len() != 0 {
+				t.Errorf("%d keys left in the wheel", tw.Len())
+			}
+		})
+	}
+}
+
+func TestTimingWheelCascades(t *testing.T) {
+	start := utc("2026-01-05T12:00:00.03Z")
+	tw := NewTimingWheel(testTick, testSize, start)
+
+	// Keys spread over every level, each is handed down level by level before it expires
+	due := make(map[string]time.Time)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("job%03d", i)
+		due[key] = start.Add(time.Duration(i*i) * 137 * time.Millisecond)
+		if i > 0 && !tw.Add(key, due[key]) {
+			t.Fatalf("adding %s reported it due", key)
+		}
+	}
+	delete(due, "job000")
+
+	fired := runWheel(tw, start, start.Add(499*499*137*time.Millisecond+time.Second))
+	if len(fired) != len(due) {
+		t.Errorf("%d keys expired, want %d", len(fired), len(due))
+	}
+	for key, at := range due {
+		checkFired(t, fired, key, at)
+	}
+}
+
+func TestTimingWheelAddAndRemove(t *testing.T) {
+	start := utc("2026-01-05T12:00:00Z")
+	tw := NewTimingWheel(testTick, testSize, start)
+
+	if tw.Add("due", start) {
+		t.Errorf("adding a key due at the wheel's time stored it")
+	}
+
+	far := start.Add(testSpans[1] + time.Minute)
+	tw.Add("removed", far)
+	tw.Add("moved-earlier", far)
+	tw.Add("moved-later", start.Add(time.Second))
+	tw.Add("kept", far)
+
+	tw.Remove("removed")
+	earlier := start.Add(3 * time.Second)
+	tw.Add("moved-earlier", earlier)
+	later := start.Add(testSpans[2] + time.Minute)
+	tw.Add("moved-later", later)
+	if tw.Len() != 3 {
+		t.Fatalf("the wheel holds %d keys, want 3", tw.Len())
+	}
+
+	fired := runWheel(tw, start, later.Add(time.Second))
+	if _, ok := fired["removed"]; ok {
+		t.Errorf("a removed key expired")
+	}
+	checkFired(t, fired, "moved-earlier", earlier)
+	checkFired(t, fired, "moved-later", later)
+	checkFired(t, fired, "kept", far)
+	if len(fired) != 3 {
+		t.Errorf("%d keys expired, want 3: %v", len(fired), fired)
+	}
+}
@@ -1,43 +1,99 @@
 package utils
 
 import (
-    "sync"
-    "time"
+	"math"
+	"sync"
+	"time"
 )
 
+// TokenBucket holds up to capacity tokens and gains refill tokens per second. Tokens are added for the
+// time that passed whenever the bucket is used, so no goroutine has to tick it and a slow tick can't
+// lose refills.
 type TokenBucket struct {
-	capacity int
-	tokens   int
-	rate     time.Duration
 	mu       sync.Mutex
+	capacity int
+	refill   float64
+	tokens   float64
+	last     time.Time
+}
+
+// BucketState is a snapshot of a bucket
+type BucketState struct {
+	Capacity        int     `json:"capacity"`
+	RefillPerSecond float64 `json:"refill_per_second"`
+	Tokens          float64 `json:"tokens"`
 }
 
-func NewTokenBucket(capacity int, rate time.Duration) *TokenBucket {
+// NewTokenBucket returns a full bucket
+func NewTokenBucket(capacity int, refillPerSecond float64) *TokenBucket {
 	return &TokenBucket{
 		capacity: capacity,
-		tokens:   capacity,
-		rate:     rate,
+		refill:   refillPerSecond,
+		tokens:   float64(capacity),
+		last:     time.Now(),
+	}
+}
+
+// advance adds the tokens earned since the bucket was last used
+func (tb *TokenBucket) advance(now time.Time) {
+	if elapsed := now.Sub(tb.last).Seconds(); elapsed > 0 {
+		tb.tokens = math.Min(float64(tb.capacity), tb.tokens+elapsed*tb.refill)
 	}
+	tb.last = now
 }
 
+// Take removes a token, it reports false when the bucket is empty
 func (tb *TokenBucket) Take() bool {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
 
-	if tb.tokens > 0 {
+	tb.advance(time.Now())
+	if tb.tokens >= 1 {
 		tb.tokens--
 		return true
 	}
 	return false
 }
 
-func (tb *TokenBucket) Refill() {
-	for {
-		time.Sleep(tb.rate)
-		tb.mu.Lock()
-		if tb.tokens < tb.capacity {
-			tb.tokens++
-		}
-		tb.mu.Unlock()
+// Return gives back a token that was taken but not used
+func (tb *TokenBucket) Return() {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.advance(time.Now())
+	tb.tokens = math.Min(float64(tb.capacity), tb.tokens+1)
+}
+
+// Delay is how long until the bucket has a token, 0 if it has one now
+func (tb *TokenBucket) Delay() time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.advance(time.Now())
+	if tb.tokens >= 1 {
+		return 0
+	}
+	if tb.refill <= 0 {
+		return time.Duration(math.MaxInt64)
 	}
-}
\ No newline at end of file
+	return time.Duration((1 - tb.tokens) / tb.refill * float64(time.Second))
+}
+
+// Set changes the capacity and refill rate, the tokens already in the bucket are kept up to the new capacity
+func (tb *TokenBucket) Set(capacity int, refillPerSecond float64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.advance(time.Now())
+	tb.capacity = capacity
+	tb.refill = refillPerSecond
+	tb.tokens = math.Min(float64(capacity), tb.tokens)
+}
+
+func (tb *TokenBucket) State() BucketState {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.advance(time.Now())
+	return BucketState{Capacity: tb.capacity, RefillPerSecond: tb.refill, Tokens: tb.tokens}
+}
@@ -46,4 +46,12 @@ func ValidateId(id string) bool {
 
 func GenerateWorkerId() string {
 	return uuid.New().String()
-}
\ No newline at end of file
+}
+
+func GenerateExecutorId() string {
+	return uuid.New().String()
+}
+
+func GenerateAPIKeyId() string {
+	return uuid.New().String()
+}